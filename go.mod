@@ -5,12 +5,16 @@ go 1.15
 require (
 	github.com/adejoux/grafanaclient v0.2.0
 	github.com/adejoux/influxdbclient v0.0.0-20190306152914-598f21461b64
+	github.com/golang/snappy v0.0.3
 	github.com/goreleaser/goreleaser v0.148.0 // indirect
-	github.com/influxdata/influxdb1-client v0.0.0-20200827194710-b269163b24ab // indirect
+	github.com/influxdata/influxdb1-client v0.0.0-20200827194710-b269163b24ab
+	github.com/klauspost/compress v1.11.0
 	github.com/kylelemons/godebug v1.1.0 // indirect
 	github.com/naoina/go-stringutil v0.1.0 // indirect
 	github.com/naoina/toml v0.1.1
 	github.com/pkg/sftp v1.12.0
+	github.com/ulikunitz/xz v0.5.8
 	github.com/urfave/cli/v2 v2.3.0
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/crypto v0.0.0-20201124201722-c8d3bf9c5392
 )
@@ -16,10 +16,11 @@ import (
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
+	"sort"
+	"strings"
 	"text/template"
 	"time"
 
-	"github.com/adejoux/influxdbclient"
 	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
 	"github.com/urfave/cli/v2"
 )
@@ -27,7 +28,8 @@ import (
 // HMC contains the base struct used by all the hmc sub command
 type HMC struct {
 	Session             *Session
-	InfluxDB            *influxdbclient.InfluxDB
+	InfluxDB            nmon2influxdblib.PointWriter
+	Output              *nmon2influxdblib.LineProtocolFile
 	GlobalPoint         Point
 	FilterManagedSystem string
 	Debug               bool
@@ -35,6 +37,21 @@ type HMC struct {
 	Samples             int
 	TagParsers          nmon2influxdblib.TagParsers
 	Token               string
+	Calculations        map[string]nmon2influxdblib.Calculations
+	sample              pcmSample
+	// points counts reported at the end of the import
+	written  int64
+	failed   int64
+	rejected int64
+}
+
+// pcmSample stores the values of the points sharing the same measurement, tags and timestamp to compute the calculated metrics
+type pcmSample struct {
+	measurement string
+	key         string
+	tags        map[string]string
+	timestamp   time.Time
+	values      map[string]float64
 }
 
 // Point is a struct to simplify InfluxDB point creation
@@ -61,18 +78,19 @@ type Point struct {
 }
 
 //NewHMC return a new HMC struct and use the command line and config file parameters to intialize it.
-func NewHMC(c *cli.Context) *HMC {
+func NewHMC(c *cli.Context) (*HMC, error) {
 
 	var hmc HMC
 	// parsing parameters
-	config := nmon2influxdblib.ParseParameters(c)
+	config, err := nmon2influxdblib.ParseParameters(c)
+	if err != nil {
+		return nil, err
+	}
 
 	if config.Debug {
 		log.Printf("configuration: %+v\n", config.Sanitized())
 	}
 
-	//getting databases connections
-	hmc.InfluxDB = config.GetDB("hmc")
 	hmc.ManagedSystemOnly = config.HMCManagedSystemOnly
 	hmc.Samples = config.HMCSamples
 	hmc.Debug = config.Debug
@@ -82,22 +100,76 @@ func NewHMC(c *cli.Context) *HMC {
 		//Build tag parsing
 		hmc.TagParsers = nmon2influxdblib.ParseInputs(config.Inputs)
 	}
+	calculations, err := nmon2influxdblib.ParseCalculations(config.Calculations)
+	if err != nil {
+		return nil, err
+	}
+	hmc.Calculations = calculations
 	hmcURL := fmt.Sprintf("https://"+"%s"+":12443", config.HMCServer)
 	//initialize new http session
-	hmc.Session = NewSession(config.HMCUser, config.HMCPassword, hmcURL, config.HMCTimeout)
-	hmc.Token = hmc.Session.doLogon()
+	hmc.Session, err = NewSession(config.HMCUser, config.HMCPassword, hmcURL, config.HMCTimeout)
+	if err != nil {
+		return nil, err
+	}
+	hmc.Token, err = hmc.Session.doLogon()
+	if err != nil {
+		return nil, err
+	}
+
+	//getting databases connections. The output file is only created once the HMC is reachable.
+	if len(config.OutputFile) > 0 {
+		output, err := nmon2influxdblib.CreateLineProtocolFile(config.OutputFile)
+		if err != nil {
+			return nil, err
+		}
+		hmc.Output = output
+		hmc.InfluxDB = output.NewWriter()
+	} else if len(config.RemoteWriteURL) > 0 {
+		hmc.InfluxDB = config.NewRetryWriter(config.NewRemoteWriter())
+	} else {
+		db, err := config.GetDB("hmc")
+		if err != nil {
+			return nil, err
+		}
+		hmc.InfluxDB = config.NewRetryWriter(db)
+	}
 
-	return &hmc
+	return &hmc, nil
 }
 
-// WritePoints send points to InfluxDB database and reset points count
+// WritePoints send points to InfluxDB database and reset points count. The points are dropped if they can't be written.
+// The failed and rejected points are counted for the import summary.
 func (hmc *HMC) WritePoints() (err error) {
+	hmc.addCalculatedPoints()
+	count := hmc.InfluxDB.PointsCount()
 	err = hmc.InfluxDB.WritePoints()
-	nmon2influxdblib.CheckError(err)
+	if err != nil {
+		log.Printf("unable to write %d points: %s\n", count, err)
+		hmc.failed += count
+	}
+	if retryWriter, ok := hmc.InfluxDB.(*nmon2influxdblib.RetryWriter); ok {
+		if rejected, messages := retryWriter.TakeRejected(); rejected > 0 {
+			log.Printf("%d points rejected: %s\n", rejected, messages[0])
+			hmc.rejected += rejected
+			count -= rejected
+		}
+	}
+	if err == nil {
+		hmc.written += count
+	}
 	hmc.InfluxDB.ClearPoints()
 	return
 }
 
+// summary returns the points counts of the import and an error if points were lost
+func (hmc *HMC) summary() (string, error) {
+	summary := fmt.Sprintf("%d points written, %d points not written, %d points rejected", hmc.written, hmc.failed, hmc.rejected)
+	if hmc.failed+hmc.rejected > 0 {
+		return summary, cli.Exit(fmt.Sprintf("%d points lost", hmc.failed+hmc.rejected), 1)
+	}
+	return summary, nil
+}
+
 // AddPoint add a InfluxDB point. It's using the GlobalPoint parameter to fill some fields
 func (hmc *HMC) AddPoint(name string, metric string, values []float64) {
 
@@ -145,10 +217,19 @@ func (hmc *HMC) AddPoint(name string, metric string, values []float64) {
 	}
 	field := map[string]interface{}{"value": value}
 
-	// Checking additional tagging
+	if len(hmc.Calculations[point.Name]) > 0 {
+		hmc.collect(point.Name, tags, value)
+	}
+
+	hmc.applyTagParsers(point.Name, tags)
+	hmc.InfluxDB.AddPoint(point.Name, hmc.GlobalPoint.Timestamp, field, tags)
+}
+
+// applyTagParsers adds the custom tags matching the point tags
+func (hmc *HMC) applyTagParsers(measurement string, tags map[string]string) {
 	for key, value := range tags {
-		if _, ok := hmc.TagParsers[point.Name][key]; ok {
-			for _, tagParser := range hmc.TagParsers[point.Name][key] {
+		if _, ok := hmc.TagParsers[measurement][key]; ok {
+			for _, tagParser := range hmc.TagParsers[measurement][key] {
 				if tagParser.Regexp.MatchString(value) {
 					tags[tagParser.Name] = tagParser.Value
 				}
@@ -162,7 +243,45 @@ func (hmc *HMC) AddPoint(name string, metric string, values []float64) {
 			}
 		}
 	}
-	hmc.InfluxDB.AddPoint(point.Name, hmc.GlobalPoint.Timestamp, field, tags)
+}
+
+// collect stores the point value in the current sample. The calculated metrics of the previous sample are added when the measurement, the tags or the timestamp change.
+func (hmc *HMC) collect(measurement string, tags map[string]string, value float64) {
+	var keys []string
+	for key, tagValue := range tags {
+		if key != "name" {
+			keys = append(keys, key+"="+tagValue)
+		}
+	}
+	sort.Strings(keys)
+	key := measurement + "," + strings.Join(keys, ",") + "," + hmc.GlobalPoint.Timestamp.String()
+
+	if key != hmc.sample.key {
+		hmc.addCalculatedPoints()
+		sampleTags := make(map[string]string, len(tags))
+		for tagKey, tagValue := range tags {
+			sampleTags[tagKey] = tagValue
+		}
+		hmc.sample = pcmSample{measurement: measurement, key: key, tags: sampleTags, timestamp: hmc.GlobalPoint.Timestamp, values: make(map[string]float64)}
+	}
+	hmc.sample.values[tags["name"]] = value
+}
+
+// addCalculatedPoints adds the calculated metrics of the current sample
+func (hmc *HMC) addCalculatedPoints() {
+	if len(hmc.sample.key) == 0 {
+		return
+	}
+	for _, result := range hmc.Calculations[hmc.sample.measurement].Evaluate(hmc.sample.values) {
+		tags := make(map[string]string, len(hmc.sample.tags))
+		for key, value := range hmc.sample.tags {
+			tags[key] = value
+		}
+		tags["name"] = result.Name
+		hmc.applyTagParsers(hmc.sample.measurement, tags)
+		hmc.InfluxDB.AddPoint(hmc.sample.measurement, hmc.sample.timestamp, map[string]interface{}{"value": result.Value}, tags)
+	}
+	hmc.sample = pcmSample{}
 }
 
 //
@@ -220,19 +339,19 @@ type Session struct {
 }
 
 // NewSession initialize a Session struct
-func NewSession(user string, password string, url string, timeout int) *Session {
+func NewSession(user string, password string, url string, timeout int) (*Session, error) {
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
 
 	jar, err := cookiejar.New(nil)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	log.Printf("Session Timeout %d\n", timeout)
 
-	return &Session{client: &http.Client{Transport: tr, Jar: jar, Timeout: time.Second * time.Duration(timeout)}, User: user, Password: password, url: url}
+	return &Session{client: &http.Client{Transport: tr, Jar: jar, Timeout: time.Second * time.Duration(timeout)}, User: user, Password: password, url: url}, nil
 }
 
 type Token struct {
@@ -240,7 +359,7 @@ type Token struct {
 }
 
 // doLogon performs the login to the inflxudb instance
-func (s *Session) doLogon() string {
+func (s *Session) doLogon() (string, error) {
 
 	authurl := s.url + "/rest/api/web/Logon"
 
@@ -259,10 +378,13 @@ func (s *Session) doLogon() string {
 	authrequest := new(bytes.Buffer)
 	err := tmpl.Execute(authrequest, s)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
 	request, err := http.NewRequest("PUT", authurl, authrequest)
+	if err != nil {
+		return "", err
+	}
 
 	// set request headers
 	request.Header.Set("Content-Type", "application/vnd.ibm.powervm.web+xml; type=LogonRequest")
@@ -271,25 +393,31 @@ func (s *Session) doLogon() string {
 
 	response, err := s.client.Do(request)
 	if err != nil {
-		log.Fatalf("HMC error sending auth request: %v\n", err)
-	} else {
-		defer response.Body.Close()
-		if response.StatusCode != 200 {
-			log.Fatalf("HMC authentication error: %s\n", response.Status)
-		}
+		return "", fmt.Errorf("HMC error sending auth request: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 200 {
+		return "", &nmon2influxdblib.HTTPError{StatusCode: response.StatusCode, Message: "HMC authentication error: " + response.Status}
 	}
 
 	// store session token
 	var token Token
 	bodyBytes, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
 	xml.Unmarshal([]byte(bodyBytes), &token)
 	// log.Printf("%v", token.API)
-	return token.API
+	return token.API, nil
 }
 
-func (s *Session) DoLogoff(token string) {
+// DoLogoff closes the HMC session
+func (s *Session) DoLogoff(token string) error {
 	authurl := s.url + "/rest/api/web/Logon"
 	request, err := http.NewRequest("DELETE", authurl, nil)
+	if err != nil {
+		return err
+	}
 
 	// set request headers
 	// log.Printf("%v", token)
@@ -297,15 +425,14 @@ func (s *Session) DoLogoff(token string) {
 	response, err := s.client.Do(request)
 
 	if err != nil {
-		log.Fatalf("HMC error sending auth request: %v\n", err)
-	} else {
-		defer response.Body.Close()
-		if response.StatusCode != 204 {
-			log.Fatalf("HMC logoff error: %s\n", response.Status)
-		} else {
-			log.Printf("Succesfully logged off")
-		}
+		return fmt.Errorf("HMC error sending auth request: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != 204 {
+		return &nmon2influxdblib.HTTPError{StatusCode: response.StatusCode, Message: "HMC logoff error: " + response.Status}
 	}
+	log.Printf("Succesfully logged off")
+	return nil
 }
 
 // PCMLinks store a system and associated partitions links to PCM data
@@ -427,7 +554,7 @@ func (s *Session) getPCMData(rawurl string, debug bool) (PCMData, error) {
 	}
 
 	if response.StatusCode != 200 {
-		log.Fatalf("Error getting PCM Data informations. status code: %d", response.StatusCode)
+		return data, &nmon2influxdblib.HTTPError{StatusCode: response.StatusCode, Message: fmt.Sprintf("Error getting PCM Data informations. status code: %d", response.StatusCode)}
 	}
 
 	jsonErr := json.Unmarshal(contents, &data)
@@ -463,7 +590,7 @@ func (s *Session) getManagedSystems() (systems []System, err error) {
 	}
 
 	if response.StatusCode != 200 {
-		log.Fatalf("Error getting LPAR informations. status code: %d", response.StatusCode)
+		return systems, &nmon2influxdblib.HTTPError{StatusCode: response.StatusCode, Message: fmt.Sprintf("Error getting LPAR informations. status code: %d", response.StatusCode)}
 	}
 
 	var feed Feed
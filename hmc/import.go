@@ -11,16 +11,26 @@ import (
 	"strings"
 	"time"
 
-	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
 	"github.com/urfave/cli/v2"
 )
 
 const timeFormat = "2006-01-02T15:04:05-0700"
 
 //Import is the entry point for subcommand hmc
-func Import(c *cli.Context) error {
+func Import(c *cli.Context) (err error) {
 	//new hmc session
-	hmc := NewHMC(c)
+	hmc, err := NewHMC(c)
+	if err != nil {
+		return err
+	}
+	// the output file is closed even if the import fails. Its close error is returned if the import succeeded.
+	if hmc.Output != nil {
+		defer func() {
+			if closeErr := hmc.Output.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+	}
 
 	if hmc.Samples > 0 {
 		log.Printf("Fetching %d latest samples. 30 seconds interval.\n", hmc.Samples)
@@ -30,7 +40,9 @@ func Import(c *cli.Context) error {
 
 	log.Printf("Getting list of managed systems\n")
 	systems, GetSysErr := hmc.GetManagedSystems()
-	nmon2influxdblib.CheckError(GetSysErr)
+	if GetSysErr != nil {
+		return GetSysErr
+	}
 
 	for _, system := range systems {
 		if len(hmc.FilterManagedSystem) > 0 {
@@ -52,11 +64,17 @@ func Import(c *cli.Context) error {
 
 		// Get Managed System PCM metrics
 		data, err := hmc.GetPCMData(pcmlinks.System)
-		nmon2influxdblib.CheckError(err)
+		if err != nil {
+			log.Printf("Error getting PCM data: %s\n", err)
+			continue
+		}
 		for _, sample := range data.SystemUtil.UtilSamples {
 
 			timestamp, timeErr := time.Parse(timeFormat, sample.SampleInfo.TimeStamp)
-			nmon2influxdblib.CheckError(timeErr)
+			if timeErr != nil {
+				log.Printf("Skipping sample: %s\n", timeErr)
+				continue
+			}
 
 			//Set timestamp common to all this points
 			hmc.GlobalPoint.Timestamp = timestamp
@@ -183,7 +201,10 @@ func Import(c *cli.Context) error {
 			for _, lparLink := range lparLinks.Partitions {
 				hmc.GlobalPoint = Point{System: system.Name}
 				lparData, getErr := hmc.GetPCMData(lparLink)
-				nmon2influxdblib.CheckError(getErr)
+				if getErr != nil {
+					log.Printf("Error getting PCM data: %s\n", getErr)
+					continue
+				}
 
 				for _, sample := range lparData.SystemUtil.UtilSamples {
 					// if sample status equal 1 we have no data in this sample
@@ -193,7 +214,10 @@ func Import(c *cli.Context) error {
 					}
 
 					timestamp, timeErr := time.Parse(timeFormat, sample.SampleInfo.TimeStamp)
-					nmon2influxdblib.CheckError(timeErr)
+					if timeErr != nil {
+						log.Printf("Skipping sample: %s\n", timeErr)
+						continue
+					}
 					//Set timestamp common to all this points
 					hmc.GlobalPoint.Timestamp = timestamp
 
@@ -286,6 +310,10 @@ func Import(c *cli.Context) error {
 			}
 		}
 	}
-	hmc.Session.DoLogoff(hmc.Token)
-	return nil
+	if err := hmc.Session.DoLogoff(hmc.Token); err != nil {
+		log.Println(err)
+	}
+	summary, err := hmc.summary()
+	log.Println(summary)
+	return err
 }
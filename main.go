@@ -6,6 +6,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 
@@ -18,7 +19,10 @@ import (
 func main() {
 	config := nmon2influxdblib.InitConfig()
 
-	cfgfile := config.LoadCfgFile()
+	cfgfile, err := config.LoadCfgFile()
+	if err != nil {
+		log.Fatal(err)
+	}
 	if len(config.DebugFile) > 0 {
 		debugFile, err := os.OpenFile("config.DebugFile", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 		if err != nil {
@@ -70,6 +74,18 @@ func main() {
 		os.Setenv("NMON2INFLUXDB_HMC_USER", config.HMCServer)
 	}
 
+	// the state store flag is also available in the import sub commands
+	stateFileFlag := &cli.StringFlag{
+		Name:  "state_file",
+		Usage: fmt.Sprintf("local state store file used instead of the import log database, like %s", nmon2influxdblib.DefaultStateFile),
+		Value: config.ImportStateFile,
+	}
+	mappingFlag := &cli.StringFlag{
+		Name:  "mapping",
+		Usage: "file keeping the pseudonyms of the anonymized identifiers",
+		Value: config.AnonymizeMapping,
+	}
+
 	app := cli.NewApp()
 	app.Name = "nmon2influxdb"
 	app.Usage = "upload NMON stats to InfluxDB database"
@@ -108,6 +124,61 @@ func main() {
 					Usage:   "force import",
 					EnvVars: []string{"NMON2INFLUXDB_FORCE"},
 				},
+				&cli.BoolFlag{
+					Name:  "follow",
+					Usage: "follow a nmon file or the newest nmon file of a directory while it's recorded",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "parse the nmon files and report what would be imported without writing anything",
+				},
+				&cli.BoolFlag{
+					Name:  "replace",
+					Usage: "delete the points of the nmon host during the time frame of each file before importing it again",
+				},
+				&cli.StringFlag{
+					Name:  "resample",
+					Usage: "aggregate the points over windows of this duration, like 5m",
+					Value: config.ImportResample,
+				},
+				&cli.StringFlag{
+					Name:  "agg",
+					Usage: "aggregation of the resampled points: mean, max or p95",
+					Value: config.ImportAggregation,
+				},
+				&cli.StringFlag{
+					Name:  "raw_prefix",
+					Usage: "also write the raw points of the resampled files in measurements with this prefix",
+					Value: config.ImportRawPrefix,
+				},
+				&cli.StringFlag{
+					Name:  "raw_database",
+					Usage: "also write the raw points of the resampled files in this database",
+					Value: config.ImportRawDatabase,
+				},
+				&cli.BoolFlag{
+					Name:  "anonymize",
+					Usage: "replace the host names, serial numbers, filesystems and users by their pseudonyms",
+				},
+				mappingFlag,
+				&cli.StringFlag{
+					Name:  "format",
+					Usage: "dry run report format: text or json",
+					Value: "text",
+				},
+				&cli.BoolFlag{
+					Name:    "inventory",
+					Usage:   "import the configuration sections as inventory measurements",
+					EnvVars: []string{"NMON2INFLUXDB_INVENTORY"},
+				},
+				&cli.StringFlag{
+					Name:  "name",
+					Usage: "name of the nmon data read from stdin or a named pipe in the import log",
+				},
+				&cli.StringSliceFlag{
+					Name:  "file_tz",
+					Usage: "timezone of a nmon file, like lpar1_240101_0000.nmon=Asia/Singapore. Can be repeated",
+				},
 				&cli.StringFlag{
 					Name:  "log_database",
 					Usage: "influxdb database used to log imports",
@@ -118,8 +189,89 @@ func main() {
 					Usage: "import log retention",
 					Value: config.ImportLogRetention,
 				},
+				&cli.StringFlag{
+					Name:  "journal_database",
+					Usage: "influxdb database used to record the import history",
+					Value: config.JournalDatabase,
+				},
+				&cli.StringFlag{
+					Name:  "journal_retention",
+					Usage: "import history retention",
+					Value: config.JournalRetention,
+				},
+				&cli.IntFlag{
+					Name:    "jobs",
+					Aliases: []string{"j"},
+					Usage:   "number of files imported in parallel",
+					Value:   config.ImportJobs,
+				},
+				&cli.IntFlag{
+					Name:  "rate",
+					Usage: "maximum number of points written per second. 0 for no limit",
+					Value: config.ImportWriteRate,
+				},
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Usage:   "write points in InfluxDB line protocol to this file instead of InfluxDB. gzipped if ending with .gz",
+				},
+				&cli.StringFlag{
+					Name:  "remote_write",
+					Usage: "send points to this Prometheus remote write URL instead of InfluxDB",
+					Value: config.RemoteWriteURL,
+				},
+				stateFileFlag,
 			},
 			Action: nmon.Import,
+			Subcommands: []*cli.Command{
+				{
+					Name:  "history",
+					Usage: "list the imports recorded in the import log",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "host",
+							Usage: "only for specified host",
+						},
+						&cli.StringFlag{
+							Name:  "since",
+							Usage: "only the imports since a duration like 7d or a date like 2006-01-02",
+						},
+						stateFileFlag,
+					},
+					Action: nmon.History,
+				},
+				{
+					Name:  "state",
+					Usage: "inspect and reset the local state store",
+					Subcommands: []*cli.Command{
+						{
+							Name:  "list",
+							Usage: "list the files recorded in the local state store",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:  "host",
+									Usage: "only for specified host",
+								},
+								stateFileFlag,
+							},
+							Action: nmon.StateList,
+						},
+						{
+							Name:      "reset",
+							Usage:     "remove files from the local state store to import them again",
+							ArgsUsage: "[file...]",
+							Flags: []cli.Flag{
+								&cli.BoolFlag{
+									Name:  "all",
+									Usage: "remove all the files",
+								},
+								stateFileFlag,
+							},
+							Action: nmon.StateReset,
+						},
+					},
+				},
+			},
 		},
 		{
 			Name:  "dashboard",
@@ -227,6 +379,95 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:      "check",
+			Usage:     "check the structure of nmon files",
+			ArgsUsage: "file...",
+			Action:    nmon.Check,
+		},
+		{
+			Name:      "split",
+			Usage:     "split nmon files by day or by hour",
+			ArgsUsage: "file...",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "by",
+					Usage: "day or hour",
+					Value: "day",
+				},
+				&cli.StringFlag{
+					Name:  "dir",
+					Usage: "directory of the split files",
+					Value: ".",
+				},
+			},
+			Action: nmon.Split,
+		},
+		{
+			Name:      "merge",
+			Usage:     "merge the nmon files of a host",
+			ArgsUsage: "file...",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Usage:   "merged file, <host>_<date>_<time>.nmon by default",
+				},
+			},
+			Action: nmon.Merge,
+		},
+		{
+			Name:      "anonymize",
+			Usage:     "anonymize nmon files before sharing them",
+			ArgsUsage: "file...",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "dir",
+					Usage: "directory of the anonymized files",
+					Value: ".",
+				},
+				mappingFlag,
+			},
+			Action: nmon.Anonymize,
+		},
+		{
+			Name:  "purge",
+			Usage: "delete the points of a host and clear its import journal",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "host",
+					Usage: "mandatory host to purge",
+				},
+				&cli.StringFlag{
+					Name:  "from",
+					Usage: "from date, like 2006-01-02 or 2006-01-02 15:04:05",
+				},
+				&cli.StringFlag{
+					Name:  "to",
+					Usage: "to date, like 2006-01-02 or 2006-01-02 15:04:05",
+				},
+				&cli.StringFlag{
+					Name:  "measurement",
+					Usage: "only this measurement",
+				},
+				&cli.BoolFlag{
+					Name:  "hmc",
+					Usage: "purge a partition in the HMC database",
+				},
+				&cli.StringFlag{
+					Name:  "log_database",
+					Usage: "influxdb database used to log imports",
+					Value: config.ImportLogDatabase,
+				},
+				&cli.StringFlag{
+					Name:  "journal_database",
+					Usage: "influxdb database used to record the import history",
+					Value: config.JournalDatabase,
+				},
+				stateFileFlag,
+			},
+			Action: nmon.Purge,
+		},
 		{
 			Name:  "hmc",
 			Usage: "load hmc data",
@@ -270,6 +511,16 @@ func main() {
 							Usage: "HMC connection timeout",
 							Value: config.HMCTimeout,
 						},
+						&cli.StringFlag{
+							Name:    "output",
+							Aliases: []string{"o"},
+							Usage:   "write points in InfluxDB line protocol to this file instead of InfluxDB. gzipped if ending with .gz",
+						},
+						&cli.StringFlag{
+							Name:  "remote_write",
+							Usage: "send points to this Prometheus remote write URL instead of InfluxDB",
+							Value: config.RemoteWriteURL,
+						},
 					},
 				},
 			},
@@ -327,9 +578,16 @@ func main() {
 			Usage: "timezone",
 			Value: config.Timezone,
 		},
+		&cli.StringFlag{
+			Name:  "schema",
+			Usage: "points schema: narrow (one point by column) or wide (one point by section line with columns as fields)",
+			Value: config.ImportSchema,
+		},
 	}
 	app.Authors = []*cli.Author{{Name: "Alain Dejoux", Email: "adejoux@djouxtech.net"},
 				    {Name: "Valery Grusdev", Email: "valery@grusdev.com"}}
-	app.Run(os.Args)
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
 
 }
@@ -0,0 +1,361 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+	"github.com/urfave/cli/v2"
+)
+
+var ipRegexp = regexp.MustCompile(`\b\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}\b`)
+var ipv6Regexp = regexp.MustCompile(`(?:[0-9A-Fa-f]{0,4}:){2,7}(?:\d{1,3}(?:\.\d{1,3}){3}|[0-9A-Fa-f]{1,4})?`)
+var macRegexp = regexp.MustCompile(`\b[0-9A-Fa-f]{2}(?:[:-][0-9A-Fa-f]{2}){5}\b`)
+var lscfgAddressRegexp = regexp.MustCompile(`Network Address\.{2,}([0-9A-Fa-f]{12})\b`)
+var pathRegexp = regexp.MustCompile(`/[\w.\-/]*`)
+var wordRegexp = regexp.MustCompile(`[A-Za-z0-9-]+`)
+
+// filesystemSections are the sections whose columns are filesystem paths
+var filesystemSections = map[string]bool{"JFSFILE": true, "JFSINODE": true}
+
+// systemPaths are the standard filesystems kept as they are
+var systemPaths = map[string]bool{
+	"/": true, "/usr": true, "/var": true, "/tmp": true, "/home": true, "/opt": true, "/admin": true, "/root": true,
+	"/proc": true, "/dev": true, "/dev/shm": true, "/run": true, "/boot": true, "/sys": true, "/var/adm/ras/livedump": true,
+}
+
+// pseudonym returns the pseudonym of the identifier when the import is anonymized
+func (nmon *Nmon) pseudonym(kind string, value string) string {
+	if nmon.mapping == nil {
+		return value
+	}
+	return nmon.mapping.Pseudonym(kind, value)
+}
+
+// anonymizeColumns replaces the filesystem paths of the JFS sections when the import is anonymized
+func (nmon *Nmon) anonymizeColumns(name string, columns []string) []string {
+	if nmon.mapping == nil || !filesystemSections[name] {
+		return columns
+	}
+	anonymized := make([]string, len(columns))
+	for i, column := range columns {
+		anonymized[i] = anonymizePath(nmon.mapping, column)
+	}
+	return anonymized
+}
+
+// anonymizePath returns the pseudonym of a filesystem path. The system filesystems are kept.
+func anonymizePath(mapping *nmon2influxdblib.Mapping, path string) string {
+	path = strings.TrimSpace(path)
+	if systemPaths[path] || !strings.HasPrefix(path, "/") {
+		return path
+	}
+	return mapping.Pseudonym(nmon2influxdblib.PathIdentifier, path)
+}
+
+// anonymizer replaces the identifiers found in the nmon lines by their pseudonyms
+type anonymizer struct {
+	mapping     *nmon2influxdblib.Mapping
+	hosts       map[string]bool
+	serials     []serialPattern
+	filesystems []string
+}
+
+// serialPattern finds a serial number in any case
+type serialPattern struct {
+	regexp    *regexp.Regexp
+	pseudonym string
+}
+
+// newAnonymizer returns an anonymizer replacing the hosts, serial numbers and paths known by the mapping
+func newAnonymizer(mapping *nmon2influxdblib.Mapping) *anonymizer {
+	a := &anonymizer{mapping: mapping, hosts: make(map[string]bool)}
+	for _, host := range mapping.Known(nmon2influxdblib.HostIdentifier) {
+		a.hosts[host] = true
+	}
+	// short serial numbers would replace parts of unrelated words
+	serials := mapping.Known(nmon2influxdblib.SerialIdentifier)
+	sort.Slice(serials, func(i, j int) bool { return len(serials[i]) > len(serials[j]) })
+	for _, serial := range serials {
+		if len(serial) >= 5 {
+			pseudonym, _ := mapping.Lookup(nmon2influxdblib.SerialIdentifier, serial)
+			a.serials = append(a.serials, serialPattern{regexp: regexp.MustCompile(`(?i)` + regexp.QuoteMeta(serial)), pseudonym: pseudonym})
+		}
+	}
+	a.filesystems = mapping.Known(nmon2influxdblib.PathIdentifier)
+	// the longest paths are replaced first
+	sort.Slice(a.filesystems, func(i, j int) bool { return len(a.filesystems[i]) > len(a.filesystems[j]) })
+	return a
+}
+
+// ip returns the pseudonym of an IP address. Unspecified, loopback and netmask addresses are kept.
+func (a *anonymizer) ip(address string) string {
+	for _, octet := range strings.Split(address, ".") {
+		if value, _ := strconv.Atoi(octet); value > 255 {
+			return address
+		}
+	}
+	if address == "0.0.0.0" || strings.HasPrefix(address, "127.") || strings.HasPrefix(address, "255.") {
+		return address
+	}
+	return a.mapping.Pseudonym(nmon2influxdblib.IPIdentifier, address)
+}
+
+// ipv6 returns the pseudonym of an IPv6 address. Unspecified and loopback addresses are kept.
+func (a *anonymizer) ipv6(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() {
+		return address
+	}
+	// the IPv4-mapped addresses would be written as IPv4 addresses
+	if ip.To4() == nil {
+		address = ip.String()
+	}
+	return a.mapping.Pseudonym(nmon2influxdblib.IPv6Identifier, strings.ToLower(address))
+}
+
+// ipv6s replaces the IPv6 addresses of a free text. The matches inside a word, like C++ names, are kept.
+func (a *anonymizer) ipv6s(text string) string {
+	var replaced strings.Builder
+	last := 0
+	for _, match := range ipv6Regexp.FindAllStringIndex(text, -1) {
+		if match[0] > 0 && addressByte(text[match[0]-1]) || match[1] < len(text) && addressByte(text[match[1]]) {
+			continue
+		}
+		replaced.WriteString(text[last:match[0]])
+		replaced.WriteString(a.ipv6(text[match[0]:match[1]]))
+		last = match[1]
+	}
+	replaced.WriteString(text[last:])
+	return replaced.String()
+}
+
+// addressByte reports whether an address can continue with the byte
+func addressByte(b byte) bool {
+	return b == ':' || b == '.' || b == '_' || '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// mac returns the pseudonym of a MAC address written with colons or hyphens. The null and broadcast addresses are kept.
+func (a *anonymizer) mac(address string) string {
+	canonical := strings.ToLower(strings.ReplaceAll(address, "-", ":"))
+	if canonical == "00:00:00:00:00:00" || canonical == "ff:ff:ff:ff:ff:ff" {
+		return address
+	}
+	pseudonym := a.mapping.Pseudonym(nmon2influxdblib.MACIdentifier, canonical)
+	if strings.Contains(address, "-") {
+		pseudonym = strings.ReplaceAll(pseudonym, ":", "-")
+	}
+	return pseudonym
+}
+
+// macs replaces the MAC addresses of a free text, and the network addresses listed by lscfg written without separator
+func (a *anonymizer) macs(text string) string {
+	text = macRegexp.ReplaceAllStringFunc(text, a.mac)
+	return lscfgAddressRegexp.ReplaceAllStringFunc(text, func(match string) string {
+		address := match[len(match)-12:]
+		colons := make([]string, 0, 6)
+		for i := 0; i < len(address); i += 2 {
+			colons = append(colons, address[i:i+2])
+		}
+		pseudonym := strings.ToUpper(strings.ReplaceAll(a.mac(strings.Join(colons, ":")), ":", ""))
+		return match[:len(match)-12] + pseudonym
+	})
+}
+
+// path replaces the known filesystem at the beginning of a path
+func (a *anonymizer) path(path string) string {
+	for _, known := range a.filesystems {
+		if path == known || strings.HasPrefix(path, known+"/") {
+			pseudonym, _ := a.mapping.Lookup(nmon2influxdblib.PathIdentifier, known)
+			return pseudonym + path[len(known):]
+		}
+	}
+	return path
+}
+
+// word replaces a host name or a serial number found in a word
+func (a *anonymizer) word(word string) string {
+	if lower := strings.ToLower(word); a.hosts[lower] {
+		pseudonym, _ := a.mapping.Lookup(nmon2influxdblib.HostIdentifier, lower)
+		return pseudonym
+	}
+	for _, serial := range a.serials {
+		word = serial.regexp.ReplaceAllLiteralString(word, serial.pseudonym)
+	}
+	return word
+}
+
+// paths replaces the known filesystems of a free text
+func (a *anonymizer) paths(text string) string {
+	return pathRegexp.ReplaceAllStringFunc(text, a.path)
+}
+
+// words replaces the host names and serial numbers of a free text
+func (a *anonymizer) words(text string) string {
+	return wordRegexp.ReplaceAllStringFunc(text, a.word)
+}
+
+// text replaces the MAC and IP addresses, the known filesystems, host names and serial numbers of a free text
+func (a *anonymizer) text(text string) string {
+	// the IPv6 addresses can end with an IPv4 address
+	text = ipRegexp.ReplaceAllStringFunc(a.ipv6s(a.macs(text)), a.ip)
+	return a.words(a.paths(text))
+}
+
+// process replaces the user, the group and the command line of an UARG line
+func (a *anonymizer) process(elems []string, columns []string, delimiter string) string {
+	for i, column := range columns {
+		if i >= len(elems) {
+			break
+		}
+		switch column {
+		case "USER":
+			elems[i] = a.mapping.Pseudonym(nmon2influxdblib.UserIdentifier, strings.TrimSpace(elems[i]))
+		case "GROUP":
+			elems[i] = a.mapping.Pseudonym(nmon2influxdblib.GroupIdentifier, strings.TrimSpace(elems[i]))
+		case "FullCommand":
+			// the command line can contain the delimiter
+			return strings.Join(elems[:i], delimiter) + delimiter + a.text(strings.Join(elems[i:], delimiter))
+		}
+	}
+	return strings.Join(elems, delimiter)
+}
+
+// anonymizeFile writes a copy of the nmon file in dir with the identifiers replaced by their pseudonyms.
+// The identifiers are read by the parser before the copy: the host, the serial number and the filesystems.
+func anonymizeFile(config *nmon2influxdblib.Config, mapping *nmon2influxdblib.Mapping, nmonFile nmon2influxdblib.File, dir string) (path string, err error) {
+	// all the filesystem sections are needed, even if they are not imported
+	parseConfig := *config
+	parseConfig.ImportSkipMetrics = ""
+	nmon, err := InitNmon(&parseConfig, nmonFile)
+	if err != nil {
+		return
+	}
+	snapshots, err := nmon.snapshots()
+	if err != nil {
+		return "", &nmon2influxdblib.FileError{File: nmonFile.FullName(), Err: err}
+	}
+	if len(nmon.Hostname) == 0 {
+		return "", &nmon2influxdblib.FileError{File: nmonFile.FullName(), Err: fmt.Errorf("no AAA host line")}
+	}
+
+	host := mapping.Pseudonym(nmon2influxdblib.HostIdentifier, nmon.Hostname)
+	if len(nmon.LPARname) > 0 {
+		mapping.Pseudonym(nmon2influxdblib.HostIdentifier, strings.ToLower(nmon.LPARname))
+	}
+	mapping.Pseudonym(nmon2influxdblib.SerialIdentifier, nmon.Serial)
+	for _, serial := range nmon.serials {
+		mapping.Pseudonym(nmon2influxdblib.SerialIdentifier, serial)
+	}
+	for name, dataserie := range nmon.DataSeries {
+		if filesystemSections[name] {
+			for _, column := range dataserie.Columns {
+				anonymizePath(mapping, column)
+			}
+		}
+	}
+	a := newAnonymizer(mapping)
+
+	scanner, err := nmonFile.GetLineScanner()
+	if err != nil {
+		return
+	}
+	defer scanner.Close()
+
+	path = filepath.Join(dir, nmonFileName(host, snapshots[0].time))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", &nmon2influxdblib.FileError{File: path, Err: err}
+	}
+	writer := bufio.NewWriter(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case timeRegexp.MatchString(line):
+		case uargRegexp.MatchString(line) && statsRegexp.MatchString(line):
+			elems := strings.Split(line, scanner.Delimiter)
+			line = a.process(elems, nmon.processColumns(elems), scanner.Delimiter)
+		case statsRegexp.MatchString(line) && !configRegexp.MatchString(line):
+			// the values of the data lines are numbers
+		case strings.HasPrefix(line, "AAA"+scanner.Delimiter+"user"+scanner.Delimiter):
+			elems := strings.SplitN(line, scanner.Delimiter, 3)
+			line = strings.Join(elems[:2], scanner.Delimiter) + scanner.Delimiter + mapping.Pseudonym(nmon2influxdblib.UserIdentifier, strings.TrimSpace(elems[2]))
+		case strings.HasPrefix(line, "AAA"):
+			// the AAA lines have versions looking like IP addresses, but no addresses
+			line = a.words(a.paths(line))
+		default:
+			line = a.text(line)
+		}
+		writer.WriteString(line)
+		writer.WriteString("\n")
+	}
+	err = scanner.Err()
+	if flushErr := writer.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", &nmon2influxdblib.FileError{File: path, Err: err}
+	}
+	return path, nil
+}
+
+// Anonymize is the entry point for the anonymize command. The pseudonyms are kept in the mapping file.
+func Anonymize(c *cli.Context) error {
+	config, err := nmon2influxdblib.ParseParameters(c)
+	if err != nil {
+		return err
+	}
+	if len(config.AnonymizeMapping) == 0 {
+		return cli.Exit("the mapping file is required", 1)
+	}
+	mapping, err := nmon2influxdblib.LoadMapping(config.AnonymizeMapping)
+	if err != nil {
+		return err
+	}
+	dir := c.String("dir")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return &nmon2influxdblib.FileError{File: dir, Err: err}
+	}
+
+	failed := 0
+	nmonFiles := new(nmon2influxdblib.Files)
+	for _, paramErr := range nmonFiles.Parse(c.Args().Slice(), config.ImportSSHUser, config.ImportSSHKey) {
+		fmt.Printf("%s ! skipped.\n", paramErr)
+		failed++
+	}
+	for _, nmonFile := range nmonFiles.Valid() {
+		path, err := anonymizeFile(config, mapping, nmonFile, dir)
+		if err != nil {
+			fmt.Printf("%s ! skipped.\n", err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s anonymized in %s\n", nmonFile.FullName(), path)
+	}
+
+	// the pseudonyms given to the written files must be kept
+	if err := mapping.Save(); err != nil {
+		return fmt.Errorf("unable to save the mapping: %w", err)
+	}
+	log.Printf("mapping saved in %s\n", config.AnonymizeMapping)
+	if failed > 0 {
+		return cli.Exit(fmt.Sprintf("%d files not anonymized", failed), 1)
+	}
+	return nil
+}
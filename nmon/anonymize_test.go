@@ -0,0 +1,76 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+)
+
+func TestAnonymizerText(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mapping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mapping, err := nmon2influxdblib.LoadMapping(filepath.Join(dir, "mapping.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping.Pseudonym(nmon2influxdblib.HostIdentifier, "lpar1")
+	mapping.Pseudonym(nmon2influxdblib.SerialIdentifier, "0123456A")
+	mapping.Pseudonym(nmon2influxdblib.SerialIdentifier, "YL10JP36K00A")
+	a := newAnonymizer(mapping)
+
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"ipv4", "inet 10.1.2.3 netmask 255.255.255.0", "inet 198.18.0.1 netmask 255.255.255.0"},
+		{"ipv6", "inet6 fe80::94cb:82ff:fece:2552  prefixlen 64", "inet6 2001:db8::0:1  prefixlen 64"},
+		{"same ipv6", "FE80::94CB:82FF:FECE:2552", "2001:db8::0:1"},
+		{"ipv4-mapped ipv6", "::ffff:10.1.2.4", "2001:db8::0:2"},
+		{"loopback ipv6", "inet6 ::1  prefixlen 128", "inet6 ::1  prefixlen 128"},
+		{"time", "started at 02:30:00", "started at 02:30:00"},
+		{"c++ name", "std::string", "std::string"},
+		{"mac", "ether 00:21:cc:6b:91:0f  txqueuelen 1000", "ether 02:00:00:00:00:01  txqueuelen 1000"},
+		{"mac with hyphens", "00-21-CC-6B-91-0F", "02-00-00-00-00-01"},
+		{"broadcast mac", "brd ff:ff:ff:ff:ff:ff", "brd ff:ff:ff:ff:ff:ff"},
+		{"lscfg network address", "Network Address.............0021CC6B9110", "Network Address.............020000000002"},
+		{"serial in location code", "U8205.E6C.0123456a-V6-C0", "U8205.E6C.SN000001-V6-C0"},
+		{"lscfg serial", "Serial Number...............YL10JP36K00A", "Serial Number...............SN000002"},
+		{"host", "lpar1.example.com", "host001.example.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := a.text(test.text); got != test.want {
+				t.Errorf("text(%q) = %q, want %q", test.text, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLscfgSerials(t *testing.T) {
+	nmon := newTestNmon(t)
+	streamLines(nmon, []string{
+		`BBBP,100,lscfg -vp,"  hdisk0           U78AA.001.WZSGB7H-P2-D3  SAS Disk Drive (300000 MB)"`,
+		`BBBP,101,lscfg -vp,"        Serial Number...............yl10jp36k00a"`,
+		`BBBP,102,lscfg -vp,"        Machine/Cabinet Serial No.........10ABCDE"`,
+	})
+	want := []string{"YL10JP36K00A", "10ABCDE"}
+	if len(nmon.serials) != len(want) {
+		t.Fatalf("serials = %q, want %q", nmon.serials, want)
+	}
+	for i := range want {
+		if nmon.serials[i] != want[i] {
+			t.Errorf("serials = %q, want %q", nmon.serials, want)
+		}
+	}
+}
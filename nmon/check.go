@@ -0,0 +1,382 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+	"github.com/urfave/cli/v2"
+)
+
+// problem severities. Only errors make the check fail.
+const (
+	checkError   = "error"
+	checkWarning = "warning"
+)
+
+var labelRegexp = regexp.MustCompile(`^T(\d+)$`)
+
+// checkProblem is a structural problem found in a nmon file. The problems of the same kind are reported once with their first line.
+type checkProblem struct {
+	severity string
+	line     int
+	message  string
+	count    int
+}
+
+// lineRef is the first line of lines waiting for their section header or their snapshot
+type lineRef struct {
+	line  int
+	count int
+}
+
+// fileCheck reads a nmon file line by line and records its structural problems.
+// The snapshot times are converted by nmon like during an import.
+type fileCheck struct {
+	nmon      *Nmon
+	delimiter string
+	lines     int
+	problems  []*checkProblem
+	kinds     map[string]*checkProblem
+
+	host              string
+	expectedSnapshots int
+	headers           map[string]int
+	ignored           map[string]bool
+	labels            map[string]int
+	lastLabel         int
+	lastTime          time.Time
+	lastSnapshot      string
+	snapshotLines     map[string]int
+	snapshots         []string
+	withoutHeader     map[string]*lineRef
+	withoutSnapshot   map[string]*lineRef
+}
+
+// newFileCheck returns an empty fileCheck
+func newFileCheck(nmon *Nmon) *fileCheck {
+	return &fileCheck{
+		nmon:            nmon,
+		kinds:           make(map[string]*checkProblem),
+		headers:         make(map[string]int),
+		ignored:         make(map[string]bool),
+		labels:          make(map[string]int),
+		snapshotLines:   make(map[string]int),
+		withoutHeader:   make(map[string]*lineRef),
+		withoutSnapshot: make(map[string]*lineRef),
+	}
+}
+
+// add records a problem. The problems with the same kind are counted instead of being repeated.
+func (check *fileCheck) add(severity string, kind string, line int, format string, args ...interface{}) {
+	if problem, ok := check.kinds[kind]; ok && len(kind) > 0 {
+		problem.count++
+		return
+	}
+	problem := &checkProblem{severity: severity, line: line, message: fmt.Sprintf(format, args...), count: 1}
+	check.problems = append(check.problems, problem)
+	if len(kind) > 0 {
+		check.kinds[kind] = problem
+	}
+}
+
+// addLine checks one line of the nmon file
+func (check *fileCheck) addLine(line string) {
+	check.lines++
+	if check.lines == 1 {
+		if !strings.HasPrefix(line, "AAA") {
+			check.add(checkError, "", 1, "the file doesn't start with an AAA line: not a nmon file or truncated at the beginning")
+		}
+		if check.delimiter != "," && check.delimiter != ";" {
+			check.add(checkError, "", 1, "unknown delimiter %q", check.delimiter)
+		}
+	}
+	if len(line) == 0 {
+		return
+	}
+
+	elems := strings.Split(line, check.delimiter)
+	switch {
+	case elems[0] == "AAA":
+		// the AAA lines set the timezone of the snapshots
+		check.nmon.AddLine(line, nil)
+		check.addInfo(elems)
+	case elems[0] == "ZZZZ":
+		check.addSnapshot(elems)
+	case strings.HasPrefix(elems[0], "BBB") || elems[0] == "UARG":
+		// configuration and process arguments are free text
+	case len(elems) < 3:
+		if !strings.HasPrefix(line, "TOP"+check.delimiter+"%CPU") {
+			check.add(checkError, "short:"+elems[0], check.lines, "%s: line with less than 3 fields", elems[0])
+		}
+	case statsRegexp.MatchString(line):
+		check.addData(line, elems)
+	default:
+		check.addHeader(line, elems)
+	}
+}
+
+// addInfo checks the AAA lines. A new nmon header after the first snapshot means concatenated files.
+func (check *fileCheck) addInfo(elems []string) {
+	if len(elems) < 2 {
+		return
+	}
+	if elems[1] == "progname" && len(check.labels) > 0 {
+		check.add(checkError, "concatenated", check.lines, "AAA header after the first snapshot: concatenated nmon files")
+	}
+	if len(elems) < 3 {
+		return
+	}
+	switch elems[1] {
+	case "host":
+		check.host = elems[2]
+	case "snapshots":
+		check.expectedSnapshots, _ = strconv.Atoi(elems[2])
+	}
+}
+
+// addSnapshot checks the label and the time of a ZZZZ line
+func (check *fileCheck) addSnapshot(elems []string) {
+	if len(elems) < 4 || !labelRegexp.MatchString(elems[1]) {
+		check.add(checkError, "zzzz", check.lines, "invalid ZZZZ line: %s", strings.Join(elems, check.delimiter))
+		return
+	}
+	label := elems[1]
+	if first, ok := check.labels[label]; ok {
+		check.add(checkError, "duplicated", check.lines, "snapshot %s is duplicated, first found at line %d", label, first)
+		return
+	}
+	check.labels[label] = check.lines
+	check.snapshots = append(check.snapshots, label)
+	if ref, ok := check.withoutSnapshot[label]; ok {
+		check.add(checkWarning, "before", ref.line, "data lines written before their ZZZZ line")
+		delete(check.withoutSnapshot, label)
+	}
+
+	number, _ := strconv.Atoi(labelRegexp.FindStringSubmatch(label)[1])
+	if number <= check.lastLabel {
+		check.add(checkError, "order", check.lines, "snapshot %s found after %s", label, check.lastSnapshot)
+	}
+	check.lastLabel = number
+	check.lastSnapshot = label
+
+	timeStr := strings.Join(elems[2:], check.delimiter)
+	t, err := check.nmon.ConvertTimeStamp(timeStr)
+	if err != nil {
+		check.add(checkError, "time", check.lines, "snapshot %s: invalid time %s", label, timeStr)
+		return
+	}
+	if !check.lastTime.IsZero() {
+		switch {
+		case t.Equal(check.lastTime):
+			check.add(checkWarning, "same", check.lines, "snapshot %s has the same time as the previous one: %s", label, timeStr)
+		case t.Before(check.lastTime) && check.lastTime.Sub(t) <= time.Hour:
+			check.add(checkWarning, "dst", check.lines, "snapshot %s: the time goes back to %s, like at a daylight saving time change", label, timeStr)
+		case t.Before(check.lastTime):
+			check.add(checkError, "back", check.lines, "snapshot %s: the time goes back to %s", label, timeStr)
+		}
+	}
+	check.lastTime = t
+}
+
+// addHeader records the number of columns of a section header. The sections with empty column names are not imported.
+func (check *fileCheck) addHeader(line string, elems []string) {
+	name := elems[0]
+	check.headers[name] = len(elems) - 2
+	delete(check.withoutHeader, name)
+	if strings.Contains(line, check.delimiter+check.delimiter) {
+		check.ignored[name] = true
+		check.add(checkWarning, "empty:"+name, check.lines, "%s: empty column name, the section is not imported", name)
+	}
+}
+
+// addData checks the snapshot, the number of values and the values of a data line
+func (check *fileCheck) addData(line string, elems []string) {
+	name := elems[0]
+	label := statsRegexp.FindStringSubmatch(line)[1]
+	if _, ok := check.labels[label]; ok {
+		if name != "TOP" {
+			check.snapshotLines[label]++
+		}
+	} else if ref, ok := check.withoutSnapshot[label]; ok {
+		ref.count++
+	} else {
+		check.withoutSnapshot[label] = &lineRef{line: check.lines, count: 1}
+	}
+
+	columns, ok := check.headers[name]
+	if check.ignored[name] {
+		return
+	}
+	if !ok {
+		if ref, ok := check.withoutHeader[name]; ok {
+			ref.count++
+		} else {
+			check.withoutHeader[name] = &lineRef{line: check.lines, count: 1}
+		}
+		return
+	}
+
+	values := elems[2:]
+	count := len(values)
+	for count > columns && len(values[count-1]) == 0 {
+		count--
+	}
+	switch {
+	case count < columns:
+		check.add(checkError, "missing:"+name, check.lines, "%s: %d values for %d columns", name, count, columns)
+	case count > columns && deviceSectionRegexp.MatchString(name):
+		check.add(checkWarning, "added:"+name, check.lines, "%s: %d values for %d columns, devices added while nmon was running", name, count, columns)
+	case count > columns:
+		check.add(checkWarning, "extra:"+name, check.lines, "%s: %d values for %d columns, decimal commas in the values?", name, count, columns)
+	}
+
+	// the TOP lines contain the command names
+	if name == "TOP" {
+		return
+	}
+	for _, value := range values {
+		if len(value) == 0 {
+			continue
+		}
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			check.add(checkWarning, "text:"+name, check.lines, "%s: non numeric value %q not imported", name, value)
+			return
+		}
+	}
+}
+
+// end checks the file content once all the lines are read
+func (check *fileCheck) end(readErr error) {
+	if readErr != nil {
+		check.add(checkError, "", check.lines, "read error after line %d: %s. The file is truncated or corrupted", check.lines, readErr)
+	}
+	if check.lines == 0 {
+		check.add(checkError, "", 0, "empty file")
+		return
+	}
+	if len(check.host) == 0 {
+		check.add(checkError, "", 0, "missing AAA host line")
+	}
+	if len(check.snapshots) == 0 {
+		check.add(checkError, "", 0, "no ZZZZ line: the file has no snapshot")
+	}
+
+	for name, ref := range check.withoutHeader {
+		check.add(checkError, "", ref.line, "%s: %d data lines without section header", name, ref.count)
+	}
+	for label, ref := range check.withoutSnapshot {
+		check.add(checkError, "", ref.line, "%d data lines of the unknown snapshot %s", ref.count, label)
+	}
+
+	if check.expectedSnapshots > 0 && len(check.snapshots) < check.expectedSnapshots {
+		check.add(checkWarning, "", 0, "%d of %d snapshots: nmon was stopped or the file is truncated", len(check.snapshots), check.expectedSnapshots)
+	}
+	if count := len(check.snapshots); count > 1 {
+		last, previous := check.snapshots[count-1], check.snapshots[count-2]
+		if check.snapshotLines[last] < check.snapshotLines[previous] {
+			check.add(checkWarning, "", check.labels[last], "last snapshot %s has %d data lines instead of %d: the file is truncated", last, check.snapshotLines[last], check.snapshotLines[previous])
+		}
+	}
+
+	sort.SliceStable(check.problems, func(i, j int) bool { return check.problems[i].line < check.problems[j].line })
+}
+
+// count returns the number of problems with the severity
+func (check *fileCheck) count(severity string) (count int) {
+	for _, problem := range check.problems {
+		if problem.severity == severity {
+			count++
+		}
+	}
+	return
+}
+
+// String returns the problems found in the file
+func (check *fileCheck) String() string {
+	var text strings.Builder
+	for _, problem := range check.problems {
+		location := ""
+		if problem.line > 0 {
+			location = fmt.Sprintf("line %d: ", problem.line)
+		}
+		fmt.Fprintf(&text, "  %-8s %s%s", problem.severity, location, problem.message)
+		if problem.count > 1 {
+			fmt.Fprintf(&text, " (%d lines)", problem.count)
+		}
+		text.WriteString("\n")
+	}
+	return text.String()
+}
+
+// checkFile reads the nmon file and returns its structural problems
+func checkFile(config *nmon2influxdblib.Config, nmonFile nmon2influxdblib.File) (*fileCheck, error) {
+	nmon, err := NewNmonImport(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := nmon.SetFileLocation(nmonFile); err != nil {
+		return nil, err
+	}
+	scanner, err := nmonFile.GetLineScanner()
+	if err != nil {
+		return nil, err
+	}
+	defer scanner.Close()
+
+	check := newFileCheck(nmon)
+	for scanner.Scan() {
+		check.delimiter = scanner.Delimiter
+		nmon.Delimiter = scanner.Delimiter
+		check.addLine(scanner.Text())
+	}
+	check.end(scanner.Err())
+	return check, nil
+}
+
+// Check is the entry point for the check command. It exits with status 1 if a file has errors.
+func Check(c *cli.Context) error {
+	config, err := nmon2influxdblib.ParseParameters(c)
+	if err != nil {
+		return err
+	}
+	if c.NArg() == 0 {
+		return cli.Exit("no nmon file to check", 1)
+	}
+
+	failed := 0
+	nmonFiles := new(nmon2influxdblib.Files)
+	for _, paramErr := range nmonFiles.Parse(c.Args().Slice(), config.ImportSSHUser, config.ImportSSHKey) {
+		fmt.Printf("%s ! not checked.\n", paramErr)
+		failed++
+	}
+	for _, nmonFile := range nmonFiles.Valid() {
+		check, err := checkFile(config, nmonFile)
+		if err != nil {
+			fmt.Printf("%s ! not checked.\n", err)
+			failed++
+			continue
+		}
+		errors, warnings := check.count(checkError), check.count(checkWarning)
+		if errors+warnings == 0 {
+			fmt.Printf("%s: ok, %d snapshots\n", nmonFile.FullName(), len(check.snapshots))
+			continue
+		}
+		fmt.Printf("%s: %d errors, %d warnings\n%s", nmonFile.FullName(), errors, warnings, check)
+		if errors > 0 {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return cli.Exit(fmt.Sprintf("%d files with errors", failed), 1)
+	}
+	return nil
+}
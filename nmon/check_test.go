@@ -0,0 +1,154 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFileCheck(t *testing.T) {
+	header := []string{
+		"AAA,progname,topas_nmon",
+		"AAA,host,lpar1",
+		"CPU_ALL,CPU Total lpar1,User%,Sys%,Wait%,Idle%",
+		"DISKBUSY,Disk %Busy lpar1,hdisk0,hdisk1",
+	}
+	snapshot := func(label string, timeStr string) []string {
+		return []string{
+			"ZZZZ," + label + "," + timeStr,
+			"CPU_ALL," + label + ",1.0,2.0,0.0,97.0",
+			"DISKBUSY," + label + ",0.0,1.0",
+		}
+	}
+	fixture := func(parts ...[]string) (lines []string) {
+		for _, part := range parts {
+			lines = append(lines, part...)
+		}
+		return
+	}
+
+	type problem struct {
+		severity string
+		line     int
+		message  string
+	}
+	tests := []struct {
+		name     string
+		timezone string
+		lines    []string
+		readErr  error
+		want     []problem
+	}{
+		{
+			name:  "valid",
+			lines: fixture(header, snapshot("T0001", "00:00:01,01-JAN-2020"), snapshot("T0002", "00:05:01,01-JAN-2020")),
+		},
+		{
+			name:  "trailing delimiter",
+			lines: fixture(header, []string{"ZZZZ,T0001,00:00:01,01-JAN-2020", "CPU_ALL,T0001,1.0,2.0,0.0,97.0,"}),
+		},
+		{
+			name:  "duplicated snapshot",
+			lines: fixture(header, snapshot("T0001", "00:00:01,01-JAN-2020"), snapshot("T0002", "00:05:01,01-JAN-2020"), snapshot("T0002", "00:05:01,01-JAN-2020")),
+			want:  []problem{{checkError, 11, "snapshot T0002 is duplicated, first found at line 8"}},
+		},
+		{
+			name:  "snapshots out of order",
+			lines: fixture(header, snapshot("T0002", "00:00:01,01-JAN-2020"), snapshot("T0001", "00:05:01,01-JAN-2020")),
+			want:  []problem{{checkError, 8, "snapshot T0001 found after T0002"}},
+		},
+		{
+			name:  "same time",
+			lines: fixture(header, snapshot("T0001", "00:00:01,01-JAN-2020"), snapshot("T0002", "00:00:01,01-JAN-2020")),
+			want:  []problem{{checkWarning, 8, "snapshot T0002 has the same time as the previous one"}},
+		},
+		{
+			name:     "daylight saving time change",
+			timezone: "Europe/Paris",
+			lines:    fixture(header, snapshot("T0001", "02:50:00,25-OCT-2020"), snapshot("T0002", "02:10:00,25-OCT-2020")),
+			want:     []problem{{checkWarning, 8, "like at a daylight saving time change"}},
+		},
+		{
+			name:  "time going back",
+			lines: fixture(header, snapshot("T0001", "10:00:00,01-JAN-2020"), snapshot("T0002", "08:00:00,01-JAN-2020")),
+			want:  []problem{{checkError, 8, "snapshot T0002: the time goes back to 08:00:00,01-JAN-2020"}},
+		},
+		{
+			name:  "data without header",
+			lines: fixture(header, snapshot("T0001", "00:00:01,01-JAN-2020"), []string{"MEM,T0001,1.0,2.0"}, snapshot("T0002", "00:05:01,01-JAN-2020"), []string{"MEM,T0002,1.0,2.0"}),
+			want:  []problem{{checkError, 8, "MEM: 2 data lines without section header"}},
+		},
+		{
+			name:  "data before snapshot",
+			lines: fixture(header, snapshot("T0001", "00:00:01,01-JAN-2020"), []string{"CPU_ALL,T0002,1.0,2.0,0.0,97.0", "ZZZZ,T0002,00:05:01,01-JAN-2020", "DISKBUSY,T0002,0.0,1.0"}, snapshot("T0003", "00:10:01,01-JAN-2020")),
+			want:  []problem{{checkWarning, 8, "data lines written before their ZZZZ line"}},
+		},
+		{
+			name:  "data without snapshot",
+			lines: fixture(header, snapshot("T0001", "00:00:01,01-JAN-2020"), []string{"CPU_ALL,T0003,1.0,2.0,0.0,97.0"}),
+			want:  []problem{{checkError, 8, "1 data lines of the unknown snapshot T0003"}},
+		},
+		{
+			name:  "missing columns",
+			lines: fixture(header, []string{"ZZZZ,T0001,00:00:01,01-JAN-2020", "CPU_ALL,T0001,1.0,2.0", "DISKBUSY,T0001,0.0,1.0"}),
+			want:  []problem{{checkError, 6, "CPU_ALL: 2 values for 4 columns"}},
+		},
+		{
+			name:  "extra columns",
+			lines: fixture(header, []string{"ZZZZ,T0001,00:00:01,01-JAN-2020", "CPU_ALL,T0001,1,0,2.0,0.0,97.0", "DISKBUSY,T0001,0.0,1.0,5.0"}),
+			want: []problem{
+				{checkWarning, 6, "CPU_ALL: 5 values for 4 columns, decimal commas in the values?"},
+				{checkWarning, 7, "DISKBUSY: 3 values for 2 columns, devices added while nmon was running"},
+			},
+		},
+		{
+			name:  "concatenated files",
+			lines: fixture(header, snapshot("T0001", "00:00:01,01-JAN-2020"), header, snapshot("T0001", "00:00:01,02-JAN-2020")),
+			want: []problem{
+				{checkError, 8, "AAA header after the first snapshot: concatenated nmon files"},
+				{checkError, 12, "snapshot T0001 is duplicated, first found at line 5"},
+			},
+		},
+		{
+			name:    "truncated file",
+			lines:   fixture(header, []string{"AAA,snapshots,3"}, snapshot("T0001", "00:00:01,01-JAN-2020"), []string{"ZZZZ,T0002,00:05:01,01-JAN-2020", "CPU_ALL,T0002,1.0,2.0,0.0,97.0"}),
+			readErr: errors.New("unexpected EOF"),
+			want: []problem{
+				{checkWarning, 0, "2 of 3 snapshots"},
+				{checkWarning, 9, "last snapshot T0002 has 1 data lines instead of 2"},
+				{checkError, 10, "read error after line 10: unexpected EOF"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nmon := newTestNmon(t)
+			if len(test.timezone) > 0 {
+				if err := nmon.SetLocation(test.timezone); err != nil {
+					t.Fatal(err)
+				}
+			}
+			check := newFileCheck(nmon)
+			check.delimiter = ","
+			for _, line := range test.lines {
+				check.addLine(line)
+			}
+			check.end(test.readErr)
+
+			if len(check.problems) != len(test.want) {
+				t.Fatalf("problems:\n%swant %d problems", check, len(test.want))
+			}
+			for i, want := range test.want {
+				got := check.problems[i]
+				if got.severity != want.severity || got.line != want.line || !strings.Contains(got.message, want.message) {
+					t.Errorf("problem %d = %s line %d: %s, want %s line %d: %s", i, got.severity, got.line, got.message, want.severity, want.line, want.message)
+				}
+			}
+		})
+	}
+}
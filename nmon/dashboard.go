@@ -13,13 +13,14 @@ import (
 	"path"
 	"regexp"
 	"sort"
+	"strings"
 
 	"github.com/adejoux/grafanaclient"
 	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
 	"github.com/urfave/cli/v2"
 )
 
-var nmonFileRegexp = regexp.MustCompile(`\.(nmon|nmon.gz|nmon.bz2)$`)
+var nmonFileRegexp = regexp.MustCompile(`\.(nmon|nmon\.gz|nmon\.bz2|nmon\.xz|nmon\.zst|nmon\.zstd)$`)
 var cpuRegexp = regexp.MustCompile(`^CPU\d+`)
 
 const panelSize = "300px"
@@ -31,37 +32,42 @@ const dataSource = "nmon2influxdb"
 func Dashboard(c *cli.Context) error {
 
 	if c.Args().Len() < 1 {
-		fmt.Printf("file name needs to be provided\n")
-		os.Exit(1)
+		return cli.Exit("file name needs to be provided", 1)
 	}
 
 	// parsing parameters
-	config := nmon2influxdblib.ParseParameters(c)
+	config, err := nmon2influxdblib.ParseParameters(c)
+	if err != nil {
+		return err
+	}
 
 	file := c.Args().First()
 
 	if nmonFileRegexp.MatchString(file) {
-		DashboardFile(config, file)
-		return nil
+		return DashboardFile(config, file)
 	}
 
-	DashboardTemplate(config, file)
-
-	return nil
+	return DashboardTemplate(config, file)
 }
 
 //DashboardFile export dashboard to file
-func DashboardFile(config *nmon2influxdblib.Config, file string) {
+func DashboardFile(config *nmon2influxdblib.Config, file string) error {
 	nmonFile := nmon2influxdblib.File{Name: file, FileType: path.Ext(file)}
-	nmon := InitNmon(config, nmonFile)
-	if config.DashboardWriteFile {
-		nmon.WriteDashboard()
-		return
+	nmon, err := InitNmon(config, nmonFile)
+	if err != nil {
+		return err
+	}
+	return nmon.BuildDashboard()
+}
+
+// BuildDashboard writes or uploads the dashboard of a parsed nmon file
+func (nmon *Nmon) BuildDashboard() error {
+	if nmon.Config.DashboardWriteFile {
+		return nmon.WriteDashboard()
 	}
 
 	if nmon.OS != linux && nmon.OS != aix {
-		fmt.Printf("Error: unable to find if it's a Linux or AIX nmon file !\n")
-		os.Exit(1)
+		return fmt.Errorf("unable to find if it's a Linux or AIX nmon file")
 	}
 
 	var dashboard grafanaclient.Dashboard
@@ -72,28 +78,25 @@ func DashboardFile(config *nmon2influxdblib.Config, file string) {
 	if nmon.OS == aix {
 		dashboard = nmon.GenerateAixDashboard()
 	}
-	err := nmon.UploadDashboard(dashboard)
-	nmon2influxdblib.CheckError(err)
-	return
+	return nmon.UploadDashboard(dashboard)
 }
 
 // DashboardTemplate generates dashboard from toml template
-func DashboardTemplate(config *nmon2influxdblib.Config, file string) {
-	nmon := InitNmonTemplate(config)
+func DashboardTemplate(config *nmon2influxdblib.Config, file string) error {
+	nmon, err := InitNmonTemplate(config)
+	if err != nil {
+		return err
+	}
 	dashboard, err := grafanaclient.ConvertTemplate(file)
 	if err != nil {
-		fmt.Printf("Cannot convert template !\n")
-		nmon2influxdblib.CheckError(err)
+		return fmt.Errorf("cannot convert template %s: %w", file, err)
 	}
 
-	err = nmon.UploadDashboard(dashboard)
-	nmon2influxdblib.CheckError(err)
-	return
-
+	return nmon.UploadDashboard(dashboard)
 }
 
 // WriteDashboard to file
-func (nmon *Nmon) WriteDashboard() {
+func (nmon *Nmon) WriteDashboard() error {
 
 	var dashboard grafanaclient.Dashboard
 
@@ -107,7 +110,9 @@ func (nmon *Nmon) WriteDashboard() {
 	// open output file
 	filename := nmon.Hostname + "_dashboard"
 	file, err := os.Create(filename)
-	nmon2influxdblib.CheckError(err)
+	if err != nil {
+		return err
+	}
 	defer file.Close()
 
 	// make a write buffer
@@ -119,7 +124,7 @@ func (nmon *Nmon) WriteDashboard() {
 	writer.Flush()
 
 	log.Printf("Writing GRAFANA dashboard: %s\n", filename)
-
+	return nil
 }
 
 //GenerateAixDashboard custom minimal dashboard for AIX
@@ -478,6 +483,10 @@ func (nmon *Nmon) GenerateAixDashboard() grafanaclient.Dashboard {
 		db.Rows = append(db.Rows, row)
 	}
 
+	if nmon.Wide() {
+		nmon.WideDashboard(&db)
+	}
+
 	db.GTime = grafanaclient.GTime{From: nmon.StartTime(), To: nmon.StopTime()}
 	return db
 
@@ -642,11 +651,102 @@ func (nmon *Nmon) GenerateLinuxDashboard() grafanaclient.Dashboard {
 	row = BuildGrafanaRow("TOP", panels)
 	db.Rows = append(db.Rows, row)
 
+	if nmon.Wide() {
+		nmon.WideDashboard(&db)
+	}
+
 	db.GTime = grafanaclient.GTime{From: nmon.StartTime(), To: nmon.StopTime()}
 	return db
 
 }
 
+// WideDashboard converts the dashboard queries to the wide schema.
+// The columns matching the name tag filter are selected as fields instead of filtering and grouping on the name tag.
+func (nmon *Nmon) WideDashboard(db *grafanaclient.Dashboard) {
+	for i := range db.Rows {
+		for j := range db.Rows[i].Panels {
+			panel := &db.Rows[i].Panels[j]
+			for k := range panel.Targets {
+				nmon.wideTarget(&panel.Targets[k])
+			}
+		}
+	}
+}
+
+// wideTarget converts a target of the narrow schema to the wide schema
+func (nmon *Nmon) wideTarget(target *grafanaclient.Target) {
+	if len(target.Measurement) == 0 {
+		return
+	}
+
+	nameFilter := ""
+	var tags []grafanaclient.Tag
+	for _, tag := range target.Tags {
+		if tag.Key == "name" {
+			nameFilter = strings.Trim(tag.Value, "/")
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	target.Tags = tags
+
+	filter, err := regexp.Compile(nameFilter)
+	if err != nil {
+		log.Printf("invalid filter %s for measurement %s: %s\n", nameFilter, target.Measurement, err)
+		return
+	}
+
+	// aggregation applied to each field. Grafana uses mean by default.
+	functions := grafanaclient.Selects{{Type: "mean", Params: []string{}}}
+	if len(target.Select) > 0 && len(target.Select[0]) > 1 {
+		functions = target.Select[0][1:]
+	}
+
+	var selects []grafanaclient.Selects
+	for _, column := range nmon.MeasurementColumns(target.Measurement) {
+		if !filter.MatchString(column) {
+			continue
+		}
+		selectField := grafanaclient.Selects{{Type: "field", Params: []string{column}}}
+		selectField = append(selectField, functions...)
+		selectField = append(selectField, grafanaclient.Select{Type: "alias", Params: []string{column}})
+		selects = append(selects, selectField)
+	}
+	target.Select = selects
+
+	var groupBy []grafanaclient.GroupBy
+	for _, group := range target.GroupBy {
+		if group.Type == "tag" && len(group.Params) > 0 && group.Params[0] == "name" {
+			continue
+		}
+		groupBy = append(groupBy, group)
+	}
+	target.GroupBy = groupBy
+	target.Alias = strings.Replace(target.Alias, "$tag_name", "$col", -1)
+}
+
+// MeasurementColumns returns the columns of all the sections stored in the measurement
+func (nmon *Nmon) MeasurementColumns(measurement string) (columns []string) {
+	var sections []string
+	for name := range nmon.DataSeries {
+		if MeasurementName(name) == measurement {
+			sections = append(sections, name)
+		}
+	}
+	sort.Strings(sections)
+
+	found := make(map[string]bool)
+	for _, name := range sections {
+		for _, column := range nmon.DataSeries[name].Columns {
+			if !found[column] {
+				found[column] = true
+				columns = append(columns, column)
+			}
+		}
+	}
+	return
+}
+
 // Panel custom Panel fro Grafana
 type Panel struct {
 	Host            string
@@ -804,21 +904,27 @@ func BuildGrafanaTablePanel(np Panel) grafanaclient.Panel {
 }
 
 //InitGrafanaSession connects to grafana instance and setup influxdb datasource
-func (nmon *Nmon) InitGrafanaSession() *grafanaclient.Session {
+func (nmon *Nmon) InitGrafanaSession() (*grafanaclient.Session, error) {
 	//check if datasource for nmon2influxdb exist
 	grafana := grafanaclient.NewSession(nmon.Config.GrafanaUser, nmon.Config.GrafanaPassword, nmon.Config.GrafanaURL)
 	err := grafana.DoLogon()
-	nmon2influxdblib.CheckError(err)
+	if err != nil {
+		return nil, err
+	}
 
 	resDs, err := grafana.GetDataSource(nmon.Config.GrafanaDatasource)
-	nmon2influxdblib.CheckError(err)
+	if err != nil {
+		return nil, err
+	}
 	if resDs.Name == "" {
 		plugins, err := grafana.GetDataSourcePlugins()
 
 		//grafana 3.0 new plugin architecture
-		if err.Error() == "HTTP 404: Data source not found" {
+		if err != nil && err.Error() == "HTTP 404: Data source not found" {
 			plugins, pluginErr := grafana.GetPlugins("datasource")
-			nmon2influxdblib.CheckError(pluginErr)
+			if pluginErr != nil {
+				return nil, pluginErr
+			}
 
 			status := ""
 			for _, plugin := range plugins {
@@ -828,14 +934,14 @@ func (nmon *Nmon) InitGrafanaSession() *grafanaclient.Session {
 			}
 
 			if status != "ok" {
-				log.Printf("No plugin for influxDB in Grafana !\n")
-				os.Exit(1)
+				return nil, fmt.Errorf("no plugin for influxDB in Grafana")
 			}
 		} else {
-			nmon2influxdblib.CheckError(err)
+			if err != nil {
+				return nil, err
+			}
 			if _, present := plugins["influxdb"]; !present {
-				log.Printf("No plugin for influxDB in Grafana !\n")
-				os.Exit(1)
+				return nil, fmt.Errorf("no plugin for influxDB in Grafana")
 			}
 		}
 
@@ -849,16 +955,21 @@ func (nmon *Nmon) InitGrafanaSession() *grafanaclient.Session {
 			IsDefault: true,
 		}
 		err = grafana.CreateDataSource(ds)
-		nmon2influxdblib.CheckError(err)
+		if err != nil {
+			return nil, err
+		}
 		log.Printf("Grafana %s DataSource created.\n", nmon.Config.GrafanaDatasource)
 	}
 
-	return grafana
+	return grafana, nil
 }
 
 //UploadDashboard upload dashboard to current grafana instance
 func (nmon *Nmon) UploadDashboard(dashboard grafanaclient.Dashboard) (err error) {
-	grafana := nmon.InitGrafanaSession()
+	grafana, err := nmon.InitGrafanaSession()
+	if err != nil {
+		return
+	}
 
 	err = grafana.UploadDashboard(dashboard, true)
 	if err != nil {
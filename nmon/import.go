@@ -9,18 +9,19 @@ import (
 	"log"
 	"math"
 	"os"
-	"path"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/adejoux/influxdbclient"
 	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
 	"github.com/urfave/cli/v2"
 )
 
 var hostRegexp = regexp.MustCompile(`^AAA.host.(\S+)`)
+var timezoneRegexp = regexp.MustCompile(`^AAA.(?i:time_?zone).([^,;]+)`)
 var serialRegexp = regexp.MustCompile(`^AAA.SerialNumber.(\S+)`)
 var osRegexp = regexp.MustCompile(`^AAA.*(Linux|AIX)`)
 var timeRegexp = regexp.MustCompile(`^ZZZZ.(T\d+).(.*)$`)
@@ -33,7 +34,10 @@ var skipRegexp = regexp.MustCompile(`T0+\W|^Z|^TOP.%CPU`)
 var statsRegexp = regexp.MustCompile(`\W(T\d{4,16})`)
 var topRegexp = regexp.MustCompile(`^TOP.\d+.(T\d+)`)
 var nfsRegexp = regexp.MustCompile(`^NFS`)
+var configRegexp = regexp.MustCompile(`^AAA|^BBB`)
+var uargRegexp = regexp.MustCompile(`^UARG`)
 var nameRegexp = regexp.MustCompile(`(\d+)$`)
+var deviceSectionRegexp = regexp.MustCompile(`^(DISK|FC|JFS)`)
 
 // VG
 var viosverRegexp = regexp.MustCompile(`^AAA.VIOS.(\S+)`)
@@ -52,6 +56,7 @@ var aixfirmwareRegexp = regexp.MustCompile(`^BBB.*lsconf.*Firmware.Version:\s*(I
 
 //var linuxserialRegexp = regexp.MustCompile(`^BBB.*ppc64_utils.*lscfg.*01:01\s+\w+.(\w+)`)
 var linuxserialRegexp = regexp.MustCompile(`^BBB.*ppc64_utils.*lscfg.*\shost0.*(\w{7})`)
+var lscfgSerialRegexp = regexp.MustCompile(`^BBB.*Serial (?:Number|No)\.{2,}\s*([\w-]+)`)
 var linuxverRegexp = regexp.MustCompile(`^BBB.*\/etc\/\S*PRETTY_NAME=Q*([^\"Q*]+)`)
 var linuxkernelRegexp = regexp.MustCompile(`^AAA.*Linux,(\S+),`)
 var linuxmtRegexp = regexp.MustCompile(`^BBB.*ppc64_utils.*lscfg.*Model Name: (\S{8})`)
@@ -74,354 +79,860 @@ var uptimeRegexp = regexp.MustCompile(`^BBB.*uptime.*up\s+([\w\s:]+)`)
 func Import(c *cli.Context) error {
 
 	if c.Args().Len() < 1 {
-		fmt.Printf("file name or directory needs to be provided\n")
-		os.Exit(1)
+		return cli.Exit("file name or directory needs to be provided", 1)
 	}
 
 	// parsing parameters
-	config := nmon2influxdblib.ParseParameters(c)
+	config, err := nmon2influxdblib.ParseParameters(c)
+	if err != nil {
+		return err
+	}
+
+	if config.ImportDryRun && config.ImportReportFormat != textReport && config.ImportReportFormat != jsonReport {
+		return cli.Exit(fmt.Sprintf("report format must be %s or %s", textReport, jsonReport), 1)
+	}
+
+	// the points of the files are deleted before they are imported again
+	if config.ImportReplace {
+		if config.ImportDryRun || config.ImportFollow || len(config.OutputFile) > 0 || len(config.RemoteWriteURL) > 0 || config.InfluxdbVersion >= 3 {
+			return cli.Exit("replace is only available for imports in InfluxDB 1.x or 2.x, without dry-run or follow", 1)
+		}
+		config.ImportForce = true
+	}
+
+	// the points are aggregated over the resample window. The raw points can be kept in another database.
+	if _, err := nmon2influxdblib.ParseResample(config.ImportResample, config.ImportAggregation); err != nil {
+		return cli.Exit(err.Error(), 1)
+	}
+	rawDatabase := len(config.ImportResample) > 0 && len(config.ImportRawDatabase) > 0
+	if rawDatabase && (config.ImportFollow || config.ImportReplace || len(config.OutputFile) > 0 || len(config.RemoteWriteURL) > 0) {
+		return cli.Exit("raw_database is only available for imports in InfluxDB, without follow or replace", 1)
+	}
+	if len(config.ImportResample) > 0 && config.ImportFollow {
+		return cli.Exit("resample is not available with follow", 1)
+	}
+
+	// points are written in a file, in a Prometheus remote write endpoint or in InfluxDB. The import log is only available with InfluxDB
+	// or with the local state store. A dry run only reads the import log.
+	var output *nmon2influxdblib.LineProtocolFile
+	remoteWrite := len(config.RemoteWriteURL) > 0
+	if config.ImportDryRun {
+		if len(config.OutputFile) > 0 || (remoteWrite && len(config.ImportStateFile) == 0) {
+			log.Printf("dry run: the import log is not used\n")
+		}
+	} else if len(config.OutputFile) > 0 {
+		output, err = nmon2influxdblib.CreateLineProtocolFile(config.OutputFile)
+		if err != nil {
+			return err
+		}
+		// the file is closed before the end of the import to report the errors of the last writes
+		defer func() {
+			if output != nil {
+				output.Close()
+			}
+		}()
+	} else if !remoteWrite {
+		//create databases if needed
+		if _, err = config.GetDB("nmon"); err != nil {
+			return err
+		}
+		if rawDatabase {
+			if _, err = config.GetDB("raw"); err != nil {
+				return err
+			}
+		}
+		if len(config.ImportStateFile) == 0 {
+			if _, err = config.GetLogDB(); err != nil {
+				return err
+			}
+			if _, err = config.GetJournalDB(); err != nil {
+				return err
+			}
+		}
+	}
 
-	//getting databases connections
-	influxdb := config.GetDB("nmon")
-	influxdbLog := config.GetLogDB()
+	// the local state store replaces the import log database. It's shared by the workers.
+	var stateStore *nmon2influxdblib.StateStore
+	if len(config.ImportStateFile) > 0 && len(config.OutputFile) == 0 {
+		stateStore, err = nmon2influxdblib.OpenStateStore(config.ImportStateFile)
+		if err != nil {
+			return err
+		}
+		defer stateStore.Close()
+	}
 
+	// the parameters which can't be read are reported with the import errors
+	var failures []ImportSummary
 	nmonFiles := new(nmon2influxdblib.Files)
-	nmonFiles.Parse(c.Args().Slice(), config.ImportSSHUser, config.ImportSSHKey)
+	if config.ImportFollow {
+		*nmonFiles, err = followFile(c)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, paramErr := range nmonFiles.Parse(c.Args().Slice(), config.ImportSSHUser, config.ImportSSHKey) {
+			fmt.Printf("%s ! skipped.\n", paramErr)
+			failures = append(failures, ImportSummary{Error: paramErr})
+		}
+	}
+	if len(config.ImportName) > 0 {
+		nmonFiles.NameStreams(config.ImportName)
+	}
 
 	tagParsers := nmon2influxdblib.ParseInputs(config.Inputs)
+	// the pseudonyms are shared by the workers and saved at the end of the import
+	var mapping *nmon2influxdblib.Mapping
+	if config.ImportAnonymize {
+		if mapping, err = nmon2influxdblib.LoadMapping(config.AnonymizeMapping); err != nil {
+			return err
+		}
+	}
+	limiter := nmon2influxdblib.NewRateLimiter(config.ImportWriteRate)
 
-	var userSkipRegexp *regexp.Regexp
-	if len(config.ImportSkipMetrics) > 0 {
-		skipped := strings.Replace(config.ImportSkipMetrics, ",", "|", -1)
-		userSkipRegexp = regexp.MustCompile(skipped)
+	validFiles := nmonFiles.Valid()
+	jobs := config.ImportJobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	if jobs > len(validFiles) {
+		jobs = len(validFiles)
 	}
 
-	for _, nmonFile := range nmonFiles.Valid() {
+	// each worker uses its own connections to keep its points separated
+	indexes := make(chan int)
+	results := make([]chan ImportSummary, len(validFiles))
+	for i := range results {
+		results[i] = make(chan ImportSummary, 1)
+	}
 
-		// store the list of metrics which was logged as skipped
-		LoggedSkippedMetrics := make(map[string]bool)
-		var count int64
-		count = 0
-		nmon := InitNmon(config, nmonFile)
+	for worker := 0; worker < jobs; worker++ {
+		go func() {
+			var influxdb nmon2influxdblib.PointWriter
+			var importLog ImportLog
+			// db deletes the points of the replaced files
+			var db nmon2influxdblib.DB
+			// raw keeps the points of the resampled files
+			var raw nmon2influxdblib.PointWriter
+			var connErr error
+			if stateStore != nil {
+				importLog = stateStore
+			}
+			// the import log database is used when the points are written in InfluxDB
+			connectLog := func() {
+				if stateStore == nil {
+					var influxdbLog *influxImportLog
+					if influxdbLog, connErr = connectInfluxImportLog(config); connErr == nil {
+						importLog = influxdbLog
+					}
+				}
+			}
+			if config.ImportDryRun {
+				// the points are counted by ImportFile
+				if len(config.OutputFile) == 0 && !remoteWrite {
+					connectLog()
+				}
+			} else if output != nil {
+				influxdb = output.NewWriter()
+			} else if remoteWrite {
+				influxdb = config.NewRetryWriter(&nmon2influxdblib.LimitedWriter{PointWriter: config.NewRemoteWriter(), Limiter: limiter})
+			} else {
+				if db, connErr = config.ConnectDB(config.InfluxdbDatabase); connErr == nil {
+					influxdb = config.NewRetryWriter(&nmon2influxdblib.LimitedWriter{PointWriter: db, Limiter: limiter})
+					connectLog()
+				}
+				if rawDatabase && connErr == nil {
+					var rawDB nmon2influxdblib.DB
+					if rawDB, connErr = config.ConnectDB(config.ImportRawDatabase); connErr == nil {
+						raw = config.NewRetryWriter(&nmon2influxdblib.LimitedWriter{PointWriter: rawDB, Limiter: limiter})
+					}
+				}
+			}
+			for i := range indexes {
+				if connErr != nil {
+					results[i] <- ImportSummary{File: validFiles[i].FullName(), Error: connErr}
+					continue
+				}
+				if config.ImportReplace {
+					if purgeErr := purgeFile(config, validFiles[i], db, tagParsers, mapping); purgeErr != nil {
+						results[i] <- ImportSummary{File: validFiles[i].FullName(), Error: purgeErr}
+						continue
+					}
+				}
+				results[i] <- ImportFile(config, validFiles[i], influxdb, raw, importLog, tagParsers, mapping)
+			}
+		}()
+	}
 
-		if len(config.Inputs) > 0 {
-			//Build tag parsing
-			nmon.TagParsers = tagParsers
+	go func() {
+		for i := range validFiles {
+			indexes <- i
+		}
+		close(indexes)
+	}()
+
+	// summaries are displayed in the files order
+	var reports []*ImportReport
+	for i := range validFiles {
+		summary := <-results[i]
+		if summary.Error != nil || summary.Rejected > 0 {
+			failures = append(failures, summary)
+		}
+		switch {
+		case summary.Report == nil:
+			fmt.Println(summary)
+		case config.ImportReportFormat == jsonReport:
+			reports = append(reports, summary.Report)
+		default:
+			fmt.Println(summary.Report)
+		}
+	}
+	// the pseudonyms written in InfluxDB must be kept. A dry run writes nothing.
+	if mapping != nil && !config.ImportDryRun {
+		if err := mapping.Save(); err != nil {
+			return fmt.Errorf("unable to save the mapping: %w", err)
+		}
+	}
+	// a full disk can only be detected when the buffers are flushed
+	if output != nil {
+		closeErr := output.Close()
+		output = nil
+		if closeErr != nil {
+			return closeErr
+		}
+	}
+	if config.ImportDryRun && config.ImportReportFormat == jsonReport {
+		if err := printJSONReports(reports); err != nil {
+			return err
 		}
+	}
 
-		if nmon.Debug {
-			log.Printf("Import file: %s", nmonFile.Name)
+	// the files not fully imported are listed at the end
+	if len(failures) > 0 {
+		failed := 0
+		fmt.Printf("\nImport errors:\n")
+		for _, summary := range failures {
+			fmt.Println(summary.Failure())
+			if summary.Error != nil {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return cli.Exit(fmt.Sprintf("%d files not imported completely", failed), 1)
 		}
+	}
 
-		lines := nmonFile.Content()
-		log.Printf("NMON file separator: %s\n", nmonFile.Delimiter)
-		var last string
-		filters := new(influxdbclient.Filters)
-		filters.Add("file", path.Base(nmonFile.Name), "text")
+	return nil
+}
 
-		timeStamp, err := influxdbLog.ReadLastPoint("value", filters, "timestamp")
-		nmon2influxdblib.CheckError(err)
+// followFile returns the local nmon file to follow. It's read until the import is interrupted.
+func followFile(c *cli.Context) (nmon2influxdblib.Files, error) {
+	if c.Args().Len() != 1 {
+		return nil, fmt.Errorf("only one file or directory can be followed")
+	}
+	follower, err := nmon2influxdblib.NewFollowReader(c.Args().First())
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("following file %s\n", follower.Name)
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Printf("stopping import\n")
+		close(stop)
+	}()
+	follower.Stop = stop
+
+	return nmon2influxdblib.Files{{Name: follower.Name, FileType: ".nmon", Reader: follower}}, nil
+}
 
-		if nmon.Debug {
-			log.Printf("influxdb stored timestamp: %v\n", timeStamp)
-		}
+// ImportSummary contains the result of a nmon file import
+type ImportSummary struct {
+	File   string
+	Points int64
+	// RawPoints are the points written in the raw database. They are not counted in Points.
+	RawPoints int64
+	Unchanged bool
+	// Report is only set for dry runs
+	Report *ImportReport
+	// Error stopped the import of the file
+	Error error
+	// Rejected is the number of points refused by the server
+	Rejected         int64
+	RejectedMessages []string
+	// Start and End are the times of the first and last imported snapshots
+	Start time.Time
+	End   time.Time
+}
+
+// String returns the summary displayed at the end of a file import
+func (summary ImportSummary) String() string {
+	if summary.Unchanged {
+		return fmt.Sprintf("file not changed since last import: %s", summary.File)
+	}
+	points := fmt.Sprintf("%d points", summary.Points)
+	if summary.RawPoints > 0 {
+		points += fmt.Sprintf(" and %d raw points", summary.RawPoints)
+	}
+	if summary.Error != nil {
+		return fmt.Sprintf("\nFile %s failed after %s !", summary.File, points)
+	}
+	return fmt.Sprintf("\nFile %s imported : %s !", summary.File, points)
+}
 
-		var lastTime time.Time
-		if !nmon.Config.ImportForce && len(timeStamp) > 0 {
-			lastTime, err = nmon.ConvertTimeStamp(timeStamp)
-		} else {
-			lastTime, err = nmon.ConvertTimeStamp("00:00:00,01-JAN-1900")
+// Failure returns the errors of the file
+func (summary ImportSummary) Failure() string {
+	var text strings.Builder
+	if summary.Error != nil && len(summary.File) == 0 {
+		// the errors of the command parameters contain the file name
+		fmt.Fprintf(&text, "  %s\n", summary.Error)
+	} else if summary.Error != nil {
+		fmt.Fprintf(&text, "  %s: %s\n", summary.File, summary.Error)
+	}
+	if summary.Rejected > 0 {
+		fmt.Fprintf(&text, "  %s: %d points rejected\n", summary.File, summary.Rejected)
+		for _, message := range summary.RejectedMessages {
+			fmt.Fprintf(&text, "    %s\n", message)
 		}
-		nmon2influxdblib.CheckError(err)
+	}
+	return strings.TrimSuffix(text.String(), "\n")
+}
+
+// ImportFile streams a nmon file and writes its points in InfluxDB
+func ImportFile(config *nmon2influxdblib.Config, nmonFile nmon2influxdblib.File, influxdb nmon2influxdblib.PointWriter, raw nmon2influxdblib.PointWriter, importLog ImportLog, tagParsers nmon2influxdblib.TagParsers, mapping *nmon2influxdblib.Mapping) (summary ImportSummary) {
+	start := time.Now()
+	summary.File = nmonFile.FullName()
+	nmon, err := NewNmonImport(config)
+	if err == nil {
+		err = nmon.SetFileLocation(nmonFile)
+	}
+	if err != nil {
+		summary.Error = err
+		return
+	}
 
-		origChecksum, err := influxdbLog.ReadLastPoint("value", filters, "checksum")
-		nmon2influxdblib.CheckError(err)
+	if len(config.Inputs) > 0 {
+		//Build tag parsing
+		nmon.TagParsers = tagParsers
+	}
+	// the identifiers are replaced by their pseudonyms when the import is anonymized
+	nmon.mapping = mapping
+
+	if nmon.Debug {
+		log.Printf("Import file: %s", nmonFile.FullName())
+	}
+
+	// a dry run counts the points instead of writing them
+	var dryRun *nmon2influxdblib.DryRunWriter
+	if config.ImportDryRun {
+		dryRun = nmon2influxdblib.NewDryRunWriter()
+		influxdb = dryRun
+		summary.Report = &ImportReport{File: summary.File}
+	}
+
+	// the points are aggregated by a resampler in front of the writer. The raw points are written with a prefix or in raw.
+	writer := influxdb
+	var resampler *nmon2influxdblib.ResampleWriter
+	if window, _ := nmon2influxdblib.ParseResample(config.ImportResample, config.ImportAggregation); window > 0 {
+		resampler = nmon2influxdblib.NewResampleWriter(influxdb, window, config.ImportAggregation)
+		resampler.RawPrefix = config.ImportRawPrefix
+		resampler.Raw = raw
+		influxdb = resampler
+	}
+
+	var last string
+	var checksum string
+	// the last imported timestamp is converted once the timezone is known from the file headers
+	var lastTime time.Time
+	var lastTimeStamp string
+
+	// stdin can't be identified in the import log without a name
+	if nmonFile.Name == nmon2influxdblib.Stdin {
+		importLog = nil
+	}
+
+	// the import journal records how each import went, except for unchanged files
+	if importLog != nil && !config.ImportDryRun {
+		defer func() {
+			if summary.Unchanged {
+				return
+			}
+			if journalErr := importLog.AddEntry(nmon.journalEntry(nmonFile, summary, time.Since(start))); journalErr != nil {
+				log.Printf("unable to update the import journal of %s: %s\n", summary.File, journalErr)
+			}
+		}()
+	}
+
+	// the import log is not used when writing to a file
+	if importLog != nil {
+		timeStamp, origChecksum, err := importLog.ReadState(nmonFile)
+		if err != nil {
+			summary.Error = fmt.Errorf("unable to read the import log: %w", err)
+			return
+		}
 
 		if nmon.Debug {
+			log.Printf("influxdb stored timestamp: %v\n", timeStamp)
 			log.Printf("influxdb stored checksum: %v\n", origChecksum)
 		}
 
-		ckfield := map[string]interface{}{"value": nmonFile.Checksum()}
-		if !nmon.Config.ImportForce && len(origChecksum) > 0 {
+		if !nmon.Config.ImportForce {
+			lastTimeStamp = timeStamp
+		}
 
-			if origChecksum == nmonFile.Checksum() {
-				fmt.Printf("file not changed since last import: %s\n", nmonFile.Name)
-				continue
+		// the checksum can't be computed on streamed content
+		if nmonFile.Reader == nil {
+			checksum, err = nmonFile.Checksum()
+			if err != nil {
+				summary.Error = err
+				return
 			}
-		}
+			if !nmon.Config.ImportForce && len(origChecksum) > 0 {
 
-		//VG++
-		systags := map[string]string{	"host": nmon.Hostname,
-						"name": "smt",
-						"mtype": nmon.MT,
-						"serial": nmon.Serial,
-						"SysCPU": nmon.CPUs,
-						"CPUtype": nmon.CPUtype,
-						"CPUmode": nmon.CPUmode,
-						"FWlevel": nmon.FW,
-						"os": nmon.OS,
-						"osver": nmon.OSver,
-						"osrelease": nmon.OStl,
-						"uptime": nmon.uptime,
-						"lparnr": nmon.LPARnr,
-						"lparname": nmon.LPARname}
-
-		// try to convert smt string to integer
-		smtfloat := 1.0
-		converted, parseErr := strconv.ParseFloat(nmon.SMT, 64)
-                if parseErr != nil || math.IsNaN(converted) {
-                        //if not working, skip to next value. We don't want text values in InfluxDB.
-			smtfloat = 1.0
-		} else {
-			smtfloat = converted
-		}
-		//VG--
-		for _, line := range lines {
-
-			if cpuallRegexp.MatchString(line) && !config.ImportAllCpus {
-				continue
+				if origChecksum == checksum {
+					summary.Unchanged = true
+					if summary.Report != nil {
+						summary.Report.Unchanged = true
+					}
+					return
+				}
 			}
+		}
+	}
 
-			if diskallRegexp.MatchString(line) && config.ImportSkipDisks {
-				continue
+	scanner, err := nmonFile.GetLineScanner()
+	if err != nil {
+		summary.Error = err
+		return
+	}
+	defer scanner.Close()
+
+	// after a write error, the file is not imported further and the import log keeps the previous import state.
+	// The points of the raw database are counted apart from the resampled points.
+	write := func() {
+		if summary.Error == nil {
+			var rawCount int64
+			if resampler != nil && raw != nil {
+				rawCount = raw.PointsCount()
 			}
+			if writeErr := influxdb.WritePoints(); writeErr != nil {
+				summary.Error = writeErr
+				log.Printf("unable to write the points of %s: %s\n", summary.File, writeErr)
+			} else {
+				summary.Points += influxdb.PointsCount() - rawCount
+				summary.RawPoints += rawCount
+			}
+		}
+		influxdb.ClearPoints()
+	}
 
-			if skipRegexp.MatchString(line) {
-				continue
+	// write points by batch to keep memory usage low
+	flush := func(size int64) {
+		if influxdb.PointsCount() >= size {
+			write()
+			// progress is only displayed when files are imported one by one
+			if config.ImportJobs <= 1 && !config.ImportDryRun && summary.Error == nil {
+				fmt.Printf("#")
 			}
+		}
+	}
 
-			if statsRegexp.MatchString(line) {
-				matched := statsRegexp.FindStringSubmatch(line)
-				elems := strings.Split(line, nmonFile.Delimiter)
-				name := elems[0]
-				//VG++
-				measurement := ""
-                                if nfsRegexp.MatchString(name) || cpuallRegexp.MatchString(name) {
-					measurement = name
-				} else {
-					measurement = nameRegexp.ReplaceAllString(name, "")
-				}
-				//VG ---
-
-				if len(config.ImportSkipMetrics) > 0 {
-					if userSkipRegexp.MatchString(name) {
-						if nmon.Debug {
-							if !LoggedSkippedMetrics[name] {
-								log.Printf("metric skipped : %s\n", name)
-								LoggedSkippedMetrics[name] = true
-							}
-						}
-						continue
-					}
-				}
+	// the last imported timestamp is stored in the import log
+	writeLog := func() {
+		if len(last) == 0 || importLog == nil || config.ImportDryRun || summary.Error != nil {
+			return
+		}
+		if logErr := importLog.WriteState(nmonFile, nmon.Hostname, last, checksum); logErr != nil {
+			summary.Error = fmt.Errorf("unable to update the import log: %s", logErr)
+			log.Printf("%s: %s\n", summary.File, summary.Error)
+		}
+	}
 
-				timeStr, getErr := nmon.GetTimeStamp(matched[1])
-				if getErr != nil {
-					continue
-				}
-				last = timeStr
-				timestamp, convErr := nmon.ConvertTimeStamp(timeStr)
-				nmon2influxdblib.CheckError(convErr)
-				if timestamp.Before(lastTime) && !nmon.Config.ImportForce {
-					continue
+	// the points refused by the server are not counted as imported
+	takeRejected := func() {
+		summary.Rejected, summary.RejectedMessages = 0, nil
+		if retryWriter, ok := writer.(*nmon2influxdblib.RetryWriter); ok {
+			rejected, messages := retryWriter.TakeRejected()
+			summary.Points -= rejected
+			summary.Rejected += rejected
+			summary.RejectedMessages = append(summary.RejectedMessages, messages...)
+		}
+		if retryWriter, ok := raw.(*nmon2influxdblib.RetryWriter); ok && resampler != nil {
+			rejected, messages := retryWriter.TakeRejected()
+			summary.RawPoints -= rejected
+			summary.Rejected += rejected
+			summary.RejectedMessages = append(summary.RejectedMessages, messages...)
+		}
+	}
+
+	// with UARG tags, the TOP lines are imported at the end of their snapshot: the UARG lines are written after them
+	type topLine struct {
+		elems     []string
+		timestamp time.Time
+	}
+	var topLines []topLine
+	var topTime string
+	intervalChecked := false
+	addTopLines := func() {
+		for _, top := range topLines {
+			nmon.AddTopPoints(influxdb, top.elems, top.timestamp)
+			flush(10000)
+		}
+		topLines = topLines[:0]
+	}
+
+	// a followed file is written each time its end is reached
+	if follower, ok := nmonFile.Reader.(*nmon2influxdblib.FollowReader); ok {
+		follower.Idle = func() bool {
+			addTopLines()
+			if influxdb.PointsCount() > 0 {
+				flush(1)
+				writeLog()
+			}
+			return summary.Error == nil
+		}
+		// each followed file has its own import log state and journal entry
+		follower.Rotated = func(name string) {
+			addTopLines()
+			flush(1)
+			writeLog()
+			takeRejected()
+			if importLog != nil && !config.ImportDryRun {
+				if journalErr := importLog.AddEntry(nmon.journalEntry(nmonFile, summary, time.Since(start))); journalErr != nil {
+					log.Printf("unable to update the import journal of %s: %s\n", summary.File, journalErr)
 				}
+			}
+			fmt.Println(summary)
+
+			nmonFile.Name = name
+			summary.File = nmonFile.FullName()
+			summary.Points, summary.RawPoints = 0, 0
+			summary.Start, summary.End = time.Time{}, time.Time{}
+			start = time.Now()
+			last = ""
+			// the snapshots of the new file are numbered from T0001
+			nmon.TimeStamps = make(map[string]string)
+			nmon.repeated = nil
+			nmon.lastSnapshot = time.Time{}
+		}
+	}
 
-				for i, value := range elems[2:] {
-					if len(nmon.DataSeries[name].Columns) < i+1 {
-						if nmon.Debug {
-							log.Printf(line)
-							log.Printf("Entry added position %d in serie %s since nmon start: skipped\n", i+1, name)
-						}
-						continue
-					}
-					column := nmon.DataSeries[name].Columns[i]
-					tags := map[string]string{"host": nmon.Hostname, "name": column}
-					// try to convert string to integer
-					converted, parseErr := strconv.ParseFloat(value, 64)
-					if parseErr != nil || math.IsNaN(converted) {
-						//if not working, skip to next value. We don't want text values in InfluxDB.
-						continue
-					}
+	err = nmon.Stream(scanner, func(line string, elems []string, label string, timeStr string) {
+		if summary.Error != nil {
+			return
+		}
+		name := elems[0]
+		timestamp, convErr := nmon.SnapshotTime(label)
+		if convErr != nil && config.ImportDryRun {
+			nmon.parseError("invalid timestamp %s: %s", timeStr, convErr)
+			return
+		}
+		if convErr != nil {
+			summary.Error = convErr
+			return
+		}
 
-					//send integer if it worked
-					field := map[string]interface{}{"value": converted}
-
-					//VG++
-					//measurement := ""
-					//if nfsRegexp.MatchString(name) || cpuallRegexp.MatchString(name) {
-					//	measurement = name
-					//} else {
-					//	measurement = nameRegexp.ReplaceAllString(name, "")
-					//}
-					//VG + 
-					if measurement == "CPU_ALL" {
-						if len(nmon.MT) > 0 {
-							tags["mtype"] = nmon.MT
-						}
-						if len(nmon.Serial) > 0 {
-							tags["serial"] = nmon.Serial
-						}
-						if len(nmon.SMT) > 0 {
-							tags["smt"] = nmon.SMT
-						}
-						if len(nmon.CPUs) > 0 {
-							tags["cpus_in_sys"] = nmon.CPUs
-						}
-					}
-					if measurement == "MEM" {
-						if len(nmon.MT) > 0 {
-                                                        tags["mtype"] = nmon.MT
-                                                }
-                                                if len(nmon.Serial) > 0 {
-                                                        tags["serial"] = nmon.Serial
-                                                }
-					}
+		last = timeStr
 
-					// Checking additional tagging
-					for key, value := range tags {
-						if _, ok := nmon.TagParsers[measurement][key]; ok {
-							for _, tagParser := range nmon.TagParsers[measurement][key] {
-								if tagParser.Regexp.MatchString(value) {
-									tags[tagParser.Name] = tagParser.Value
-								}
-							}
-						}
-
-						if _, ok := nmon.TagParsers["_ALL"][key]; ok {
-							for _, tagParser := range nmon.TagParsers["_ALL"][key] {
-								if tagParser.Regexp.MatchString(value) {
-									tags[tagParser.Name] = tagParser.Value
-								}
-							}
-						}
+		// the interval is known once the AAA lines are read. A window not longer than the interval is useless.
+		if resampler != nil && !intervalChecked {
+			intervalChecked = true
+			if nmon.interval >= resampler.Window {
+				log.Printf("%s: interval of %s, not resampled to %s\n", summary.File, nmon.interval, resampler.Window)
+				resampler.Window = 0
+			}
+		}
 
-					}
-					influxdb.AddPoint(measurement, timestamp, field, tags)
-
-					if influxdb.PointsCount() >= 5000 {
-						err = influxdb.WritePoints()
-						nmon2influxdblib.CheckError(err)
-						count += influxdb.PointsCount()
-						influxdb.ClearPoints()
-						fmt.Printf("#")
-					}
-				}
-				if measurement == "CPU_ALL" {
-
-					// write SYSINFO measurement
-					sysfield := map[string]interface{}{"value": smtfloat}
-
-					// Checking additional tagging
-                                        for key, value := range systags {
-                                                if _, ok := nmon.TagParsers["SYSINFO"][key]; ok {
-                                                        for _, tagParser := range nmon.TagParsers["SYSINFO"][key] {
-                                                                if tagParser.Regexp.MatchString(value) {
-                                                                        systags[tagParser.Name] = tagParser.Value
-                                                                }
-                                                        }
-                                                }
-
-                                                if _, ok := nmon.TagParsers["_ALL"][key]; ok {
-                                                        for _, tagParser := range nmon.TagParsers["_ALL"][key] {
-                                                                if tagParser.Regexp.MatchString(value) {
-                                                                        systags[tagParser.Name] = tagParser.Value
-                                                                }
-                                                        }
-                                                }
-
-                                        }
-
-					influxdb.AddPoint("SYSINFO", timestamp, sysfield, systags)
-				}
+		// the BBB sections are before the first snapshot. The inventory points are not resampled.
+		nmon.AddInventoryPoints(writer, timestamp)
+
+		if len(lastTimeStamp) > 0 {
+			lastTime, convErr = nmon.ConvertTimeStamp(lastTimeStamp)
+			if convErr != nil {
+				summary.Error = fmt.Errorf("invalid timestamp in the import log: %w", convErr)
+				return
 			}
+			lastTimeStamp = ""
+			// the window of the last imported timestamp is aggregated again with its new points
+			if resampler != nil && resampler.Window > 0 {
+				lastTime = nmon2influxdblib.WindowStart(lastTime, resampler.Window)
+			}
+		}
 
-			if topRegexp.MatchString(line) {
-				matched := topRegexp.FindStringSubmatch(line)
-
-				elems := strings.Split(line, nmonFile.Delimiter)
-				name := elems[0]
-				if len(config.ImportSkipMetrics) > 0 {
-					if userSkipRegexp.MatchString(name) {
-						if nmon.Debug {
-							if !LoggedSkippedMetrics[name] {
-								log.Printf("metric skipped : %s\n", name)
-								LoggedSkippedMetrics[name] = true
-							}
-						}
-						continue
-					}
-				}
+		if timestamp.Before(lastTime) && !nmon.Config.ImportForce {
+			if summary.Report != nil {
+				summary.Report.AlreadyImported++
+			}
+			return
+		}
 
-				timeStr, getErr := nmon.GetTimeStamp(matched[1])
-				if getErr != nil {
-					continue
-				}
+		nmon.AddStatsPoints(influxdb, name, elems, timestamp, line)
+		flush(5000)
+		if summary.Start.IsZero() || timestamp.Before(summary.Start) {
+			summary.Start = timestamp
+		}
+		if timestamp.After(summary.End) {
+			summary.End = timestamp
+		}
 
-				timestamp, convErr := nmon.ConvertTimeStamp(timeStr)
-				nmon2influxdblib.CheckError(convErr)
+		if timeStr != topTime {
+			addTopLines()
+		}
+		if topRegexp.MatchString(line) {
+			if nmon.processTagging() {
+				topLines = append(topLines, topLine{elems: elems, timestamp: timestamp})
+				topTime = timeStr
+				return
+			}
+			nmon.AddTopPoints(influxdb, elems, timestamp)
+			flush(10000)
+		}
+	})
+	if err != nil && summary.Error == nil {
+		summary.Error = err
+	}
+	addTopLines()
+	if nmon.Debug {
+		log.Printf("NMON file separator: %s\n", nmon.Delimiter)
+	}
 
-				if len(elems) < 14 {
-					log.Printf("error TOP import:")
-					log.Println(elems)
-					continue
-				}
+	// flushing remaining data
+	if resampler != nil {
+		resampler.Flush()
+	}
+	write()
+	takeRejected()
+	if summary.Error != nil {
+		return
+	}
+	if dryRun != nil {
+		nmon.fillReport(summary.Report, dryRun)
+		if resampler != nil && resampler.Window > 0 {
+			summary.Report.Resample = fmt.Sprintf("%s windows, %s", resampler.Window, config.ImportAggregation)
+		}
+	} else if config.ImportBuildDashboard {
+		// the points are imported even if the dashboard can't be built
+		if dashboardErr := nmon.BuildDashboard(); dashboardErr != nil {
+			log.Printf("unable to build the dashboard of %s: %s\n", summary.File, dashboardErr)
+		}
+	}
 
-				for i, value := range elems[3:12] {
-					column := nmon.DataSeries["TOP"].Columns[i]
+	writeLog()
+	return
+}
 
-					var wlmclass string
-					if len(elems) < 15 {
-						wlmclass = "none"
-					} else {
-						wlmclass = elems[14]
-					}
+// MeasurementName returns the measurement used for a nmon section. Numbered sections like DISKBUSY1 share the same measurement.
+func MeasurementName(name string) string {
+	//VG++
+	if nfsRegexp.MatchString(name) || cpuallRegexp.MatchString(name) {
+		return name
+	}
+	//VG ---
+	return nameRegexp.ReplaceAllString(name, "")
+}
 
-					tags := map[string]string{"host": nmon.Hostname, "name": column, "pid": elems[1], "command": elems[13], "wlm": wlmclass}
+// AddStatsPoints adds one point for each column of a nmon data line. With the wide schema, a single point is added with the columns as fields.
+func (nmon *Nmon) AddStatsPoints(influxdb nmon2influxdblib.PointWriter, name string, elems []string, timestamp time.Time, line string) {
+	measurement := MeasurementName(name)
 
-					if len(nmon.Serial) > 0 {
-						tags["serial"] = nmon.Serial
-					}
+	tags := map[string]string{"host": nmon.Hostname}
+	if measurement == "CPU_ALL" {
+		if len(nmon.MT) > 0 {
+			tags["mtype"] = nmon.MT
+		}
+		if len(nmon.Serial) > 0 {
+			tags["serial"] = nmon.Serial
+		}
+		if len(nmon.SMT) > 0 {
+			tags["smt"] = nmon.SMT
+		}
+		if len(nmon.CPUs) > 0 {
+			tags["cpus_in_sys"] = nmon.CPUs
+		}
+	}
+	if measurement == "MEM" {
+		if len(nmon.MT) > 0 {
+			tags["mtype"] = nmon.MT
+		}
+		if len(nmon.Serial) > 0 {
+			tags["serial"] = nmon.Serial
+		}
+	}
 
-					// try to convert string to integer
-					converted, parseErr := strconv.ParseFloat(value, 64)
-					if parseErr != nil {
-						//if not working, skip to next value. We don't want text values in InfluxDB.
-						continue
-					}
+	// wide schema: one point with a field by column
+	wideFields := make(map[string]interface{})
 
-					//send integer if it worked
-					field := map[string]interface{}{"value": converted}
+	// column values used by the calculated metrics
+	calculations := nmon.calculations[measurement]
+	var values map[string]float64
+	if len(calculations) > 0 {
+		values = make(map[string]float64)
+	}
 
-					influxdb.AddPoint("TOP", timestamp, field, tags)
+	columns := nmon.Columns(name, elems[2:])
+	for i, value := range elems[2:] {
+		if len(columns) < i+1 {
+			continue
+		}
+		column := columns[i]
+		// try to convert string to integer
+		converted, parseErr := strconv.ParseFloat(value, 64)
+		if parseErr != nil || math.IsNaN(converted) {
+			//if not working, skip to next value. We don't want text values in InfluxDB.
+			continue
+		}
+		if values != nil {
+			values[column] = converted
+		}
 
-					if influxdb.PointsCount() == 10000 {
-						err = influxdb.WritePoints()
-						nmon2influxdblib.CheckError(err)
-						count += influxdb.PointsCount()
-						influxdb.ClearPoints()
-						fmt.Printf("#")
-					}
-				}
-			}
+		if nmon.Wide() {
+			wideFields[column] = converted
+			continue
 		}
-		// flushing remaining data
-		influxdb.WritePoints()
-		count += influxdb.PointsCount()
-		fmt.Printf("\nFile %s imported : %d points !\n", nmonFile.Name, count)
-		if config.ImportBuildDashboard {
-			DashboardFile(config, nmonFile.Name)
+
+		//send integer if it worked
+		field := map[string]interface{}{"value": converted}
+		pointTags := map[string]string{"name": column}
+		for key, value := range tags {
+			pointTags[key] = value
 		}
 
-		if len(last) > 0 {
-			field := map[string]interface{}{"value": last}
-			tag := map[string]string{"file": path.Base(nmonFile.Name)}
-			lasttime, _ := nmon.ConvertTimeStamp("now")
-			influxdbLog.AddPoint("timestamp", lasttime, field, tag)
-			influxdbLog.AddPoint("checksum", lasttime, ckfield, tag)
-			err = influxdbLog.WritePoints()
-			nmon2influxdblib.CheckError(err)
+		nmon.ApplyTagParsers(measurement, pointTags)
+		influxdb.AddPoint(measurement, timestamp, field, pointTags)
+	}
+
+	// calculated metrics are written like columns
+	for _, result := range calculations.Evaluate(values) {
+		if nmon.Wide() {
+			wideFields[result.Name] = result.Value
+			continue
 		}
+		pointTags := map[string]string{"name": result.Name}
+		for key, value := range tags {
+			pointTags[key] = value
+		}
+		nmon.ApplyTagParsers(measurement, pointTags)
+		influxdb.AddPoint(measurement, timestamp, map[string]interface{}{"value": result.Value}, pointTags)
 	}
 
-	return nil
+	if len(wideFields) > 0 {
+		nmon.ApplyTagParsers(measurement, tags)
+		influxdb.AddPoint(measurement, timestamp, wideFields, tags)
+	}
+
+	if measurement == "CPU_ALL" {
+		nmon.AddSysinfoPoint(influxdb, timestamp)
+	}
+}
+
+// AddSysinfoPoint adds the SYSINFO point storing the system informations found in the nmon file
+func (nmon *Nmon) AddSysinfoPoint(influxdb nmon2influxdblib.PointWriter, timestamp time.Time) {
+	//VG++
+	systags := map[string]string{"host": nmon.Hostname,
+		"name":      "smt",
+		"mtype":     nmon.MT,
+		"serial":    nmon.Serial,
+		"SysCPU":    nmon.CPUs,
+		"CPUtype":   nmon.CPUtype,
+		"CPUmode":   nmon.CPUmode,
+		"FWlevel":   nmon.FW,
+		"os":        nmon.OS,
+		"osver":     nmon.OSver,
+		"osrelease": nmon.OStl,
+		"uptime":    nmon.uptime,
+		"lparnr":    nmon.LPARnr,
+		"lparname":  nmon.LPARname}
+
+	// try to convert smt string to integer
+	smtfloat := 1.0
+	converted, parseErr := strconv.ParseFloat(nmon.SMT, 64)
+	if parseErr == nil && !math.IsNaN(converted) {
+		smtfloat = converted
+	}
+	//VG--
+
+	// write SYSINFO measurement
+	sysfield := map[string]interface{}{"value": smtfloat}
+
+	nmon.ApplyTagParsers("SYSINFO", systags)
+	influxdb.AddPoint("SYSINFO", timestamp, sysfield, systags)
+}
+
+// AddTopPoints adds the points of a TOP process line
+func (nmon *Nmon) AddTopPoints(influxdb nmon2influxdblib.PointWriter, elems []string, timestamp time.Time) {
+	if len(elems) < 14 {
+		log.Printf("error TOP import:")
+		log.Println(elems)
+		nmon.parseError("invalid TOP line: %v", elems)
+		return
+	}
+
+	var wlmclass string
+	if len(elems) < 15 {
+		wlmclass = "none"
+	} else {
+		wlmclass = elems[14]
+	}
+
+	tags := map[string]string{"host": nmon.Hostname, "pid": elems[1], "command": elems[13], "wlm": wlmclass}
+	if len(nmon.Serial) > 0 {
+		tags["serial"] = nmon.Serial
+	}
+	nmon.addProcessTags(tags, elems[1])
+
+	// wide schema: one point by process with a field by column
+	wideFields := make(map[string]interface{})
+
+	for i, value := range elems[3:12] {
+		column := nmon.DataSeries["TOP"].Columns[i]
+
+		// try to convert string to integer
+		converted, parseErr := strconv.ParseFloat(value, 64)
+		if parseErr != nil {
+			//if not working, skip to next value. We don't want text values in InfluxDB.
+			continue
+		}
+
+		if nmon.Wide() {
+			wideFields[column] = converted
+			continue
+		}
+
+		//send integer if it worked
+		field := map[string]interface{}{"value": converted}
+		pointTags := map[string]string{"name": column}
+		for key, value := range tags {
+			pointTags[key] = value
+		}
+
+		influxdb.AddPoint("TOP", timestamp, field, pointTags)
+	}
+
+	if len(wideFields) > 0 {
+		influxdb.AddPoint("TOP", timestamp, wideFields, tags)
+	}
+}
+
+// ApplyTagParsers adds the custom tags defined in the configuration file
+func (nmon *Nmon) ApplyTagParsers(measurement string, tags map[string]string) {
+	// Checking additional tagging
+	for key, value := range tags {
+		if _, ok := nmon.TagParsers[measurement][key]; ok {
+			for _, tagParser := range nmon.TagParsers[measurement][key] {
+				if tagParser.Regexp.MatchString(value) {
+					tags[tagParser.Name] = tagParser.Value
+				}
+			}
+		}
+
+		if _, ok := nmon.TagParsers["_ALL"][key]; ok {
+			for _, tagParser := range nmon.TagParsers["_ALL"][key] {
+				if tagParser.Regexp.MatchString(value) {
+					tags[tagParser.Name] = tagParser.Value
+				}
+			}
+		}
+	}
 }
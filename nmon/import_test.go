@@ -0,0 +1,167 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+)
+
+// stateLog is an import log returning the same last imported timestamp for every file
+type stateLog struct {
+	timeStamp string
+}
+
+func (importLog *stateLog) ReadState(nmonFile nmon2influxdblib.File) (string, string, error) {
+	return importLog.timeStamp, "", nil
+}
+
+func (importLog *stateLog) WriteState(nmonFile nmon2influxdblib.File, host string, timeStamp string, checksum string) error {
+	importLog.timeStamp = timeStamp
+	return nil
+}
+
+func (importLog *stateLog) AddEntry(entry nmon2influxdblib.JournalEntry) error { return nil }
+
+func (importLog *stateLog) Entries(host string, since time.Time) ([]nmon2influxdblib.JournalEntry, error) {
+	return nil, nil
+}
+
+func (importLog *stateLog) Clear(host string, match func(entry nmon2influxdblib.JournalEntry) bool) (int, error) {
+	return 0, nil
+}
+
+func TestImportResumeResampled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// one snapshot per minute from 00:00 to 00:20, the user value is the minute
+	lines := []string{"AAA,host,lpar1", "CPU_ALL,CPU Total lpar1,User%"}
+	for minute := 0; minute <= 20; minute++ {
+		label := fmt.Sprintf("T%04d", minute+1)
+		lines = append(lines, fmt.Sprintf("ZZZZ,%s,00:%02d:00,01-JAN-2020", label, minute), fmt.Sprintf("CPU_ALL,%s,%d.0", label, minute))
+	}
+	path := filepath.Join(dir, "lpar1.nmon")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := nmon2influxdblib.InitConfig()
+	config.Timezone = "UTC"
+	config.ImportSkipMetrics = ""
+	// 7m doesn't divide 24h: the epoch windows start at 23:58, 00:05, 00:12 and 00:19
+	config.ImportResample = "7m"
+	recorder := make(pointRecorder)
+	summary := ImportFile(&config, nmon2influxdblib.File{Name: path}, recorder, nil, &stateLog{timeStamp: "00:10:00,01-JAN-2020"}, nil, nil)
+	if summary.Error != nil {
+		t.Fatal(summary.Error)
+	}
+
+	// the window of the last imported timestamp is aggregated again with all its points
+	want := map[string]interface{}{
+		"CPU_ALL User% 00:05:00": 8.0,
+		"CPU_ALL User% 00:12:00": 15.0,
+		"CPU_ALL User% 00:19:00": 19.5,
+	}
+	for key, value := range recorder {
+		if !strings.HasPrefix(key, "CPU_ALL ") {
+			continue
+		}
+		if want, ok := want[key]; !ok {
+			t.Errorf("unexpected point %s = %v", key, value)
+		} else if value != want {
+			t.Errorf("point %s = %v, want %v", key, value, want)
+		}
+	}
+	for key := range want {
+		if _, ok := recorder[key]; !ok {
+			t.Errorf("point %s not written", key)
+		}
+	}
+}
+
+// batchWriter counts the written points. The batches containing a point of the rejected measurement are refused.
+type batchWriter struct {
+	rejected string
+	points   int64
+	written  int64
+	// invalid is the time of the first rejected point of the batch
+	invalid string
+}
+
+func (writer *batchWriter) AddPoint(measurement string, timestamp time.Time, fields map[string]interface{}, tags map[string]string) {
+	writer.points++
+	if measurement == writer.rejected && len(writer.invalid) == 0 {
+		writer.invalid = timestamp.Format("15:04:05")
+	}
+}
+
+func (writer *batchWriter) WritePoints() error {
+	if len(writer.invalid) > 0 {
+		return &nmon2influxdblib.HTTPError{StatusCode: http.StatusBadRequest, Message: "partial write: " + writer.rejected + " " + writer.invalid}
+	}
+	writer.written += writer.points
+	return nil
+}
+
+func (writer *batchWriter) PointsCount() int64 { return writer.points }
+
+func (writer *batchWriter) ClearPoints() {
+	writer.points = 0
+	writer.invalid = ""
+}
+
+func TestImportRawPoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lines := []string{"AAA,host,lpar1", "CPU_ALL,CPU Total lpar1,User%", "MEM,Memory lpar1,Real Free %"}
+	for minute := 0; minute < 3; minute++ {
+		label := fmt.Sprintf("T%04d", minute+1)
+		lines = append(lines, fmt.Sprintf("ZZZZ,%s,00:%02d:00,01-JAN-2020", label, minute), "CPU_ALL,"+label+",1.0", "MEM,"+label+",50.0")
+	}
+	path := filepath.Join(dir, "lpar1.nmon")
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := nmon2influxdblib.InitConfig()
+	config.Timezone = "UTC"
+	config.ImportSkipMetrics = ""
+	config.ImportResample = "10m"
+	writer := &batchWriter{}
+	// the raw database rejects the MEM points
+	rawWriter := &batchWriter{rejected: "MEM"}
+	raw := nmon2influxdblib.NewRetryWriter(rawWriter, 0, 0)
+	summary := ImportFile(&config, nmon2influxdblib.File{Name: path}, nmon2influxdblib.NewRetryWriter(writer, 0, 0), raw, nil, nil, nil)
+	if summary.Error != nil {
+		t.Fatal(summary.Error)
+	}
+
+	if summary.Points != writer.written {
+		t.Errorf("%d points, want the %d resampled points written", summary.Points, writer.written)
+	}
+	// each CPU_ALL line also adds a SYSINFO point
+	if summary.RawPoints != 6 || rawWriter.written != 6 {
+		t.Errorf("%d raw points and %d written, want 6", summary.RawPoints, rawWriter.written)
+	}
+	if summary.Rejected != 3 || len(summary.RejectedMessages) != 3 {
+		t.Errorf("%d points rejected with messages %q, want 3 with one message by point", summary.Rejected, summary.RejectedMessages)
+	}
+}
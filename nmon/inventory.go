@@ -0,0 +1,519 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+)
+
+// inventory measurements
+const (
+	inventoryPaging     = "INVENTORY_PAGING"
+	inventoryFilesystem = "INVENTORY_FILESYSTEM"
+	inventoryDisk       = "INVENTORY_DISK"
+	inventoryAdapter    = "INVENTORY_ADAPTER"
+	inventoryNetwork    = "INVENTORY_NETWORK"
+)
+
+var lsconfDeviceRegexp = regexp.MustCompile(`^[pm+*-]?\s+(\w+)\s+(U\S+)\s+(.*)$`)
+var adapterRegexp = regexp.MustCompile(`^(ent|fcs|fscsi|vscsi|sissas|sas|scsi|vhost|vfchost|iscsi|ib|hba)\d+$`)
+var aixDiskRegexp = regexp.MustCompile(`^hdisk\d+$`)
+var linuxDiskRegexp = regexp.MustCompile(`^(sd[a-z]+|vd[a-z]+|hd[a-z]+|xvd[a-z]+|dasd[a-z]+|nvme\d+n\d+)$`)
+var lspvRegexp = regexp.MustCompile(`^(hdisk\d+)\s+(\w{16})\s+(\w+)`)
+var ifconfigRegexp = regexp.MustCompile(`^(\S+?):?\s+(?:flags=\S*(?:.*mtu\s+(\d+))?|Link encap)`)
+var ifconfigInetRegexp = regexp.MustCompile(`^\s+inet (?:addr:)?(\d+\.\d+\.\d+\.\d+)`)
+var ifconfigMtuRegexp = regexp.MustCompile(`MTU:(\d+)`)
+var sizeRegexp = regexp.MustCompile(`^([\d.]+)([KMGTP]?)B?$`)
+
+// inventory stores the BBB lines of a nmon file until the inventory points are written
+type inventory struct {
+	// output of the BBBP commands in the file order
+	commands map[string][]string
+	order    []string
+	// rows of the other BBB sections
+	sections map[string][][]string
+	items    []*inventoryItem
+	written  bool
+}
+
+// inventoryItem is a configuration item like a disk or a filesystem
+type inventoryItem struct {
+	measurement string
+	name        string
+	tags        map[string]string
+	fields      map[string]interface{}
+}
+
+func newInventory() *inventory {
+	return &inventory{commands: make(map[string][]string), sections: make(map[string][][]string)}
+}
+
+// add stores a BBB line. The lines found after the first snapshot are ignored.
+func (inv *inventory) add(line string, delimiter string) {
+	if inv.written {
+		return
+	}
+	if strings.HasPrefix(line, "BBBP"+delimiter) {
+		elems := strings.SplitN(line, delimiter, 4)
+		if len(elems) < 4 {
+			return
+		}
+		if _, ok := inv.commands[elems[2]]; !ok {
+			inv.order = append(inv.order, elems[2])
+		}
+		inv.commands[elems[2]] = append(inv.commands[elems[2]], strings.Trim(elems[3], `"`))
+		return
+	}
+
+	elems := strings.Split(line, delimiter)
+	if len(elems) < 3 {
+		return
+	}
+	row := make([]string, 0, len(elems)-2)
+	for _, elem := range elems[2:] {
+		row = append(row, strings.TrimSpace(strings.Trim(elem, `"`)))
+	}
+	inv.sections[elems[0]] = append(inv.sections[elems[0]], row)
+}
+
+// item returns the item of the measurement with this name. It's created if needed.
+func (inv *inventory) item(measurement string, name string) *inventoryItem {
+	for _, item := range inv.items {
+		if item.measurement == measurement && item.name == name {
+			return item
+		}
+	}
+	item := &inventoryItem{measurement: measurement, name: name, tags: make(map[string]string), fields: map[string]interface{}{"value": 1.0}}
+	inv.items = append(inv.items, item)
+	return item
+}
+
+// setTag sets a tag if the value isn't empty
+func (item *inventoryItem) setTag(tag string, value string) {
+	if value = strings.TrimSpace(value); len(value) > 0 {
+		item.tags[tag] = value
+	}
+}
+
+// setField sets a numeric field if the value can be converted
+func (item *inventoryItem) setField(field string, value string) {
+	if converted, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "%"), 64); err == nil {
+		item.fields[field] = converted
+	}
+}
+
+// commandOutput returns the output of the first BBBP command whose name contains one of the names
+func (inv *inventory) commandOutput(names ...string) (string, []string) {
+	for _, name := range names {
+		for _, command := range inv.order {
+			if strings.Contains(command, name) {
+				return command, inv.commands[command]
+			}
+		}
+	}
+	return "", nil
+}
+
+// parseSize converts sizes like 119.2G or 8192MB in megabytes
+func parseSize(size string) (float64, bool) {
+	matched := sizeRegexp.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(size)))
+	if matched == nil {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(matched[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	switch matched[2] {
+	case "K":
+		value /= 1024
+	case "G":
+		value *= 1024
+	case "T":
+		value *= 1024 * 1024
+	case "P":
+		value *= 1024 * 1024 * 1024
+	case "":
+		// sizes without unit are in bytes
+		value /= 1024 * 1024
+	}
+	return value, true
+}
+
+// deviceName restores the /dev prefix replaced by ddev in the Linux nmon files
+func deviceName(device string) string {
+	if strings.HasPrefix(device, "ddev/") {
+		return "/" + device[1:]
+	}
+	return device
+}
+
+// lsblkRows returns the name, size and type of the lsblk devices and their mount point
+func (inv *inventory) lsblkRows() (rows [][]string) {
+	_, output := inv.commandOutput("lsblk")
+	for _, line := range output {
+		fields := strings.Fields(strings.TrimLeft(line, " ├└│─`|-"))
+		if len(fields) < 6 || fields[0] == "NAME" {
+			continue
+		}
+		mount := ""
+		if len(fields) > 6 {
+			mount = fields[6]
+		}
+		rows = append(rows, []string{fields[0], fields[3], fields[5], mount, fields[2]})
+	}
+	return
+}
+
+// parsePaging extracts the paging spaces from lsps -a, /proc/swaps, lsblk or /proc/meminfo
+func (inv *inventory) parsePaging() {
+	_, output := inv.commandOutput("lsps -a")
+	for _, line := range output {
+		fields := strings.Fields(line)
+		if len(fields) < 8 || fields[0] == "Page" {
+			continue
+		}
+		item := inv.item(inventoryPaging, fields[0])
+		item.setTag("disk", fields[1])
+		item.setTag("vg", fields[2])
+		item.setTag("type", fields[7])
+		if size, ok := parseSize(fields[3]); ok {
+			item.fields["size_mb"] = size
+		}
+		item.setField("used_percent", fields[4])
+		item.fields["active"] = boolField(fields[5] == "yes")
+		item.fields["auto"] = boolField(fields[6] == "yes")
+	}
+
+	_, output = inv.commandOutput("/proc/swaps")
+	for _, line := range output {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] == "Filename" {
+			continue
+		}
+		item := inv.item(inventoryPaging, deviceName(fields[0]))
+		item.setTag("type", fields[1])
+		if size, ok := parseSize(fields[2] + "K"); ok {
+			item.fields["size_mb"] = size
+		}
+		if used, ok := parseSize(fields[3] + "K"); ok {
+			item.fields["used_mb"] = used
+		}
+	}
+	if len(inv.itemsOf(inventoryPaging)) > 0 {
+		return
+	}
+
+	for _, row := range inv.lsblkRows() {
+		if row[3] != "[SWAP]" {
+			continue
+		}
+		item := inv.item(inventoryPaging, row[0])
+		item.setTag("type", row[2])
+		if size, ok := parseSize(row[1]); ok {
+			item.fields["size_mb"] = size
+		}
+	}
+	if len(inv.itemsOf(inventoryPaging)) > 0 {
+		return
+	}
+
+	_, output = inv.commandOutput("/proc/meminfo")
+	for _, line := range output {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "SwapTotal:" || fields[1] == "0" {
+			continue
+		}
+		if size, ok := parseSize(fields[1] + "K"); ok {
+			inv.item(inventoryPaging, "swap").fields["size_mb"] = size
+		}
+	}
+}
+
+// parseFilesystems extracts the filesystems from df and mount. Pseudo filesystems are skipped.
+func (inv *inventory) parseFilesystems() {
+	command, output := inv.commandOutput("df")
+	unit := "M"
+	if strings.Contains(command, "-k") {
+		unit = "K"
+	}
+	for _, line := range output {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "Filesystem" {
+			if strings.Contains(line, "1K-blocks") || strings.Contains(line, "1024-blocks") {
+				unit = "K"
+			}
+			continue
+		}
+		device := deviceName(fieldAt(fields, 0))
+		// pseudo filesystems like /proc on AIX are mounted on their own name
+		if !realDevice(device) || device == fields[len(fields)-1] {
+			continue
+		}
+		var item *inventoryItem
+		switch len(fields) {
+		case 6:
+			// Linux: Filesystem Size Used Available Use% Mounted
+			item = inv.item(inventoryFilesystem, fields[5])
+			setSize(item, "used_mb", fields[2], unit)
+			setSize(item, "free_mb", fields[3], unit)
+			item.setField("used_percent", fields[4])
+		case 7:
+			// AIX: Filesystem Size Free %Used Iused %Iused Mounted
+			item = inv.item(inventoryFilesystem, fields[6])
+			setSize(item, "free_mb", fields[2], unit)
+			item.setField("used_percent", fields[3])
+			item.setField("inodes_used_percent", fields[5])
+		default:
+			continue
+		}
+		item.setTag("device", device)
+		setSize(item, "size_mb", fields[1], unit)
+	}
+
+	_, output = inv.commandOutput("mount")
+	for _, line := range output {
+		fields := strings.Fields(line)
+		var device, mount, vfs string
+		switch {
+		case len(fields) >= 5 && fields[1] == "on" && fields[3] == "type":
+			// Linux: device on mount type vfs (options)
+			device, mount, vfs = fields[0], fields[2], fields[4]
+		case len(fields) == 7 && strings.HasPrefix(fields[0], "/"):
+			// AIX: device mount vfs date options
+			device, mount, vfs = fields[0], fields[1], fields[2]
+		case len(fields) == 8:
+			// AIX remote filesystem: node device mount vfs date options
+			device, mount, vfs = fields[0]+":"+fields[1], fields[2], fields[3]
+		default:
+			continue
+		}
+		device = deviceName(device)
+		// pseudo filesystems like /proc on AIX are mounted on their own name
+		if !realDevice(device) || device == mount {
+			continue
+		}
+		item := inv.item(inventoryFilesystem, mount)
+		item.setTag("device", device)
+		item.setTag("vfs", vfs)
+	}
+}
+
+// parseDisks extracts the disks from lsblk, /proc/partitions, lsconf, lspv, lspath and the BBBB section
+func (inv *inventory) parseDisks() {
+	for _, row := range inv.lsblkRows() {
+		if row[2] != "disk" && row[2] != "mpath" {
+			continue
+		}
+		item := inv.item(inventoryDisk, row[0])
+		item.setTag("type", row[2])
+		item.setField("removable", row[4])
+		if size, ok := parseSize(row[1]); ok {
+			item.fields["size_mb"] = size
+		}
+	}
+	if len(inv.itemsOf(inventoryDisk)) == 0 {
+		_, output := inv.commandOutput("/proc/partitions")
+		for _, line := range output {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || !linuxDiskRegexp.MatchString(fields[3]) {
+				continue
+			}
+			setSize(inv.item(inventoryDisk, fields[3]), "size_mb", fields[2], "K")
+		}
+	}
+
+	_, output := inv.commandOutput("lsconf")
+	for _, line := range output {
+		matched := lsconfDeviceRegexp.FindStringSubmatch(line)
+		if matched == nil || !aixDiskRegexp.MatchString(matched[1]) {
+			continue
+		}
+		item := inv.item(inventoryDisk, matched[1])
+		item.setTag("location", matched[2])
+		item.setTag("description", matched[3])
+	}
+
+	for _, row := range inv.sections["BBBB"] {
+		if len(row) < 2 || !aixDiskRegexp.MatchString(row[0]) {
+			continue
+		}
+		item := inv.item(inventoryDisk, row[0])
+		setSize(item, "size_mb", row[1], "G")
+		if len(row) > 2 {
+			item.setTag("attach", row[2])
+		}
+	}
+
+	for _, row := range inv.sections["BBBC"] {
+		if len(row) == 0 {
+			continue
+		}
+		if matched := lspvRegexp.FindStringSubmatch(row[0]); matched != nil && matched[3] != "None" {
+			inv.item(inventoryDisk, matched[1]).setTag("vg", matched[3])
+		}
+	}
+
+	// lspath: status disk parent
+	_, output = inv.commandOutput("lspath")
+	for _, line := range output {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !aixDiskRegexp.MatchString(fields[1]) {
+			continue
+		}
+		item := inv.item(inventoryDisk, fields[1])
+		item.fields["paths"] = numberField(item.fields["paths"]) + 1
+		if fields[0] == "Enabled" {
+			item.fields["enabled_paths"] = numberField(item.fields["enabled_paths"]) + 1
+		} else {
+			item.fields["enabled_paths"] = numberField(item.fields["enabled_paths"])
+		}
+	}
+}
+
+// parseAdapters extracts the adapters from lsconf and the BBBD section
+func (inv *inventory) parseAdapters() {
+	_, output := inv.commandOutput("lsconf")
+	for _, line := range output {
+		matched := lsconfDeviceRegexp.FindStringSubmatch(line)
+		if matched == nil || !adapterRegexp.MatchString(matched[1]) {
+			continue
+		}
+		item := inv.item(inventoryAdapter, matched[1])
+		item.setTag("location", matched[2])
+		item.setTag("description", matched[3])
+	}
+
+	// Adapter_number,Name,Disks,Description
+	for _, row := range inv.sections["BBBD"] {
+		if len(row) < 4 || row[1] == "Name" {
+			continue
+		}
+		item := inv.item(inventoryAdapter, row[1])
+		item.setField("disks", row[2])
+		item.setTag("description", row[3])
+	}
+}
+
+// parseNetwork extracts the network interfaces from the BBBN section and ifconfig
+func (inv *inventory) parseNetwork() {
+	// NetworkName,MTU,Mbits,Name
+	for _, row := range inv.sections["BBBN"] {
+		if len(row) < 4 || row[0] == "NetworkName" {
+			continue
+		}
+		item := inv.item(inventoryNetwork, row[0])
+		item.setField("mtu", row[1])
+		item.setField("speed_mbits", row[2])
+		item.setTag("description", strings.Join(row[3:], ","))
+	}
+
+	var item *inventoryItem
+	_, output := inv.commandOutput("ifconfig")
+	for _, line := range output {
+		if matched := ifconfigRegexp.FindStringSubmatch(line); matched != nil {
+			item = inv.item(inventoryNetwork, matched[1])
+			item.setField("mtu", matched[2])
+			continue
+		}
+		if item == nil {
+			continue
+		}
+		if matched := ifconfigInetRegexp.FindStringSubmatch(line); matched != nil {
+			item.setTag("address", matched[1])
+		}
+		if matched := ifconfigMtuRegexp.FindStringSubmatch(line); matched != nil {
+			item.setField("mtu", matched[1])
+		}
+	}
+}
+
+// itemsOf returns the items of a measurement
+func (inv *inventory) itemsOf(measurement string) (items []*inventoryItem) {
+	for _, item := range inv.items {
+		if item.measurement == measurement {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+// setSize sets a size field in megabytes
+func setSize(item *inventoryItem, field string, value string, unit string) {
+	if size, ok := parseSize(value + unit); ok {
+		item.fields[field] = size
+	}
+}
+
+// realDevice returns false for the pseudo filesystems like proc or tmpfs
+func realDevice(device string) bool {
+	return strings.HasPrefix(device, "/") || strings.Contains(device, ":")
+}
+
+// fieldAt returns the field i or an empty string
+func fieldAt(fields []string, i int) string {
+	if i < len(fields) {
+		return fields[i]
+	}
+	return ""
+}
+
+// boolField converts a boolean in a numeric field
+func boolField(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// numberField returns the value of a numeric field or 0
+func numberField(value interface{}) float64 {
+	number, _ := value.(float64)
+	return number
+}
+
+// AddInventoryPoints adds the configuration items found in the BBB sections. The items are tagged with the host and their name.
+func (nmon *Nmon) AddInventoryPoints(influxdb nmon2influxdblib.PointWriter, timestamp time.Time) {
+	inv := nmon.inventory
+	if inv == nil || inv.written {
+		return
+	}
+	inv.written = true
+	inv.parsePaging()
+	inv.parseFilesystems()
+	inv.parseDisks()
+	inv.parseAdapters()
+	inv.parseNetwork()
+
+	// the identifiers found in the BBB lines are replaced when the import is anonymized
+	var a *anonymizer
+	if nmon.mapping != nil {
+		a = newAnonymizer(nmon.mapping)
+	}
+	for _, item := range inv.items {
+		if a != nil {
+			for tag, value := range item.tags {
+				item.tags[tag] = a.text(value)
+			}
+			if item.measurement == inventoryFilesystem {
+				item.name = anonymizePath(nmon.mapping, item.name)
+			} else {
+				item.name = a.text(item.name)
+			}
+		}
+		item.tags["host"] = nmon.Hostname
+		item.tags["name"] = item.name
+		nmon.ApplyTagParsers(item.measurement, item.tags)
+		influxdb.AddPoint(item.measurement, timestamp, item.fields, item.tags)
+	}
+	// the BBB lines are not needed anymore
+	inv.commands = nil
+	inv.sections = nil
+}
@@ -0,0 +1,256 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"reflect"
+	"testing"
+)
+
+// parseInventory parses the BBB lines and returns the items by measurement and name
+func parseInventory(lines []string) map[string]*inventoryItem {
+	inv := newInventory()
+	for _, line := range lines {
+		inv.add(line, ",")
+	}
+	inv.parsePaging()
+	inv.parseFilesystems()
+	inv.parseDisks()
+	inv.parseAdapters()
+	inv.parseNetwork()
+
+	items := make(map[string]*inventoryItem)
+	for _, item := range inv.items {
+		items[item.measurement+" "+item.name] = item
+	}
+	return items
+}
+
+var aixInventory = []string{
+	`BBBP,001,lsps -a,"Page Space      Physical Volume   Volume Group    Size %Used Active  Auto  Type Chksum"`,
+	`BBBP,002,lsps -a,"hd6             hdisk0            rootvg         512MB     3   yes   yes    lv     0"`,
+	`BBBP,003,df -m,"Filesystem    MB blocks      Free %Used    Iused %Iused Mounted on"`,
+	`BBBP,004,df -m,"/dev/hd4         512.00    300.50   42%     3000     5% /"`,
+	`BBBP,005,df -m,"/proc                 -         -    -         -     -  /proc"`,
+	`BBBP,006,mount,"  node       mounted        mounted over    vfs       date        options      "`,
+	`BBBP,007,mount,"         /dev/hd4         /                jfs2   Jan 01 10:00 rw,log=/dev/hd8 "`,
+	`BBBP,008,mount,"         /proc            /proc            procfs Jan 01 10:00 rw               "`,
+	`BBBP,009,mount,"nfssrv   /export/data     /data            nfs3   Jan 01 10:01 bg,hard,intr     "`,
+	`BBBP,010,lsconf,"* hdisk0           U8286.42A.21ABCDE-V1-C2-T1-L8100000000000000  Virtual SCSI Disk Drive"`,
+	`BBBP,011,lsconf,"+ ent0             U8286.42A.21ABCDE-V1-C3-T1  Virtual I/O Ethernet Adapter (l-lan)"`,
+	`BBBP,012,lspath,"Enabled hdisk0 vscsi0"`,
+	`BBBP,013,lspath,"Failed hdisk0 vscsi1"`,
+	`BBBB,0000,name,size(GB),disc attach type`,
+	`BBBB,0001,hdisk0,30,virtual`,
+	`BBBC,001,hdisk0          00f6db0a6c7aece5                    rootvg          active`,
+	`BBBD,000,Adapter_number,Name,Disks,Description`,
+	`BBBD,001,0,vscsi0,1,Virtual SCSI Client Adapter`,
+	`BBBN,000,NetworkName,MTU,Mbits,Name`,
+	`BBBN,001,en0,1500,1024,Standard Ethernet Network Interface`,
+}
+
+var linuxInventory = []string{
+	`BBBP,001,/proc/swaps,"Filename				Type		Size	Used	Priority"`,
+	`BBBP,002,/proc/swaps,"/dev/dm-1                               partition	2097148	1024	-2"`,
+	`BBBP,003,df-m,"Filesystem     1M-blocks  Used Available Use% Mounted on"`,
+	`BBBP,004,df-m,"/dev/mapper/rhel-root     17394  4512     12883  26% /"`,
+	`BBBP,005,df-m,"tmpfs                      1000     0      1000   0% /dev/shm"`,
+	`BBBP,006,mount,"/dev/mapper/rhel-root on / type xfs (rw,relatime)"`,
+	`BBBP,007,mount,"proc on /proc type proc (rw,nosuid)"`,
+	`BBBP,008,lsblk,"NAME          MAJ:MIN RM  SIZE RO TYPE MOUNTPOINT"`,
+	`BBBP,009,lsblk,"sda             8:0    0   20G  0 disk "`,
+	`BBBP,010,lsblk,"├─sda1          8:1    0    1G  0 part /boot"`,
+	`BBBP,011,lsblk,"sr0            11:0    1 1024M  0 rom  "`,
+	`BBBP,012,ifconfig,"eth0: flags=4163<UP,BROADCAST,RUNNING,MULTICAST>  mtu 1500"`,
+	`BBBP,013,ifconfig,"        inet 10.0.0.5  netmask 255.255.255.0  broadcast 10.0.0.255"`,
+	`BBBP,014,ifconfig,"lo        Link encap:Local Loopback  "`,
+	`BBBP,015,ifconfig,"          inet addr:127.0.0.1  Mask:255.0.0.0"`,
+	`BBBP,016,ifconfig,"          UP LOOPBACK RUNNING  MTU:65536  Metric:1"`,
+}
+
+func TestInventoryItems(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  map[string]inventoryItem
+	}{
+		{
+			name:  "aix",
+			lines: aixInventory,
+			want: map[string]inventoryItem{
+				"INVENTORY_PAGING hd6": {
+					tags:   map[string]string{"disk": "hdisk0", "vg": "rootvg", "type": "lv"},
+					fields: map[string]interface{}{"value": 1.0, "size_mb": 512.0, "used_percent": 3.0, "active": 1.0, "auto": 1.0},
+				},
+				"INVENTORY_FILESYSTEM /": {
+					tags:   map[string]string{"device": "/dev/hd4", "vfs": "jfs2"},
+					fields: map[string]interface{}{"value": 1.0, "size_mb": 512.0, "free_mb": 300.5, "used_percent": 42.0, "inodes_used_percent": 5.0},
+				},
+				"INVENTORY_FILESYSTEM /data": {
+					tags:   map[string]string{"device": "nfssrv:/export/data", "vfs": "nfs3"},
+					fields: map[string]interface{}{"value": 1.0},
+				},
+				"INVENTORY_DISK hdisk0": {
+					tags:   map[string]string{"location": "U8286.42A.21ABCDE-V1-C2-T1-L8100000000000000", "description": "Virtual SCSI Disk Drive", "attach": "virtual", "vg": "rootvg"},
+					fields: map[string]interface{}{"value": 1.0, "size_mb": 30720.0, "paths": 2.0, "enabled_paths": 1.0},
+				},
+				"INVENTORY_ADAPTER ent0": {
+					tags:   map[string]string{"location": "U8286.42A.21ABCDE-V1-C3-T1", "description": "Virtual I/O Ethernet Adapter (l-lan)"},
+					fields: map[string]interface{}{"value": 1.0},
+				},
+				"INVENTORY_ADAPTER vscsi0": {
+					tags:   map[string]string{"description": "Virtual SCSI Client Adapter"},
+					fields: map[string]interface{}{"value": 1.0, "disks": 1.0},
+				},
+				"INVENTORY_NETWORK en0": {
+					tags:   map[string]string{"description": "Standard Ethernet Network Interface"},
+					fields: map[string]interface{}{"value": 1.0, "mtu": 1500.0, "speed_mbits": 1024.0},
+				},
+			},
+		},
+		{
+			name:  "linux",
+			lines: linuxInventory,
+			want: map[string]inventoryItem{
+				"INVENTORY_PAGING /dev/dm-1": {
+					tags:   map[string]string{"type": "partition"},
+					fields: map[string]interface{}{"value": 1.0, "size_mb": 2097148.0 / 1024, "used_mb": 1.0},
+				},
+				"INVENTORY_FILESYSTEM /": {
+					tags:   map[string]string{"device": "/dev/mapper/rhel-root", "vfs": "xfs"},
+					fields: map[string]interface{}{"value": 1.0, "size_mb": 17394.0, "used_mb": 4512.0, "free_mb": 12883.0, "used_percent": 26.0},
+				},
+				"INVENTORY_DISK sda": {
+					tags:   map[string]string{"type": "disk"},
+					fields: map[string]interface{}{"value": 1.0, "size_mb": 20480.0, "removable": 0.0},
+				},
+				"INVENTORY_NETWORK eth0": {
+					tags:   map[string]string{"address": "10.0.0.5"},
+					fields: map[string]interface{}{"value": 1.0, "mtu": 1500.0},
+				},
+				"INVENTORY_NETWORK lo": {
+					tags:   map[string]string{"address": "127.0.0.1"},
+					fields: map[string]interface{}{"value": 1.0, "mtu": 65536.0},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := parseInventory(test.lines)
+			for key, want := range test.want {
+				item, ok := items[key]
+				if !ok {
+					t.Errorf("%s not found", key)
+					continue
+				}
+				if !reflect.DeepEqual(item.tags, want.tags) {
+					t.Errorf("%s: tags = %v, want %v", key, item.tags, want.tags)
+				}
+				if !reflect.DeepEqual(item.fields, want.fields) {
+					t.Errorf("%s: fields = %v, want %v", key, item.fields, want.fields)
+				}
+			}
+			for key := range items {
+				if _, ok := test.want[key]; !ok {
+					t.Errorf("unexpected item %s", key)
+				}
+			}
+		})
+	}
+}
+
+func TestInventoryPagingFallback(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+		size  float64
+	}{
+		{
+			name: "lsblk",
+			lines: []string{
+				`BBBP,001,lsblk,"NAME          MAJ:MIN RM  SIZE RO TYPE MOUNTPOINT"`,
+				`BBBP,002,lsblk,"└─rhel-swap  253:1    0    2G  0 lvm  [SWAP]"`,
+				`BBBP,003,/proc/meminfo,"SwapTotal:       2097148 kB"`,
+			},
+			want: "rhel-swap",
+			size: 2048,
+		},
+		{
+			name: "meminfo",
+			lines: []string{
+				`BBBP,001,/proc/meminfo,"MemTotal:        8008692 kB"`,
+				`BBBP,002,/proc/meminfo,"SwapTotal:       2097152 kB"`,
+			},
+			want: "swap",
+			size: 2048,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items := parseInventory(test.lines)
+			if len(items) != 1 {
+				t.Fatalf("%d items, want 1", len(items))
+			}
+			item, ok := items[inventoryPaging+" "+test.want]
+			if !ok {
+				t.Fatalf("paging space %s not found in %v", test.want, items)
+			}
+			if item.fields["size_mb"] != test.size {
+				t.Errorf("size = %v, want %v", item.fields["size_mb"], test.size)
+			}
+		})
+	}
+}
+
+func TestInventoryAfterFirstSnapshot(t *testing.T) {
+	inv := newInventory()
+	inv.add(`BBBN,001,en0,1500,1024,Standard Ethernet Network Interface`, ",")
+	inv.written = true
+	inv.add(`BBBN,002,en1,1500,1024,Standard Ethernet Network Interface`, ",")
+	if len(inv.sections["BBBN"]) != 1 {
+		t.Errorf("%d BBBN rows, want 1", len(inv.sections["BBBN"]))
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size string
+		want float64
+		ok   bool
+	}{
+		{"512MB", 512, true},
+		{"119.2G", 119.2 * 1024, true},
+		{"2048K", 2, true},
+		{"1t", 1024 * 1024, true},
+		{"1048576", 1, true},
+		{" 8M ", 8, true},
+		{"-", 0, false},
+		{"12X", 0, false},
+	}
+	for _, test := range tests {
+		got, ok := parseSize(test.size)
+		if ok != test.ok || got != test.want {
+			t.Errorf("parseSize(%q) = %v %v, want %v %v", test.size, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestDeviceName(t *testing.T) {
+	tests := map[string]string{
+		"ddev/sda1": "/dev/sda1",
+		"/dev/hd4":  "/dev/hd4",
+		"tmpfs":     "tmpfs",
+		"ddevice/x": "ddevice/x",
+	}
+	for device, want := range tests {
+		if got := deviceName(device); got != want {
+			t.Errorf("deviceName(%q) = %q, want %q", device, got, want)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+// nmon2influxdb
+// import nmon report in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/adejoux/influxdbclient"
+	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+	"github.com/urfave/cli/v2"
+)
+
+// journalMeasurement is the import log measurement describing each import
+const journalMeasurement = "import"
+
+// import status recorded in the journal
+const (
+	importOK      = "ok"
+	importPartial = "partial"
+	importFailed  = "failed"
+)
+
+var relativeSinceRegexp = regexp.MustCompile(`^(\d+)([smhdw])$`)
+
+// ImportLog keeps the import state of the nmon files and the import journal.
+// It's stored in the InfluxDB import log database or in a local state store.
+type ImportLog interface {
+	// ReadState returns the last imported timestamp and the checksum of the file
+	ReadState(nmonFile nmon2influxdblib.File) (timeStamp string, checksum string, err error)
+	// WriteState stores the last imported timestamp and the checksum of the file. The checksum is empty for streams.
+	WriteState(nmonFile nmon2influxdblib.File, host string, timeStamp string, checksum string) error
+	// AddEntry records an import in the journal
+	AddEntry(entry nmon2influxdblib.JournalEntry) error
+	// Entries returns the journal entries of host since the time. Empty host and zero time select all the entries.
+	Entries(host string, since time.Time) ([]nmon2influxdblib.JournalEntry, error)
+	// Clear removes the import state and the journal entries of the files of host having a journal entry selected by match.
+	// The files without journal entry are always cleared. It returns the number of files cleared.
+	Clear(host string, match func(entry nmon2influxdblib.JournalEntry) bool) (int, error)
+}
+
+// influxImportLog is the import log stored in the InfluxDB log database. The journal has its own database to keep it longer.
+type influxImportLog struct {
+	db            nmon2influxdblib.DB
+	writer        *nmon2influxdblib.RetryWriter
+	journal       nmon2influxdblib.DB
+	journalWriter *nmon2influxdblib.RetryWriter
+}
+
+// newInfluxImportLog returns the import log stored in db and journal. The writes are retried like the points writes.
+// The journal entries are written with a nanosecond precision to keep the imports done in the same second.
+func newInfluxImportLog(config *nmon2influxdblib.Config, db nmon2influxdblib.DB, journal nmon2influxdblib.DB) *influxImportLog {
+	journal.SetPrecision("ns")
+	return &influxImportLog{db: db, writer: config.NewRetryWriter(db), journal: journal, journalWriter: config.NewRetryWriter(journal)}
+}
+
+// connectInfluxImportLog connects to the import log and journal databases
+func connectInfluxImportLog(config *nmon2influxdblib.Config) (*influxImportLog, error) {
+	db, err := config.ConnectDB(config.ImportLogDatabase)
+	if err != nil {
+		return nil, err
+	}
+	journal, err := config.ConnectDB(config.JournalDatabase)
+	if err != nil {
+		return nil, err
+	}
+	return newInfluxImportLog(config, db, journal), nil
+}
+
+// journalFilters returns the filters selecting the import log points of a file.
+// The points written before the source tag was added are selected if legacy is true.
+func journalFilters(nmonFile nmon2influxdblib.File, legacy bool) *influxdbclient.Filters {
+	filters := new(influxdbclient.Filters)
+	filters.Add("file", quoteTagValue(nmonFile.LogName()), "text")
+	if legacy {
+		filters.Add("source", "", "text")
+	} else {
+		filters.Add("source", quoteTagValue(nmonFile.Source()), "text")
+	}
+	return filters
+}
+
+// quoteTagValue escapes the backslashes and the single quotes of a tag value used in a query
+func quoteTagValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(value)
+}
+
+// ReadState returns the last imported timestamp and the checksum of the file.
+// Files imported by older versions are only identified by their base name.
+func (importLog *influxImportLog) ReadState(nmonFile nmon2influxdblib.File) (timeStamp string, checksum string, err error) {
+	for _, legacy := range []bool{false, true} {
+		filters := journalFilters(nmonFile, legacy)
+		timeStamp, err = importLog.db.ReadLastPoint("value", filters, "timestamp")
+		if err != nil {
+			return
+		}
+		checksum, err = importLog.db.ReadLastPoint("value", filters, "checksum")
+		if err != nil || len(timeStamp) > 0 || len(checksum) > 0 {
+			return
+		}
+	}
+	return
+}
+
+// WriteState writes the timestamp and checksum points. They are written once a day for each file.
+func (importLog *influxImportLog) WriteState(nmonFile nmon2influxdblib.File, host string, timeStamp string, checksum string) error {
+	tags := map[string]string{"file": nmonFile.LogName(), "source": nmonFile.Source()}
+	if len(host) > 0 {
+		tags["host"] = host
+	}
+	day := time.Now().Truncate(24 * time.Hour)
+	importLog.writer.AddPoint("timestamp", day, map[string]interface{}{"value": timeStamp}, tags)
+	if len(checksum) > 0 {
+		importLog.writer.AddPoint("checksum", day, map[string]interface{}{"value": checksum}, tags)
+	}
+	defer importLog.writer.ClearPoints()
+	return importLog.writer.WritePoints()
+}
+
+// AddEntry writes the journal entry in the import measurement
+func (importLog *influxImportLog) AddEntry(entry nmon2influxdblib.JournalEntry) error {
+	tags := map[string]string{"file": entry.File, "source": entry.Source, "status": entry.Status}
+	if len(entry.Host) > 0 {
+		tags["host"] = entry.Host
+	}
+	fields := map[string]interface{}{
+		"points":   entry.Points,
+		"sections": entry.Sections,
+		"duration": entry.Duration,
+	}
+	if len(entry.Error) > 0 {
+		fields["error"] = entry.Error
+	}
+	if entry.Rejected > 0 {
+		fields["rejected"] = entry.Rejected
+	}
+	if !entry.Start.IsZero() {
+		fields["start"] = entry.Start.UTC().Format(time.RFC3339)
+		fields["end"] = entry.End.UTC().Format(time.RFC3339)
+	}
+	importLog.journalWriter.AddPoint(journalMeasurement, entry.Time, fields, tags)
+	defer importLog.journalWriter.ClearPoints()
+	return importLog.journalWriter.WritePoints()
+}
+
+// Entries reads the journal entries in the import measurement
+func (importLog *influxImportLog) Entries(host string, since time.Time) (entries []nmon2influxdblib.JournalEntry, err error) {
+	var filterQuery influxdbclient.FilterQuery
+	if len(host) > 0 {
+		filters := new(influxdbclient.Filters)
+		filters.Add("host", quoteTagValue(host), "text")
+		filterQuery.AddFilters(filters)
+	}
+	if !since.IsZero() {
+		filterQuery.Append(fmt.Sprintf("time > '%s'", since.UTC().Format(time.RFC3339)))
+	}
+
+	cmd := fmt.Sprintf("SELECT * FROM \"%s\"", journalMeasurement)
+	if len(filterQuery.Content) > 0 {
+		cmd += " WHERE " + filterQuery.Content
+	}
+	res, err := importLog.journal.Query(cmd)
+	if err != nil || len(res) == 0 || len(res[0].Series) == 0 {
+		return
+	}
+
+	serie := res[0].Series[0]
+	for _, row := range serie.Values {
+		var entry nmon2influxdblib.JournalEntry
+		for i, column := range serie.Columns {
+			if row[i] == nil {
+				continue
+			}
+			switch column {
+			case "time":
+				entry.Time, _ = time.Parse(time.RFC3339Nano, fmt.Sprint(row[i]))
+			case "file":
+				entry.File = fmt.Sprint(row[i])
+			case "host":
+				entry.Host = fmt.Sprint(row[i])
+			case "source":
+				entry.Source = fmt.Sprint(row[i])
+			case "status":
+				entry.Status = fmt.Sprint(row[i])
+			case "points":
+				entry.Points, _ = row[i].(json.Number).Int64()
+			case "rejected":
+				entry.Rejected, _ = row[i].(json.Number).Int64()
+			case "sections":
+				entry.Sections = fmt.Sprint(row[i])
+			case "duration":
+				entry.Duration, _ = row[i].(json.Number).Float64()
+			case "error":
+				entry.Error = fmt.Sprint(row[i])
+			case "start":
+				entry.Start, _ = time.Parse(time.RFC3339, fmt.Sprint(row[i]))
+			case "end":
+				entry.End, _ = time.Parse(time.RFC3339, fmt.Sprint(row[i]))
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return
+}
+
+// Clear deletes the timestamp, checksum and journal points of the files of host having a journal entry selected by match.
+// The state points written before the source tag was added are only deleted if they are tagged with host:
+// they are only identified by the file base name, which can be shared by the files of other hosts.
+func (importLog *influxImportLog) Clear(host string, match func(entry nmon2influxdblib.JournalEntry) bool) (int, error) {
+	entries, err := importLog.Entries(host, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	journaled, sources := nmon2influxdblib.JournalSources(entries, match)
+	names := make(map[string]string)
+	for _, entry := range entries {
+		names[entry.Source] = entry.File
+	}
+	// the time frame of the files without journal entry is unknown
+	states, err := importLog.stateFiles(host)
+	if err != nil {
+		return 0, err
+	}
+	for source, name := range states {
+		if !journaled[source] {
+			sources[source] = true
+			names[source] = name
+		}
+	}
+
+	for source := range sources {
+		tagSets := []map[string]string{{"file": names[source], "source": source}}
+		tagged, untagged, err := importLog.legacyStates(names[source], host)
+		if err != nil {
+			return 0, err
+		}
+		if tagged {
+			tagSets = append(tagSets, map[string]string{"file": names[source], "source": "", "host": host})
+		}
+		if untagged {
+			log.Printf("legacy import state of %s kept: it can't be tied to host %s. Use import --force to import the file again.\n", names[source], host)
+		}
+		for _, measurement := range []string{"timestamp", "checksum"} {
+			for _, tags := range tagSets {
+				if err := importLog.db.Delete(measurement, tags, time.Time{}, time.Time{}); err != nil {
+					return 0, err
+				}
+			}
+		}
+		if err := importLog.journal.Delete(journalMeasurement, map[string]string{"host": host, "source": source}, time.Time{}, time.Time{}); err != nil {
+			return 0, err
+		}
+	}
+	return len(sources), nil
+}
+
+// legacyStates reports whether the file has state points without source tag tagged with host, and without host tag
+func (importLog *influxImportLog) legacyStates(name string, host string) (tagged bool, untagged bool, err error) {
+	cmd := fmt.Sprintf(`SELECT count("value") FROM "timestamp" WHERE "file" = '%s' AND "source" = '' GROUP BY "host"`, quoteTagValue(name))
+	res, err := importLog.db.Query(cmd)
+	if err != nil {
+		return
+	}
+	for _, result := range res {
+		for _, serie := range result.Series {
+			switch serie.Tags["host"] {
+			case host:
+				tagged = true
+			case "":
+				untagged = true
+			}
+		}
+	}
+	return
+}
+
+// stateFiles returns the names of the files of host in the import state, by source
+func (importLog *influxImportLog) stateFiles(host string) (map[string]string, error) {
+	cmd := fmt.Sprintf(`SELECT last("value") FROM "timestamp" WHERE "host" = '%s' GROUP BY "file", "source"`, quoteTagValue(host))
+	res, err := importLog.db.Query(cmd)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	for _, result := range res {
+		for _, serie := range result.Series {
+			if len(serie.Tags["source"]) > 0 {
+				files[serie.Tags["source"]] = serie.Tags["file"]
+			}
+		}
+	}
+	return files, nil
+}
+
+// Status returns the import status recorded in the journal
+func (summary ImportSummary) Status() string {
+	switch {
+	case summary.Error != nil:
+		return importFailed
+	case summary.Rejected > 0:
+		return importPartial
+	}
+	return importOK
+}
+
+// journalEntry returns the journal entry describing the import of the file. Numbered sections like CPU01 are recorded once.
+func (nmon *Nmon) journalEntry(nmonFile nmon2influxdblib.File, summary ImportSummary, duration time.Duration) nmon2influxdblib.JournalEntry {
+	names := make(map[string]bool)
+	for name := range nmon.DataSeries {
+		names[nameRegexp.ReplaceAllString(name, "")] = true
+	}
+	sections := make([]string, 0, len(names))
+	for name := range names {
+		sections = append(sections, name)
+	}
+	sort.Strings(sections)
+
+	entry := nmon2influxdblib.JournalEntry{
+		Time:     time.Now(),
+		File:     nmonFile.LogName(),
+		Host:     nmon.Hostname,
+		Source:   nmonFile.Source(),
+		Status:   summary.Status(),
+		Points:   summary.Points,
+		Rejected: summary.Rejected,
+		Sections: strings.Join(sections, ","),
+		Duration: duration.Seconds(),
+		Start:    summary.Start,
+		End:      summary.End,
+	}
+	if summary.Error != nil {
+		entry.Error = summary.Error.Error()
+	}
+	return entry
+}
+
+// parseSince returns the start of the history. since is a duration like 7d or a date.
+func parseSince(since string) (time.Time, error) {
+	if matched := relativeSinceRegexp.FindStringSubmatch(since); matched != nil {
+		count, _ := strconv.Atoi(matched[1])
+		unit := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour, "w": 7 * 24 * time.Hour}[matched[2]]
+		return time.Now().Add(-time.Duration(count) * unit), nil
+	}
+	if t, ok := parseDate(since); ok {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid since value %s: use a duration like 12h or 7d, or a date like 2006-01-02", since)
+}
+
+// parseDate reads a date like 2006-01-02, 2006-01-02 15:04:05 in local time, or a RFC3339 date
+func parseDate(date string) (time.Time, bool) {
+	for _, format := range []string{"2006-01-02", "2006-01-02 15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(format, date, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// openImportLog returns the local state store if a state file is configured, or the InfluxDB import log.
+// The state store must be closed after use.
+func openImportLog(config *nmon2influxdblib.Config) (ImportLog, *nmon2influxdblib.StateStore, error) {
+	if len(config.ImportStateFile) > 0 {
+		store, err := nmon2influxdblib.OpenStateStore(config.ImportStateFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, store, nil
+	}
+	importLog, err := connectInfluxImportLog(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return importLog, nil, nil
+}
+
+// History is the entry point for the import history sub command
+func History(c *cli.Context) error {
+	config, err := nmon2influxdblib.ParseParameters(c)
+	if err != nil {
+		return err
+	}
+	var since time.Time
+	if len(c.String("since")) > 0 {
+		if since, err = parseSince(c.String("since")); err != nil {
+			return err
+		}
+	}
+	importLog, store, err := openImportLog(config)
+	if err != nil {
+		return err
+	}
+	if store != nil {
+		defer store.Close()
+	}
+	entries, err := importLog.Entries(c.String("host"), since)
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "TIME\tHOST\tSTATUS\tPOINTS\tDURATION\tSOURCE\n")
+	for _, entry := range entries {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%.1fs\t%s\n", entry.Time.Local().Format("2006-01-02 15:04:05"), entry.Host, entry.Status, entry.Points, entry.Duration, entry.Source)
+		if entry.Rejected > 0 {
+			fmt.Fprintf(writer, "\t\t\t\t\t%d points rejected\n", entry.Rejected)
+		}
+		if len(entry.Error) > 0 {
+			fmt.Fprintf(writer, "\t\t\t\t\terror: %s\n", entry.Error)
+		}
+	}
+	return writer.Flush()
+}
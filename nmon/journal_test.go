@@ -0,0 +1,26 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import "testing"
+
+func TestQuoteTagValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"/data/lpar1.nmon", "/data/lpar1.nmon"},
+		{"/data/o'brien.nmon", `/data/o\'brien.nmon`},
+		{`C:\nmon\`, `C:\\nmon\\`},
+		{`sftp://host/a\'b`, `sftp://host/a\\\'b`},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			if got := quoteTagValue(test.value); got != test.want {
+				t.Errorf("quoteTagValue(%q) = %q, want %q", test.value, got, test.want)
+			}
+		})
+	}
+}
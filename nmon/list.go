@@ -16,9 +16,15 @@ import (
 //ListMeasurement list all measurements in INFLUXDB database
 func ListMeasurement(c *cli.Context) error {
 	// parsing parameters
-	config := nmon2influxdblib.ParseParameters(c)
+	config, err := nmon2influxdblib.ParseParameters(c)
+	if err != nil {
+		return err
+	}
 
-	influxdb := config.ConnectDB(config.InfluxdbDatabase)
+	influxdb, err := config.ConnectDB(config.InfluxdbDatabase)
+	if err != nil {
+		return err
+	}
 	filters := new(influxdbclient.Filters)
 
 	if len(config.ListHost) > 0 {
@@ -26,7 +32,9 @@ func ListMeasurement(c *cli.Context) error {
 	}
 
 	measurements, err := influxdb.ListMeasurement(filters)
-	nmon2influxdblib.CheckError(err)
+	if err != nil {
+		return err
+	}
 	if measurements != nil {
 		fmt.Printf("%s\n", measurements.Name)
 		for _, value := range measurements.Datas {
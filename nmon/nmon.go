@@ -42,6 +42,33 @@ type Nmon struct {
 	stoptime    time.Time
 	Location    *time.Location
 	TagParsers  nmon2influxdblib.TagParsers
+	Delimiter   string
+
+	aixCPUs        string
+	linuxCPUs      string
+	userSkipRegexp *regexp.Regexp
+	ignored        map[string]bool
+	skipped        map[string]bool
+	pending        pendingLines
+	tzRules        nmon2influxdblib.TimezoneRules
+	tzSource       int
+	filePath       string
+	lastSnapshot   time.Time
+	repeated       map[string]bool
+	calculations   map[string]nmon2influxdblib.Calculations
+	lateColumns    map[string]bool
+	uargColumns    []string
+	processes      map[string]Process
+	processTags    []string
+	processRules   nmon2influxdblib.ProcessPatterns
+	inventory      *inventory
+	mapping        *nmon2influxdblib.Mapping
+	serials        []string
+	interval       time.Duration
+	// dry run report
+	skippedSections map[string]string
+	parseErrors     []string
+	errorCount      int
 }
 
 // DataSerie structure contains the columns and points to insert in InfluxDB
@@ -56,7 +83,7 @@ func (nmon *Nmon) AppendText(text string) {
 
 // NewNmon initialize a Nmon structure
 func NewNmon() *Nmon {
-	return &Nmon{DataSeries: make(map[string]DataSerie), TimeStamps: make(map[string]string)}
+	return &Nmon{DataSeries: make(map[string]DataSerie), TimeStamps: make(map[string]string), ignored: make(map[string]bool), skipped: make(map[string]bool), Delimiter: ","}
 
 }
 
@@ -93,23 +120,40 @@ func (nmon *Nmon) GetTimeStamp(label string) (timeStamp string, err error) {
 }
 
 //InitNmonTemplate init nmon structure when creating dashboard
-func InitNmonTemplate(config *nmon2influxdblib.Config) (nmon *Nmon) {
+func InitNmonTemplate(config *nmon2influxdblib.Config) (nmon *Nmon, err error) {
 	nmon = NewNmon()
 	nmon.Config = config
 	if config.Debug {
 		log.Printf("configuration: %+v\n", config.Sanitized())
 	}
 
-	nmon.SetLocation(config.Timezone)
+	err = nmon.SetLocation(config.Timezone)
 	return
 }
 
 //InitNmon init nmon structure for nmon file import
-func InitNmon(config *nmon2influxdblib.Config, nmonFile nmon2influxdblib.File) (nmon *Nmon) {
-	//Xcps  := 0
-	//Xsockets := 0
-	AIXcpus := "0"
-	Linuxcpus := "0"
+func InitNmon(config *nmon2influxdblib.Config, nmonFile nmon2influxdblib.File) (nmon *Nmon, err error) {
+	nmon, err = NewNmonImport(config)
+	if err != nil {
+		return
+	}
+	if err = nmon.SetFileLocation(nmonFile); err != nil {
+		return
+	}
+
+	scanner, err := nmonFile.GetLineScanner()
+	if err != nil {
+		return
+	}
+	defer scanner.Close()
+
+	// only file informations, headers and timestamps are needed here
+	err = nmon.Stream(scanner, nil)
+	return
+}
+
+// NewNmonImport initialize a Nmon structure for a nmon file parsing
+func NewNmonImport(config *nmon2influxdblib.Config) (nmon *Nmon, err error) {
 	nmon = NewNmon()
 	nmon.Config = config
 	nmon.CPUmode = ""
@@ -117,292 +161,428 @@ func InitNmon(config *nmon2influxdblib.Config, nmonFile nmon2influxdblib.File) (
 		log.Printf("configuration: %+v\n", config.Sanitized())
 	}
 
-	nmon.SetLocation(config.Timezone)
+	if err = nmon.SetLocation(config.Timezone); err != nil {
+		return
+	}
 	nmon.Debug = config.Debug
 
-	lines := nmonFile.Content()
-
-	var userSkipRegexp *regexp.Regexp
+	calculations, err := nmon2influxdblib.ParseCalculations(config.Calculations)
+	if err != nil {
+		return
+	}
+	nmon.calculations = calculations
+	if err = nmon.initProcessTags(config); err != nil {
+		return
+	}
+	if config.ImportInventory {
+		nmon.inventory = newInventory()
+	}
+	if config.ImportDryRun {
+		nmon.skippedSections = make(map[string]string)
+	}
 
 	if len(config.ImportSkipMetrics) > 0 {
 		skipped := strings.Replace(config.ImportSkipMetrics, ",", "|", -1)
-		userSkipRegexp = regexp.MustCompile(skipped)
+		nmon.userSkipRegexp = regexp.MustCompile(skipped)
 	}
-	badtext := fmt.Sprintf("%s%s",nmonFile.Delimiter,nmonFile.Delimiter)
-  var badRegexp = regexp.MustCompile(badtext)
-	for _, line := range lines {
+	return
+}
 
-		if cpuallRegexp.MatchString(line) && !config.ImportAllCpus {
-			continue
-		}
+// WideSchema is the import_schema value storing one point by section line with the columns as fields
+const WideSchema = "wide"
 
-		if diskallRegexp.MatchString(line) && config.ImportSkipDisks {
-			continue
-		}
+// Wide returns true if the points use the wide schema
+func (nmon *Nmon) Wide() bool {
+	return nmon.Config != nil && nmon.Config.ImportSchema == WideSchema
+}
 
-		if timeRegexp.MatchString(line) {
-			matched := timeRegexp.FindStringSubmatch(line)
-			nmon.TimeStamps[matched[1]] = matched[2]
-			continue
-		}
+// line kinds returned by parseLine
+const (
+	infoLine = iota
+	headerLine
+	timeLine
+	dataLine
+	skippedLine
+)
 
-		if hostRegexp.MatchString(line) {
-			matched := hostRegexp.FindStringSubmatch(line)
-			nmon.Hostname = strings.ToLower(matched[1])
-			continue
-		}
+// parseLine stores the file informations, section headers and timestamps found in line.
+// It returns the kind of line and a key: the section name for headers and the snapshot label for timestamps and data.
+func (nmon *Nmon) parseLine(line string) (kind int, key string) {
+	config := nmon.Config
 
-		if serialRegexp.MatchString(line) {
-			matched := serialRegexp.FindStringSubmatch(line)
-			nmon.Serial = strings.ToUpper(matched[1])
-			continue
+	if nmon.inventory != nil && strings.HasPrefix(line, "BBB") {
+		nmon.inventory.add(line, nmon.Delimiter)
+	}
+
+	if cpuallRegexp.MatchString(line) && !config.ImportAllCpus {
+		nmon.skipSection(line, "cpus")
+		return skippedLine, ""
+	}
+
+	if diskallRegexp.MatchString(line) && config.ImportSkipDisks {
+		nmon.skipSection(line, "nodisks")
+		return skippedLine, ""
+	}
+
+	if timeRegexp.MatchString(line) {
+		matched := timeRegexp.FindStringSubmatch(line)
+		nmon.TimeStamps[matched[1]] = matched[2]
+		nmon.trackSnapshot(matched[1], matched[2])
+		return timeLine, matched[1]
+	}
+
+	if statsRegexp.MatchString(line) && !configRegexp.MatchString(line) {
+		if uargRegexp.MatchString(line) {
+			nmon.addProcess(line)
+			return skippedLine, ""
 		}
+		matched := statsRegexp.FindStringSubmatch(line)
+		return dataLine, matched[1]
+	}
 
-		//if osRegexp.MatchString(line) {
-		//	matched := osRegexp.FindStringSubmatch(line)
-		//	nmon.OS = strings.ToLower(matched[1])
-		//	continue
-		//}
-
-		// VG ++
-
-		if viosverRegexp.MatchString(line) {
-                        matched := viosverRegexp.FindStringSubmatch(line)
-                        nmon.OS = "vios"
-			nmon.OStl = nmon.OSver
-                        nmon.OSver = strings.ToLower(matched[1])
-                        continue
-                }
-		if aixverRegexp.MatchString(line) {
-			matched := aixverRegexp.FindStringSubmatch(line)
-			if nmon.OS == "vios" {
-				nmon.OStl = strings.ToLower(matched[1])
-				continue
-			}
-			nmon.OS = "aix"
-			nmon.OSver = strings.ToLower(matched[1])
-			continue
+	if hostRegexp.MatchString(line) {
+		matched := hostRegexp.FindStringSubmatch(line)
+		nmon.Hostname = strings.ToLower(matched[1])
+		nmon.matchTimezoneRules()
+		// the timezone rules use the real host name
+		nmon.Hostname = nmon.pseudonym(nmon2influxdblib.HostIdentifier, nmon.Hostname)
+		return infoLine, ""
+	}
+
+	if timezoneRegexp.MatchString(line) {
+		matched := timezoneRegexp.FindStringSubmatch(line)
+		loc, err := nmon2influxdblib.LoadTimezone(strings.TrimSpace(matched[1]))
+		if err != nil {
+			log.Printf("AAA timezone ignored: %s\n", err)
+		} else {
+			nmon.useLocation(loc, tzHeader)
 		}
-		if aixtlRegexp.MatchString(line) {
-			if nmon.OS == "vios" {
-                                continue
-                        }
-                        matched := aixtlRegexp.FindStringSubmatch(line)
-                        nmon.OStl = matched[1]
-                        continue
-                }
-
-		if lparnumbernameRegexp.MatchString(line) {
-                        matched := lparnumbernameRegexp.FindStringSubmatch(line)
-                        nmon.LPARnr = matched[1]
-			nmon.LPARname = matched[2]
-                        continue
-                }
-
-		if aixmtRegexp.MatchString(line) {
-                        matched := aixmtRegexp.FindStringSubmatch(line)
-                        //nmon.MT = strings.ToLower(matched[1])
-			nmon.MT = strings.ToUpper(matched[1])
-                        continue
-                }
-		if aixcpusRegexp.MatchString(line) {
-			matched := aixcpusRegexp.FindStringSubmatch(line)
-			AIXcpus = matched[1]
-			//log.Printf("aixcpus matched. line = %s. AIXcpus = %s\n", line, AIXcpus)
-			continue
+		return infoLine, ""
+	}
+
+	if intervalRegexp.MatchString(line) {
+		matched := intervalRegexp.FindStringSubmatch(line)
+		seconds, _ := strconv.Atoi(matched[1])
+		nmon.interval = time.Duration(seconds) * time.Second
+		return infoLine, ""
+	}
+
+	if serialRegexp.MatchString(line) {
+		matched := serialRegexp.FindStringSubmatch(line)
+		nmon.Serial = nmon.pseudonym(nmon2influxdblib.SerialIdentifier, strings.ToUpper(matched[1]))
+		return infoLine, ""
+	}
+
+	//if osRegexp.MatchString(line) {
+	//	matched := osRegexp.FindStringSubmatch(line)
+	//	nmon.OS = strings.ToLower(matched[1])
+	//	continue
+	//}
+
+	// VG ++
+
+	if viosverRegexp.MatchString(line) {
+		matched := viosverRegexp.FindStringSubmatch(line)
+		nmon.OS = "vios"
+		nmon.OStl = nmon.OSver
+		nmon.OSver = strings.ToLower(matched[1])
+		return infoLine, ""
+	}
+	if aixverRegexp.MatchString(line) {
+		matched := aixverRegexp.FindStringSubmatch(line)
+		if nmon.OS == "vios" {
+			nmon.OStl = strings.ToLower(matched[1])
+			return infoLine, ""
 		}
-		if aixsmtRegexp.MatchString(line) {
-                        matched := aixsmtRegexp.FindStringSubmatch(line)
-                        nmon.SMT = matched[1]
-                        continue
+		nmon.OS = "aix"
+		nmon.OSver = strings.ToLower(matched[1])
+		return infoLine, ""
+	}
+	if aixtlRegexp.MatchString(line) {
+		if nmon.OS == "vios" {
+			return infoLine, ""
 		}
-		if aixcputypeRegexp.MatchString(line) {
-			matched := aixcputypeRegexp.FindStringSubmatch(line)
-			regex := regexp.MustCompile(`(?i)PowerPC_`)
-			str := regex.ReplaceAllString(matched[1], "")
-			nmon.CPUtype = str
-			continue
+		matched := aixtlRegexp.FindStringSubmatch(line)
+		nmon.OStl = matched[1]
+		return infoLine, ""
+	}
+
+	if lparnumbernameRegexp.MatchString(line) {
+		matched := lparnumbernameRegexp.FindStringSubmatch(line)
+		nmon.LPARnr = matched[1]
+		nmon.LPARname = matched[2]
+		if nmon.mapping != nil {
+			nmon.LPARname = nmon.pseudonym(nmon2influxdblib.HostIdentifier, strings.ToLower(matched[2]))
 		}
-		if aixcpumodeRegexp.MatchString(line) {
-			matched := aixcpumodeRegexp.FindStringSubmatch(line)
-			regex := regexp.MustCompile(`\s+`)
-			str := regex.ReplaceAllString(matched[1], "")
-			nmon.CPUmode = str
-			continue
+		return infoLine, ""
+	}
+
+	if aixmtRegexp.MatchString(line) {
+		matched := aixmtRegexp.FindStringSubmatch(line)
+		//nmon.MT = strings.ToLower(matched[1])
+		nmon.MT = strings.ToUpper(matched[1])
+		return infoLine, ""
+	}
+	if aixcpusRegexp.MatchString(line) {
+		matched := aixcpusRegexp.FindStringSubmatch(line)
+		nmon.aixCPUs = matched[1]
+		nmon.setCPUs()
+		return infoLine, ""
+	}
+	if aixsmtRegexp.MatchString(line) {
+		matched := aixsmtRegexp.FindStringSubmatch(line)
+		nmon.SMT = matched[1]
+		return infoLine, ""
+	}
+	if aixcputypeRegexp.MatchString(line) {
+		matched := aixcputypeRegexp.FindStringSubmatch(line)
+		regex := regexp.MustCompile(`(?i)PowerPC_`)
+		str := regex.ReplaceAllString(matched[1], "")
+		nmon.CPUtype = str
+		return infoLine, ""
+	}
+	if aixcpumodeRegexp.MatchString(line) {
+		matched := aixcpumodeRegexp.FindStringSubmatch(line)
+		regex := regexp.MustCompile(`\s+`)
+		str := regex.ReplaceAllString(matched[1], "")
+		nmon.CPUmode = str
+		return infoLine, ""
+	}
+	if aixfirmwareRegexp.MatchString(line) {
+		matched := aixfirmwareRegexp.FindStringSubmatch(line)
+		nmon.FW = matched[2]
+		return infoLine, ""
+	}
+
+	if linuxserialRegexp.MatchString(line) {
+		matched := linuxserialRegexp.FindStringSubmatch(line)
+		nmon.Serial = nmon.pseudonym(nmon2influxdblib.SerialIdentifier, strings.ToUpper(matched[1]))
+		return infoLine, ""
+	}
+
+	// the serial numbers of the devices listed by lscfg
+	if lscfgSerialRegexp.MatchString(line) {
+		matched := lscfgSerialRegexp.FindStringSubmatch(line)
+		serial := strings.ToUpper(matched[1])
+		nmon.serials = append(nmon.serials, serial)
+		nmon.pseudonym(nmon2influxdblib.SerialIdentifier, serial)
+		return infoLine, ""
+	}
+
+	if linuxverRegexp.MatchString(line) {
+		matched := linuxverRegexp.FindStringSubmatch(line)
+		//nmon.OSver = strings.ToLower(matched[1])
+		nmon.OSver = matched[1]
+		return infoLine, ""
+	}
+
+	if linuxkernelRegexp.MatchString(line) {
+		matched := linuxkernelRegexp.FindStringSubmatch(line)
+		nmon.OS = "linux"
+		nmon.OStl = matched[1]
+		return infoLine, ""
+	}
+
+	if linuxmtRegexp.MatchString(line) {
+		matched := linuxmtRegexp.FindStringSubmatch(line)
+		nmon.MT = strings.ToUpper(matched[1])
+		return infoLine, ""
+	}
+
+	if linuxcpusRegexp.MatchString(line) {
+		matched := linuxcpusRegexp.FindStringSubmatch(line)
+		nmon.linuxCPUs = matched[1]
+		nmon.setCPUs()
+		return infoLine, ""
+	}
+	if x86cpusRegexp.MatchString(line) {
+		matched := x86cpusRegexp.FindStringSubmatch(line)
+		nmon.linuxCPUs = matched[1]
+		nmon.setCPUs()
+		return infoLine, ""
+	}
+	if x86cpumodeRegexp.MatchString(line) {
+		matched := x86cpumodeRegexp.FindStringSubmatch(line)
+		nmon.CPUmode = matched[1]
+		return infoLine, ""
+	}
+
+	if linuxsmtRegexp.MatchString(line) {
+		matched := linuxsmtRegexp.FindStringSubmatch(line)
+		nmon.SMT = matched[1]
+		return infoLine, ""
+	}
+
+	if linuxcputypeRegexp.MatchString(line) {
+		matched := linuxcputypeRegexp.FindStringSubmatch(line)
+		nmon.CPUtype = matched[1]
+		return infoLine, ""
+	}
+
+	if linuxfirmwareRegexp.MatchString(line) {
+		matched := linuxfirmwareRegexp.FindStringSubmatch(line)
+		nmon.FW = matched[1]
+		return infoLine, ""
+	}
+	if linuxbmcfirmwareRegexp.MatchString(line) {
+		matched := linuxbmcfirmwareRegexp.FindStringSubmatch(line)
+		nmon.FW = "bmcFW" + matched[1]
+		return infoLine, ""
+	}
+	if uptimeRegexp.MatchString(line) {
+		matched := uptimeRegexp.FindStringSubmatch(line)
+		nmon.uptime = matched[1]
+		return infoLine, ""
+	}
+
+	//VG --
+
+	if infoRegexp.MatchString(line) {
+		matched := infoRegexp.FindStringSubmatch(line)
+		nmon.AppendText(matched[1])
+		return infoLine, ""
+	}
+
+	if uargRegexp.MatchString(line) {
+		nmon.uargColumns = strings.Split(line, nmon.Delimiter)
+		return infoLine, ""
+	}
+
+	if headerRegexp.MatchString(line) || len(line) == 0 {
+		return infoLine, ""
+	}
+
+	elems := strings.Split(line, nmon.Delimiter)
+	if len(elems) < 3 {
+		if config.Debug == true {
+			log.Printf("ERROR: parsing the following line : %s\n", line)
 		}
-		if aixfirmwareRegexp.MatchString(line) {
-			matched := aixfirmwareRegexp.FindStringSubmatch(line)
-			nmon.FW = matched[2]
-			continue
+		// the TOP section starts with a description line
+		if !strings.HasPrefix(line, "TOP"+nmon.Delimiter+"%CPU") {
+			nmon.parseError("invalid line: %s", line)
 		}
+		return skippedLine, ""
+	}
+	name := elems[0]
 
-		if linuxserialRegexp.MatchString(line) {
-                        matched := linuxserialRegexp.FindStringSubmatch(line)
-                        nmon.Serial = strings.ToUpper(matched[1])
-                        continue
-                }
-
-		if linuxverRegexp.MatchString(line) {
-                        matched := linuxverRegexp.FindStringSubmatch(line)
-                        //nmon.OSver = strings.ToLower(matched[1])
-                        nmon.OSver = matched[1]
-                        continue
-                }
-
-		if linuxkernelRegexp.MatchString(line) {
-                        matched := linuxkernelRegexp.FindStringSubmatch(line)
-			nmon.OS = "linux"
-                        nmon.OStl = matched[1]
-                        continue
-                }
-
-		if linuxmtRegexp.MatchString(line) {
-                        matched := linuxmtRegexp.FindStringSubmatch(line)
-                        nmon.MT = strings.ToUpper(matched[1])
-                        continue
-                }
-
-		//if linuxcpsRegexp.MatchString(line) {
-                //        matched := linuxcpsRegexp.FindStringSubmatch(line)
-		//	// try to convert string to integer
-                //        converted, parseErr := strconv.Atoi(matched[1])
-                //        if parseErr != nil {
-		//		continue
-                //        }
-		//	Xcps = converted
-                //        continue
-                //}
-
-		//if linuxsocketsRegexp.MatchString(line) {
-                //        matched := linuxsocketsRegexp.FindStringSubmatch(line)
-                //        // try to convert string to integer
-                //        converted, parseErr := strconv.Atoi(matched[1])
-                //        if parseErr != nil {
-                //                continue
-                //        }
-		//	Xsockets = converted
-                //        continue
-                //}
-		if linuxcpusRegexp.MatchString(line) {
-                        matched := linuxcpusRegexp.FindStringSubmatch(line)
-                        Linuxcpus = matched[1]
-			//log.Printf("linuxcpus matched. line = %s. Linuxcpus = %s\n", line, Linuxcpus)
-                        continue
-                }
-		if x86cpusRegexp.MatchString(line) {
-                        matched := x86cpusRegexp.FindStringSubmatch(line)
-                        Linuxcpus = matched[1]
-                        //log.Printf("linuxcpus matched. line = %s. Linuxcpus = %s\n", line, Linuxcpus)
-                        continue
-                }
-		if x86cpumodeRegexp.MatchString(line) {
-                        matched := x86cpumodeRegexp.FindStringSubmatch(line)
-                        nmon.CPUmode = matched[1]
-                        continue
-                }
-
-		if linuxsmtRegexp.MatchString(line) {
-                        matched := linuxsmtRegexp.FindStringSubmatch(line)
-                        nmon.SMT = matched[1]
-                        continue
-                }
-
-		if linuxcputypeRegexp.MatchString(line) {
-                        matched := linuxcputypeRegexp.FindStringSubmatch(line)
-                        nmon.CPUtype = matched[1]
-			//nmon.CPUmode = ""
-                        continue
-                }
-
-		if linuxfirmwareRegexp.MatchString(line) {
-                        matched := linuxfirmwareRegexp.FindStringSubmatch(line)
-                        nmon.FW = matched[1]
-                        continue
-                }
-		if linuxbmcfirmwareRegexp.MatchString(line) {
-                        matched := linuxbmcfirmwareRegexp.FindStringSubmatch(line)
-                        nmon.FW = "bmcFW" + matched[1]
-                        continue
-                }
-		if uptimeRegexp.MatchString(line) {
-			matched := uptimeRegexp.FindStringSubmatch(line)
-                        nmon.uptime = matched[1]
-                        continue
-                }
-
-		//VG --
-
-		if infoRegexp.MatchString(line) {
-			matched := infoRegexp.FindStringSubmatch(line)
-			nmon.AppendText(matched[1])
-			continue
-		}
+	if strings.Contains(line, nmon.Delimiter+nmon.Delimiter) {
+		nmon.ignored[name] = true
+		nmon.skipSection(line, "empty column name")
+		return skippedLine, name
+	}
 
-		if !headerRegexp.MatchString(line) {
-			if len(line) == 0 {
-				continue
-			}
+	if nmon.userSkipRegexp != nil && nmon.userSkipRegexp.MatchString(name) {
+		nmon.skipSection(line, "skip_metrics")
+		return skippedLine, name
+	}
 
-			if badRegexp.MatchString(line) {
-				continue
-			}
+	if config.Debug == true {
+		log.Printf("Adding serie %s\n", name)
+	}
 
-			elems := strings.Split(line, nmonFile.Delimiter)
+	// the header is written again when devices are added or removed while nmon is running
+	dataserie := nmon.DataSeries[name]
+	if nmon.Debug && dataserie.Columns != nil {
+		log.Printf("serie %s redefined with %d columns\n", name, len(elems[2:]))
+	}
+	dataserie.Columns = nmon.anonymizeColumns(name, elems[2:])
+	nmon.DataSeries[name] = dataserie
+	delete(nmon.lateColumns, name)
+	return headerLine, name
+}
 
-			if len(elems) < 3 {
-				if config.Debug == true {
-					log.Printf("ERROR: parsing the following line : %s\n", line)
-				}
-				continue
-			}
-			name := elems[0]
-			if len(config.ImportSkipMetrics) > 0 {
-				if userSkipRegexp.MatchString(name) {
-					continue
-				}
-			}
+// Columns returns the column names of the values of a data line.
+// Values of devices added since nmon start without a new header are named from a section of the same family listing them,
+// like DISKREAD for DISKBUSY, or by their position.
+func (nmon *Nmon) Columns(name string, values []string) []string {
+	columns := nmon.DataSeries[name].Columns
 
-			if config.Debug == true {
-				log.Printf("Adding serie %s\n", name)
-			}
+	// trailing empty values don't need a column
+	count := len(values)
+	for count > len(columns) && len(values[count-1]) == 0 {
+		count--
+	}
+	if count <= len(columns) {
+		return columns
+	}
 
-			dataserie := nmon.DataSeries[name]
-			dataserie.Columns = elems[2:]
-			nmon.DataSeries[name] = dataserie
+	extended := nmon.siblingColumns(name, columns, count)
+	found := extended != nil
+	if !found {
+		extended = append([]string{}, columns...)
+		for i := len(columns); i < count; i++ {
+			extended = append(extended, fmt.Sprintf("column%d", i+1))
 		}
 	}
-	//VG ++
-	//if Xcps > 0 {
-	//	nmon.CPUs = strconv.Itoa(Xcps * Xsockets)
-	//}
-	if AIXcpus == "0" {
-		nmon.CPUs = Linuxcpus
-	} else {
-		nmon.CPUs = AIXcpus
+
+	if !nmon.lateColumns[name] {
+		if nmon.lateColumns == nil {
+			nmon.lateColumns = make(map[string]bool)
+		}
+		nmon.lateColumns[name] = true
+		if found {
+			log.Printf("serie %s: %d columns added since nmon start named from the other sections\n", name, count-len(columns))
+		} else {
+			log.Printf("serie %s: %d columns added since nmon start without name, imported as column%d to column%d\n", name, count-len(columns), len(columns)+1, count)
+		}
 	}
-	if config.Debug {
-		log.Printf("InitNmon results:\n" +
-			"Hostname = %s\n" +
-			"Serial   = %s\n" +
-			"OS       = %s\n" +
-			"OSver    = %s\n" +
-			"OStl     = %s\n" +
-			"MT       = %s\n" +
-			"CPUs     = %s\n" +
-			"SMT      = %s\n" +
-			"CPUtype  = %s\n" +
-			"CPUmode  = %s\n" +
-			"FW       = %s\n" +
-			"uptime   = %s\n" +
-			"LPARnr   = %s\n" +
-			"LPARname = %s\n",
-			nmon.Hostname, nmon.Serial, nmon.OS, nmon.OSver, nmon.OStl, nmon.MT, nmon.CPUs, nmon.SMT, nmon.CPUtype, nmon.CPUmode, nmon.FW, nmon.uptime,
-			nmon.LPARnr, nmon.LPARname)
-	}
-
-
-	//VG--
-	return
+	return extended
+}
+
+// siblingColumns returns the columns of a section of the same device family whose header already lists the added devices
+func (nmon *Nmon) siblingColumns(name string, columns []string, count int) []string {
+	family := deviceSectionRegexp.FindString(name)
+	if len(family) == 0 {
+		return nil
+	}
+	suffix := nameRegexp.FindString(name)
+
+	for section, serie := range nmon.DataSeries {
+		if section == name || !strings.HasPrefix(section, family) || nameRegexp.FindString(section) != suffix || len(serie.Columns) < count {
+			continue
+		}
+		prefix := true
+		for i, column := range columns {
+			if serie.Columns[i] != column {
+				prefix = false
+				break
+			}
+		}
+		if prefix {
+			return serie.Columns[:count]
+		}
+	}
+	return nil
+}
+
+// setCPUs sets the number of cpus in the system. AIX value has precedence.
+func (nmon *Nmon) setCPUs() {
+	if len(nmon.aixCPUs) > 0 && nmon.aixCPUs != "0" {
+		nmon.CPUs = nmon.aixCPUs
+		return
+	}
+	nmon.CPUs = nmon.linuxCPUs
+}
+
+// logInfos displays the informations found in the nmon file
+func (nmon *Nmon) logInfos() {
+	log.Printf("InitNmon results:\n"+
+		"Hostname = %s\n"+
+		"Serial   = %s\n"+
+		"OS       = %s\n"+
+		"OSver    = %s\n"+
+		"OStl     = %s\n"+
+		"MT       = %s\n"+
+		"CPUs     = %s\n"+
+		"SMT      = %s\n"+
+		"CPUtype  = %s\n"+
+		"CPUmode  = %s\n"+
+		"FW       = %s\n"+
+		"uptime   = %s\n"+
+		"LPARnr   = %s\n"+
+		"LPARname = %s\n",
+		nmon.Hostname, nmon.Serial, nmon.OS, nmon.OSver, nmon.OStl, nmon.MT, nmon.CPUs, nmon.SMT, nmon.CPUtype, nmon.CPUmode, nmon.FW, nmon.uptime,
+		nmon.LPARnr, nmon.LPARname)
 }
 
 //SetTimeFrame set the current timeframe for the dashboard
@@ -412,8 +592,8 @@ func (nmon *Nmon) SetTimeFrame() {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
-	nmon.starttime, _ = nmon.ConvertTimeStamp(nmon.TimeStamps[keys[0]])
-	nmon.stoptime, _ = nmon.ConvertTimeStamp(nmon.TimeStamps[keys[len(keys)-1]])
+	nmon.starttime, _ = nmon.SnapshotTime(keys[0])
+	nmon.stoptime, _ = nmon.SnapshotTime(keys[len(keys)-1])
 }
 
 // StartTime returns the starting timestamp for dashboard
@@ -434,36 +614,137 @@ func (nmon *Nmon) StopTime() string {
 
 const timeformat = "15:04:05 02-Jan-2006"
 
-//SetLocation set the timezone used to input metrics in InfluxDB
+//SetLocation set the default timezone used to input metrics in InfluxDB. The local timezone is used if tz is empty.
 func (nmon *Nmon) SetLocation(tz string) (err error) {
-	var loc *time.Location
-	if len(tz) > 0 {
-		loc, err = time.LoadLocation(tz)
-		if err != nil {
-			loc = time.FixedZone("Europe/Paris", 2*60*60)
-		}
-	} else {
-		timezone, _ := time.Now().In(time.Local).Zone()
-		loc, err = time.LoadLocation(timezone)
-		if err != nil {
-			loc = time.FixedZone("Europe/Paris", 2*60*60)
-		}
+	loc, err := nmon2influxdblib.LoadTimezone(tz)
+	if err != nil {
+		return
+	}
+	nmon.Location = loc
+	return
+}
+
+// timezone sources, from the lowest to the highest priority
+const (
+	tzDefault = iota
+	tzHeader
+	tzRule
+	tzFile
+)
+
+// SetFileLocation sets the timezone of a nmon file from the --file_tz overrides or the timezone rules.
+// Rules using the host name are checked again when the AAA host line is read.
+func (nmon *Nmon) SetFileLocation(nmonFile nmon2influxdblib.File) error {
+	rules, err := nmon2influxdblib.ParseTimezoneRules(nmon.Config.TimezoneRules)
+	if err != nil {
+		return err
 	}
+	nmon.tzRules = rules
+	nmon.filePath = nmonFile.FullName()
 
+	loc, found, err := nmon2influxdblib.FileTimezone(nmon.Config.ImportFileTimezones, nmonFile)
+	if err != nil {
+		return err
+	}
+	if found {
+		nmon.useLocation(loc, tzFile)
+		return nil
+	}
+	nmon.matchTimezoneRules()
+	return nil
+}
+
+// matchTimezoneRules uses the first timezone rule matching the host and the file path
+func (nmon *Nmon) matchTimezoneRules() {
+	if loc, found := nmon.tzRules.Match(nmon.Hostname, nmon.filePath); found {
+		nmon.useLocation(loc, tzRule)
+	}
+}
+
+// useLocation sets the timezone unless it was already set by a source with a higher priority
+func (nmon *Nmon) useLocation(loc *time.Location, source int) {
+	if source < nmon.tzSource {
+		return
+	}
+	if nmon.Debug && loc != nmon.Location {
+		log.Printf("timezone: %s\n", loc)
+	}
 	nmon.Location = loc
+	nmon.tzSource = source
+}
+
+// trackSnapshot finds the timestamps recorded twice when the clock goes back at the end of the daylight saving time.
+// The nmon timestamps have no offset: the time going backwards means the second occurrence of the same local time.
+// The snapshots are identified by their label: the two snapshots of the repeated hour have the same time string.
+func (nmon *Nmon) trackSnapshot(label string, timeStr string) {
+	t, err := nmon.ConvertTimeStamp(timeStr)
+	if err != nil {
+		return
+	}
+	if t.Before(nmon.lastSnapshot) {
+		if _, later, ambiguous := nmon.occurrences(t); ambiguous && !later.Before(nmon.lastSnapshot) {
+			if nmon.repeated == nil {
+				nmon.repeated = make(map[string]bool)
+			}
+			nmon.repeated[label] = true
+			t = later
+		}
+	}
+	nmon.lastSnapshot = t
+}
+
+// SnapshotTime returns the time of the snapshot label. The snapshots taken after the clock went back get the second occurrence of the repeated hour.
+func (nmon *Nmon) SnapshotTime(label string) (time.Time, error) {
+	timeStr, err := nmon.GetTimeStamp(label)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return nmon.convertTimeStamp(timeStr, nmon.repeated[label])
+}
+
+// occurrences returns the two times having the local time of t when it's in the hour repeated at a daylight saving time change
+func (nmon *Nmon) occurrences(t time.Time) (earlier time.Time, later time.Time, ambiguous bool) {
+	_, before := t.Add(-6 * time.Hour).Zone()
+	_, after := t.Add(6 * time.Hour).Zone()
+	if before <= after {
+		return t, t, false
+	}
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+	earlier = wall.Add(-time.Duration(before) * time.Second).In(nmon.Location)
+	later = wall.Add(-time.Duration(after) * time.Second).In(nmon.Location)
+	ambiguous = earlier.Format(timeformat) == later.Format(timeformat)
 	return
 }
 
-//ConvertTimeStamp convert the string timestamp in time.Time structure
+//ConvertTimeStamp convert the string timestamp in time.Time structure.
+//The first occurrence is used for the hour repeated when the clock goes back: use SnapshotTime for the snapshots.
 func (nmon *Nmon) ConvertTimeStamp(s string) (time.Time, error) {
+	return nmon.convertTimeStamp(s, false)
+}
+
+// convertTimeStamp converts the string timestamp. The second occurrence of the repeated hour is used if later is true.
+func (nmon *Nmon) convertTimeStamp(s string, later bool) (time.Time, error) {
 	var err error
 	if s == "now" {
 		return time.Now().Truncate(24 * time.Hour), err
 	}
+	// malformed ZZZZ lines are reported instead of stopping the import
+	if len(s) < len(timeformat) {
+		return time.Time{}, errors.New("incomplete date and time")
+	}
 
   //replace separator
   stamp := s[0:8] + " " + s[9:]
 	t, err := time.ParseInLocation(timeformat, stamp, nmon.Location)
+	if err != nil {
+		return t, err
+	}
+	if earlier, second, ambiguous := nmon.occurrences(t); ambiguous {
+		t = earlier
+		if later {
+			t = second
+		}
+	}
 	return t, err
 }
 
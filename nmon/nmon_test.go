@@ -0,0 +1,82 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotTimeDaylightSavingTime(t *testing.T) {
+	nmon := newTestNmon(t)
+	if err := nmon.SetLocation("Europe/Paris"); err != nil {
+		t.Fatal(err)
+	}
+	// the clock goes back from 03:00 CEST to 02:00 CET on the 25th of October 2020
+	streamLines(nmon, []string{
+		"ZZZZ,T0001,01:30:00,25-OCT-2020",
+		"ZZZZ,T0002,02:00:00,25-OCT-2020",
+		"ZZZZ,T0003,02:30:00,25-OCT-2020",
+		"ZZZZ,T0004,02:00:00,25-OCT-2020",
+		"ZZZZ,T0005,02:30:00,25-OCT-2020",
+		"ZZZZ,T0006,03:00:00,25-OCT-2020",
+	})
+
+	tests := []struct {
+		label string
+		want  string
+	}{
+		{"T0001", "2020-10-24T23:30:00Z"},
+		{"T0002", "2020-10-25T00:00:00Z"},
+		{"T0003", "2020-10-25T00:30:00Z"},
+		{"T0004", "2020-10-25T01:00:00Z"},
+		{"T0005", "2020-10-25T01:30:00Z"},
+		{"T0006", "2020-10-25T02:00:00Z"},
+	}
+	// the whole file is parsed before the conversions, like for an import
+	for _, test := range tests {
+		got, err := nmon.SnapshotTime(test.label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.UTC().Format(time.RFC3339) != test.want {
+			t.Errorf("SnapshotTime(%s) = %s, want %s", test.label, got.UTC().Format(time.RFC3339), test.want)
+		}
+	}
+
+	// without a label, the first occurrence is used
+	got, err := nmon.ConvertTimeStamp("02:00:00,25-OCT-2020")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UTC().Format(time.RFC3339) != "2020-10-25T00:00:00Z" {
+		t.Errorf("ConvertTimeStamp() = %s, want the first occurrence", got.UTC().Format(time.RFC3339))
+	}
+}
+
+func TestConvertTimeStamp(t *testing.T) {
+	nmon := newTestNmon(t)
+	tests := []struct {
+		timeStr string
+		want    string
+		valid   bool
+	}{
+		{"10:20:30,01-JAN-2020", "2020-01-01T10:20:30Z", true},
+		{"10:20:30,01-Jan-2020", "2020-01-01T10:20:30Z", true},
+		{"10:20:30 01-JAN-2020", "2020-01-01T10:20:30Z", true},
+		{"10:20:30,01-JAN", "", false},
+		{"10:20:30,01-XXX-2020", "", false},
+	}
+	for _, test := range tests {
+		got, err := nmon.ConvertTimeStamp(test.timeStr)
+		if (err == nil) != test.valid {
+			t.Errorf("ConvertTimeStamp(%s) error = %v", test.timeStr, err)
+			continue
+		}
+		if test.valid && got.UTC().Format(time.RFC3339) != test.want {
+			t.Errorf("ConvertTimeStamp(%s) = %s, want %s", test.timeStr, got.UTC().Format(time.RFC3339), test.want)
+		}
+	}
+}
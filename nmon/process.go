@@ -0,0 +1,144 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+)
+
+// default UARG headers when the file has none
+var aixUargColumns = []string{"UARG", "+Time", "PID", "PPID", "COMM", "THCOUNT", "USER", "GROUP", "FullCommand"}
+var linuxUargColumns = []string{"UARG", "+Time", "PID", "ProgName", "FullCommand"}
+
+// Process contains the informations of a process found in the UARG section
+type Process struct {
+	PPID    string
+	User    string
+	Group   string
+	Threads string
+	Args    string
+}
+
+// processTagFields are the UARG informations which can be added as TOP tags with import_process_tags
+var processTagFields = map[string]func(Process) string{
+	"ppid":    func(p Process) string { return p.PPID },
+	"user":    func(p Process) string { return p.User },
+	"group":   func(p Process) string { return p.Group },
+	"threads": func(p Process) string { return p.Threads },
+	"args":    func(p Process) string { return p.Args },
+}
+
+// processTagging returns true if TOP points get tags from the UARG section
+func (nmon *Nmon) processTagging() bool {
+	return len(nmon.processTags) > 0 || len(nmon.processRules) > 0
+}
+
+// initProcessTags reads the UARG tags from the configuration
+func (nmon *Nmon) initProcessTags(config *nmon2influxdblib.Config) error {
+	for _, field := range strings.Split(config.ImportProcessTags, ",") {
+		field = strings.TrimSpace(strings.ToLower(field))
+		if len(field) == 0 {
+			continue
+		}
+		if _, ok := processTagFields[field]; !ok {
+			return fmt.Errorf("invalid import_process_tags value: %s", field)
+		}
+		nmon.processTags = append(nmon.processTags, field)
+	}
+
+	for _, pattern := range config.ProcessPatterns {
+		var err error
+		if pattern.Regexp, err = regexp.Compile(pattern.Match); err != nil {
+			return err
+		}
+		if len(pattern.Value) == 0 {
+			pattern.Value = "$1"
+		}
+		nmon.processRules = append(nmon.processRules, pattern)
+	}
+	return nil
+}
+
+// normalizePID removes the leading zeros of the Linux process ids
+func normalizePID(pid string) string {
+	if value, err := strconv.Atoi(pid); err == nil {
+		return strconv.Itoa(value)
+	}
+	return pid
+}
+
+// processColumns returns the columns of an UARG line. The AIX or Linux columns are used without UARG header.
+func (nmon *Nmon) processColumns(elems []string) []string {
+	if nmon.uargColumns != nil {
+		return nmon.uargColumns
+	}
+	if len(elems) >= len(aixUargColumns) {
+		return aixUargColumns
+	}
+	return linuxUargColumns
+}
+
+// addProcess stores the informations of an UARG line. A process id reused by a new process is replaced.
+func (nmon *Nmon) addProcess(line string) {
+	elems := strings.Split(line, nmon.Delimiter)
+	columns := nmon.processColumns(elems)
+
+	var pid string
+	var process Process
+	for i, column := range columns {
+		if i >= len(elems) {
+			break
+		}
+		switch column {
+		case "PID":
+			pid = normalizePID(elems[i])
+		case "PPID":
+			process.PPID = normalizePID(elems[i])
+		case "USER":
+			process.User = nmon.pseudonym(nmon2influxdblib.UserIdentifier, elems[i])
+		case "GROUP":
+			process.Group = nmon.pseudonym(nmon2influxdblib.GroupIdentifier, elems[i])
+		case "THCOUNT":
+			process.Threads = elems[i]
+		case "FullCommand":
+			// the command line can contain the delimiter
+			process.Args = strings.TrimSpace(strings.Join(elems[i:], nmon.Delimiter))
+		}
+	}
+	if len(pid) == 0 {
+		return
+	}
+	if nmon.processes == nil {
+		nmon.processes = make(map[string]Process)
+	}
+	nmon.processes[pid] = process
+}
+
+// addProcessTags adds the UARG informations of the process to the TOP tags
+func (nmon *Nmon) addProcessTags(tags map[string]string, pid string) {
+	process, ok := nmon.processes[normalizePID(pid)]
+	if !ok {
+		return
+	}
+	for _, field := range nmon.processTags {
+		if value := processTagFields[field](process); len(value) > 0 {
+			tags[field] = value
+		}
+	}
+	for _, pattern := range nmon.processRules {
+		matched := pattern.Regexp.FindStringSubmatchIndex(process.Args)
+		if matched == nil {
+			continue
+		}
+		if value := pattern.Regexp.ExpandString(nil, pattern.Value, process.Args, matched); len(value) > 0 {
+			tags[pattern.Tag] = string(value)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+)
+
+func TestAddProcess(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		pid   string
+		want  Process
+	}{
+		{
+			name: "aix with header",
+			lines: []string{
+				"UARG,+Time,PID,PPID,COMM,THCOUNT,USER,GROUP,FullCommand",
+				"UARG,T0001,4325,1,java,12,wasadm,staff,java -Xmx1g -jar app.jar",
+			},
+			pid:  "4325",
+			want: Process{PPID: "1", User: "wasadm", Group: "staff", Threads: "12", Args: "java -Xmx1g -jar app.jar"},
+		},
+		{
+			name:  "aix without header",
+			lines: []string{"UARG,T0001,4325,1,java,12,wasadm,staff,java -Dlist=a,b -jar app.jar"},
+			pid:   "4325",
+			want:  Process{PPID: "1", User: "wasadm", Group: "staff", Threads: "12", Args: "java -Dlist=a,b -jar app.jar"},
+		},
+		{
+			name: "linux with header",
+			lines: []string{
+				"UARG,+Time,PID,ProgName,FullCommand",
+				"UARG,T0001,0004325,java,java -jar app.jar",
+			},
+			pid:  "4325",
+			want: Process{Args: "java -jar app.jar"},
+		},
+		{
+			name:  "linux without header",
+			lines: []string{"UARG,T0001,0004325,java,java -jar app.jar"},
+			pid:   "4325",
+			want:  Process{Args: "java -jar app.jar"},
+		},
+		{
+			name: "reused pid",
+			lines: []string{
+				"UARG,T0001,0004325,java,java -jar app.jar",
+				"UARG,T0002,0004325,python,python batch.py",
+			},
+			pid:  "4325",
+			want: Process{Args: "python batch.py"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nmon := newTestNmon(t)
+			streamLines(nmon, test.lines)
+			if got := nmon.processes[test.pid]; !reflect.DeepEqual(got, test.want) {
+				t.Errorf("process %s = %+v, want %+v", test.pid, got, test.want)
+			}
+		})
+	}
+}
+
+func TestAddProcessTags(t *testing.T) {
+	config := nmon2influxdblib.InitConfig()
+	config.ImportProcessTags = "user, args"
+	config.ProcessPatterns = nmon2influxdblib.ProcessPatterns{
+		{Tag: "app", Match: `-jar (\w+)\.jar`},
+		{Tag: "heap", Match: `-Xmx(\d+)([mg])`, Value: "${1}${2}b"},
+		{Tag: "python", Match: `^python`},
+	}
+	nmon, err := NewNmonImport(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamLines(nmon, []string{"UARG,T0001,4325,1,java,12,wasadm,staff,java -Xmx1g -jar app.jar"})
+
+	tests := []struct {
+		name string
+		pid  string
+		want map[string]string
+	}{
+		{"known process", "04325", map[string]string{"pid": "04325", "user": "wasadm", "args": "java -Xmx1g -jar app.jar", "app": "app", "heap": "1gb"}},
+		{"unknown process", "1234", map[string]string{"pid": "1234"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tags := map[string]string{"pid": test.pid}
+			nmon.addProcessTags(tags, test.pid)
+			if !reflect.DeepEqual(tags, test.want) {
+				t.Errorf("tags = %v, want %v", tags, test.want)
+			}
+		})
+	}
+
+	config.ImportProcessTags = "ppid,cwd"
+	if _, err := NewNmonImport(&config); err == nil {
+		t.Errorf("invalid import_process_tags accepted")
+	}
+}
+
+// topRecorder keeps the tags of the TOP points by process id and time
+type topRecorder map[string]map[string]string
+
+func (recorder topRecorder) AddPoint(measurement string, timestamp time.Time, fields map[string]interface{}, tags map[string]string) {
+	// the TOP lines are also added as statistics, without process id
+	if measurement == "TOP" && len(tags["pid"]) > 0 {
+		recorder[tags["pid"]+" "+timestamp.Format("15:04:05")] = tags
+	}
+}
+
+func (recorder topRecorder) WritePoints() error { return nil }
+
+func (recorder topRecorder) PointsCount() int64 { return 0 }
+
+func (recorder topRecorder) ClearPoints() {}
+
+func TestImportTopProcessTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "process")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// nmon writes the UARG lines of a snapshot after its TOP lines. The process 4325 is replaced in the second snapshot.
+	path := filepath.Join(dir, "lpar1.nmon")
+	content := strings.Join([]string{
+		"AAA,host,lpar1",
+		"TOP,%CPU Utilisation",
+		"TOP,+PID,Time,%CPU,%Usr,%Sys,Threads,Size,ResText,ResData,CharIO,%RAM,Paging,Command,WLMclass",
+		"UARG,+Time,PID,ProgName,FullCommand",
+		"ZZZZ,T0001,00:00:01,01-JAN-2020",
+		"TOP,0004325,T0001,1.0,0.5,0.5,1,100,10,10,0,0.1,0,java,Unclassified",
+		"UARG,T0001,0004325,java,java -jar app.jar",
+		"ZZZZ,T0002,00:00:02,01-JAN-2020",
+		"TOP,0004325,T0002,2.0,1.0,1.0,1,100,10,10,0,0.1,0,python,Unclassified",
+		"UARG,T0002,0004325,python,python batch.py",
+		"",
+	}, "\n")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := nmon2influxdblib.InitConfig()
+	config.Timezone = "UTC"
+	config.ImportSkipMetrics = ""
+	config.ImportProcessTags = "args"
+	recorder := make(topRecorder)
+	summary := ImportFile(&config, nmon2influxdblib.File{Name: path}, recorder, nil, nil, nil, nil)
+	if summary.Error != nil {
+		t.Fatal(summary.Error)
+	}
+
+	want := map[string]string{
+		"0004325 00:00:01": "java -jar app.jar",
+		"0004325 00:00:02": "python batch.py",
+	}
+	if len(recorder) != len(want) {
+		t.Errorf("TOP points of %d processes, want %d", len(recorder), len(want))
+	}
+	for key, args := range want {
+		if got := recorder[key]["args"]; got != args {
+			t.Errorf("args of %s = %q, want %q", key, got, args)
+		}
+	}
+}
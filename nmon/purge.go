@@ -0,0 +1,131 @@
+// nmon2influxdb
+// import nmon report in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+	"github.com/urfave/cli/v2"
+)
+
+// Purge is the entry point for the purge command. It deletes the points of a host and clears the import journal of the purged files.
+func Purge(c *cli.Context) error {
+	config, err := nmon2influxdblib.ParseParameters(c)
+	if err != nil {
+		return err
+	}
+	host := c.String("host")
+	if len(host) == 0 {
+		return cli.Exit("the host to purge is required", 1)
+	}
+	if config.InfluxdbVersion >= 3 {
+		return cli.Exit("points can't be deleted with InfluxDB 3.x", 1)
+	}
+
+	from, err := purgeLimit(c, "from")
+	if err != nil {
+		return err
+	}
+	to, err := purgeLimit(c, "to")
+	if err != nil {
+		return err
+	}
+
+	// the HMC points are identified by the partition name
+	database, tags := config.InfluxdbDatabase, map[string]string{"host": host}
+	if c.Bool("hmc") {
+		database, tags = config.HMCDatabase, map[string]string{"partition": host}
+	}
+	db, err := config.ConnectDB(database)
+	if err != nil {
+		return err
+	}
+	if err := db.Delete(c.String("measurement"), tags, from, to); err != nil {
+		return &nmon2influxdblib.DBError{Database: database, Err: err}
+	}
+	log.Printf("points of %s deleted from %s\n", host, database)
+
+	// the next import reads the files of the host again
+	if c.Bool("hmc") {
+		return nil
+	}
+	importLog, store, err := openImportLog(config)
+	if err != nil {
+		return err
+	}
+	if store != nil {
+		defer store.Close()
+	}
+	cleared, err := importLog.Clear(host, purgeMatch(config, from, to, c.String("measurement")))
+	if err != nil {
+		return fmt.Errorf("unable to clear the import journal of %s: %w", host, err)
+	}
+	log.Printf("import journal of %d files of %s cleared\n", cleared, host)
+	return nil
+}
+
+// purgeMatch selects the journal entries of the imports which wrote points in the purged time frame and measurement.
+// The older entries without time frame or sections are always selected.
+func purgeMatch(config *nmon2influxdblib.Config, from time.Time, to time.Time, measurement string) func(entry nmon2influxdblib.JournalEntry) bool {
+	// the journal records the sections without their number, like the measurements
+	section := nameRegexp.ReplaceAllString(strings.TrimPrefix(measurement, config.ImportRawPrefix), "")
+	return func(entry nmon2influxdblib.JournalEntry) bool {
+		if !entry.Start.IsZero() {
+			if (!to.IsZero() && entry.Start.After(to)) || (!from.IsZero() && entry.End.Before(from)) {
+				return false
+			}
+		}
+		if len(measurement) == 0 || len(entry.Sections) == 0 || strings.HasPrefix(measurement, "INVENTORY_") {
+			return true
+		}
+		for _, name := range strings.Split(entry.Sections, ",") {
+			if name == section {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// purgeLimit returns the date of the from or to flag. No date is not a limit.
+func purgeLimit(c *cli.Context, flag string) (time.Time, error) {
+	if len(c.String(flag)) == 0 {
+		return time.Time{}, nil
+	}
+	date, ok := parseDate(c.String(flag))
+	if !ok {
+		return date, cli.Exit(fmt.Sprintf("invalid %s date %s: use a date like 2006-01-02 or 2006-01-02 15:04:05", flag, c.String(flag)), 1)
+	}
+	return date, nil
+}
+
+// purgeFile deletes the points of the nmon host during the time frame of the file before it's imported again.
+// The time frame is read with a dry run of the file.
+func purgeFile(config *nmon2influxdblib.Config, nmonFile nmon2influxdblib.File, db nmon2influxdblib.DB, tagParsers nmon2influxdblib.TagParsers, mapping *nmon2influxdblib.Mapping) error {
+	if nmonFile.Reader != nil {
+		return fmt.Errorf("streamed data can't be replaced")
+	}
+	dryRunConfig := *config
+	dryRunConfig.ImportDryRun = true
+	summary := ImportFile(&dryRunConfig, nmonFile, nil, nil, nil, tagParsers, mapping)
+	if summary.Error != nil {
+		return summary.Error
+	}
+	report := summary.Report
+	if len(report.Host) == 0 || report.Snapshots == 0 {
+		return nil
+	}
+	if err := db.Delete("", map[string]string{"host": report.Host}, report.Start, report.End); err != nil {
+		return &nmon2influxdblib.DBError{Database: config.InfluxdbDatabase, Err: err}
+	}
+	if config.Debug {
+		log.Printf("points of %s deleted from %s to %s\n", report.Host, report.Start, report.End)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+)
+
+func TestPurgeMatch(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+	entry := nmon2influxdblib.JournalEntry{Start: day(2), End: day(3), Sections: "CPU,CPU_ALL,DISKBUSY,MEM"}
+	legacy := nmon2influxdblib.JournalEntry{}
+
+	tests := []struct {
+		name        string
+		from        time.Time
+		to          time.Time
+		measurement string
+		entry       nmon2influxdblib.JournalEntry
+		want        bool
+	}{
+		{"no limit", time.Time{}, time.Time{}, "", entry, true},
+		{"overlap", day(1), day(2), "", entry, true},
+		{"inside", day(2).Add(time.Hour), day(2).Add(2 * time.Hour), "", entry, true},
+		{"before", time.Time{}, day(1), "", entry, false},
+		{"after", day(4), time.Time{}, "", entry, false},
+		{"measurement", time.Time{}, time.Time{}, "MEM", entry, true},
+		{"numbered measurement", time.Time{}, time.Time{}, "CPU01", entry, true},
+		{"raw measurement", time.Time{}, time.Time{}, "raw_DISKBUSY", entry, true},
+		{"other measurement", time.Time{}, time.Time{}, "NET", entry, false},
+		{"inventory", time.Time{}, time.Time{}, "INVENTORY_DISK", entry, true},
+		{"legacy entry", day(4), day(5), "NET", legacy, true},
+	}
+
+	config := nmon2influxdblib.InitConfig()
+	config.ImportRawPrefix = "raw_"
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := purgeMatch(&config, test.from, test.to, test.measurement)(test.entry); got != test.want {
+				t.Errorf("purgeMatch() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+)
+
+// maxParseErrors is the number of parse error messages kept for the dry run report
+const maxParseErrors = 20
+
+// report formats
+const (
+	textReport = "text"
+	jsonReport = "json"
+)
+
+// ImportReport describes what a dry run import found in a nmon file and would have written
+type ImportReport struct {
+	File            string              `json:"file"`
+	Host            string              `json:"host"`
+	OS              string              `json:"os"`
+	OSVersion       string              `json:"os_version"`
+	OSRelease       string              `json:"os_release"`
+	MachineType     string              `json:"machine_type"`
+	Serial          string              `json:"serial"`
+	Timezone        string              `json:"timezone"`
+	Start           time.Time           `json:"start"`
+	End             time.Time           `json:"end"`
+	Snapshots       int                 `json:"snapshots"`
+	Interval        int                 `json:"interval"`
+	Resample        string              `json:"resample,omitempty"`
+	Unchanged       bool                `json:"unchanged"`
+	AlreadyImported int                 `json:"already_imported_lines"`
+	Sections        []string            `json:"sections"`
+	Skipped         map[string]string   `json:"skipped_sections"`
+	Points          int64               `json:"points"`
+	Series          int                 `json:"series"`
+	Measurements    []MeasurementReport `json:"measurements"`
+	ErrorCount      int                 `json:"error_count"`
+	Errors          []string            `json:"errors"`
+}
+
+// MeasurementReport contains the number of points and series of a measurement
+type MeasurementReport struct {
+	Name   string `json:"name"`
+	Points int64  `json:"points"`
+	Series int    `json:"series"`
+}
+
+// parseError records an error found while reading the nmon file
+func (nmon *Nmon) parseError(format string, args ...interface{}) {
+	nmon.errorCount++
+	if len(nmon.parseErrors) < maxParseErrors {
+		nmon.parseErrors = append(nmon.parseErrors, fmt.Sprintf(format, args...))
+	}
+}
+
+// skipSection records the section of a line not imported and the reason. Numbered sections like CPU01 are recorded once.
+// It's only done for dry runs.
+func (nmon *Nmon) skipSection(line string, reason string) {
+	if nmon.skippedSections == nil {
+		return
+	}
+	name := nameRegexp.ReplaceAllString(strings.SplitN(line, nmon.Delimiter, 2)[0], "")
+	if _, ok := nmon.skippedSections[name]; !ok {
+		nmon.skippedSections[name] = reason
+	}
+}
+
+// fillReport sets the informations found in the nmon file and the points counted by the dry run writer
+func (nmon *Nmon) fillReport(report *ImportReport, writer *nmon2influxdblib.DryRunWriter) {
+	report.Host = nmon.Hostname
+	report.OS = nmon.OS
+	report.OSVersion = nmon.OSver
+	report.OSRelease = nmon.OStl
+	report.MachineType = nmon.MT
+	report.Serial = nmon.Serial
+	report.Timezone = nmon.Location.String()
+	report.Snapshots = len(nmon.TimeStamps)
+	report.Interval = int(nmon.interval.Seconds())
+	if report.Snapshots > 0 {
+		nmon.SetTimeFrame()
+		report.Start = nmon.starttime
+		report.End = nmon.stoptime
+	}
+
+	for name := range nmon.DataSeries {
+		report.Sections = append(report.Sections, name)
+	}
+	sort.Strings(report.Sections)
+	report.Skipped = nmon.skippedSections
+
+	for name, stats := range writer.Measurements {
+		report.Measurements = append(report.Measurements, MeasurementReport{Name: name, Points: stats.Points, Series: stats.Series()})
+		report.Points += stats.Points
+		report.Series += stats.Series()
+	}
+	sort.Slice(report.Measurements, func(i, j int) bool { return report.Measurements[i].Name < report.Measurements[j].Name })
+
+	report.ErrorCount = nmon.errorCount
+	report.Errors = nmon.parseErrors
+}
+
+// String returns the report as text
+func (report *ImportReport) String() string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "File %s\n", report.File)
+	if report.Unchanged {
+		fmt.Fprintf(&text, "  file not changed since last import\n")
+		return text.String()
+	}
+
+	system := report.OS
+	if len(system) == 0 {
+		system = "not detected"
+	}
+	fmt.Fprintf(&text, "  host:       %s\n", report.Host)
+	fmt.Fprintf(&text, "  os:         %s %s %s\n", system, report.OSVersion, report.OSRelease)
+	if len(report.MachineType) > 0 || len(report.Serial) > 0 {
+		fmt.Fprintf(&text, "  machine:    %s serial %s\n", report.MachineType, report.Serial)
+	}
+	fmt.Fprintf(&text, "  time range: %s - %s (%d snapshots, timezone %s)\n",
+		report.Start.Format(time.RFC3339), report.End.Format(time.RFC3339), report.Snapshots, report.Timezone)
+	if report.Interval > 0 {
+		fmt.Fprintf(&text, "  interval:   %ds\n", report.Interval)
+	}
+	if len(report.Resample) > 0 {
+		fmt.Fprintf(&text, "  resampled:  %s\n", report.Resample)
+	}
+	if report.AlreadyImported > 0 {
+		fmt.Fprintf(&text, "  already imported: %d lines\n", report.AlreadyImported)
+	}
+	fmt.Fprintf(&text, "  sections:   %s\n", strings.Join(report.Sections, " "))
+
+	skipped := make([]string, 0, len(report.Skipped))
+	for name, reason := range report.Skipped {
+		skipped = append(skipped, fmt.Sprintf("%s (%s)", name, reason))
+	}
+	sort.Strings(skipped)
+	if len(skipped) > 0 {
+		fmt.Fprintf(&text, "  skipped:    %s\n", strings.Join(skipped, " "))
+	}
+
+	fmt.Fprintf(&text, "  points:     %d in %d series\n", report.Points, report.Series)
+	for _, measurement := range report.Measurements {
+		fmt.Fprintf(&text, "    %-24s %10d points %6d series\n", measurement.Name, measurement.Points, measurement.Series)
+	}
+
+	if report.ErrorCount > 0 {
+		fmt.Fprintf(&text, "  parse errors: %d\n", report.ErrorCount)
+		for _, message := range report.Errors {
+			fmt.Fprintf(&text, "    %s\n", message)
+		}
+	}
+	return text.String()
+}
+
+// printJSONReports displays the dry run reports as a JSON array
+func printJSONReports(reports []*ImportReport) error {
+	output, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(output))
+	return nil
+}
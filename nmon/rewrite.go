@@ -0,0 +1,458 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+	"github.com/urfave/cli/v2"
+)
+
+// split time windows
+const (
+	splitByDay  = "day"
+	splitByHour = "hour"
+)
+
+// snapshot is a ZZZZ line of a nmon file
+type snapshot struct {
+	label string
+	time  time.Time
+}
+
+// snapshots returns the snapshots of the parsed nmon file ordered by their number
+func (nmon *Nmon) snapshots() ([]snapshot, error) {
+	snapshots := make([]snapshot, 0, len(nmon.TimeStamps))
+	for label := range nmon.TimeStamps {
+		// the snapshots of the hour repeated at the end of the daylight saving time keep their own time
+		t, err := nmon.SnapshotTime(label)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot %s: %s", label, err)
+		}
+		snapshots = append(snapshots, snapshot{label: label, time: t})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return labelNumber(snapshots[i].label) < labelNumber(snapshots[j].label)
+	})
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("no snapshot found")
+	}
+	return snapshots, nil
+}
+
+// labelNumber returns the number of a snapshot label like T0012
+func labelNumber(label string) int {
+	number, _ := strconv.Atoi(strings.TrimPrefix(label, "T"))
+	return number
+}
+
+// nmonFileName returns the usual nmon file name of a capture starting at start
+func nmonFileName(host string, start time.Time) string {
+	if len(host) == 0 {
+		host = "nmon"
+	}
+	return fmt.Sprintf("%s_%s.nmon", host, start.Format("060102_1504"))
+}
+
+// headerLines are the AAA, BBB and section header lines of a nmon file. A redefined section header replaces the previous one.
+type headerLines struct {
+	lines    []string
+	sections []string
+	index    map[string]int
+}
+
+// add appends a header line. section is empty for the AAA and BBB lines.
+func (headers *headerLines) add(line string, section string) {
+	if len(section) > 0 {
+		if i, ok := headers.index[section]; ok {
+			headers.lines[i] = line
+			return
+		}
+		if headers.index == nil {
+			headers.index = make(map[string]int)
+		}
+		headers.index[section] = len(headers.lines)
+	}
+	headers.lines = append(headers.lines, line)
+	headers.sections = append(headers.sections, section)
+}
+
+// nmonOutput is a nmon file written with renumbered snapshots. It's created when its first line is written.
+type nmonOutput struct {
+	path      string
+	start     time.Time
+	snapshots int
+	delimiter string
+	file      *os.File
+	writer    *bufio.Writer
+	headers   map[string]string
+}
+
+// target is the output and the new label of a snapshot
+type target struct {
+	output *nmonOutput
+	label  string
+}
+
+// sync creates the output with the header lines, or writes the section headers changed since the last snapshot
+func (output *nmonOutput) sync(headers *headerLines) error {
+	if output.file == nil {
+		file, err := os.OpenFile(output.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return &nmon2influxdblib.FileError{File: output.path, Err: err}
+		}
+		output.file = file
+		output.writer = bufio.NewWriter(file)
+		output.headers = make(map[string]string)
+		for i, line := range headers.lines {
+			if err := output.writeHeader(output.infoLine(line), headers.sections[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i, line := range headers.lines {
+		if len(headers.sections[i]) > 0 {
+			if err := output.writeHeader(line, headers.sections[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// infoLine returns the AAA line with the date, time and number of snapshots of the output
+func (output *nmonOutput) infoLine(line string) string {
+	elems := strings.Split(line, output.delimiter)
+	if len(elems) < 3 || elems[0] != "AAA" {
+		return line
+	}
+	switch elems[1] {
+	case "date":
+		elems[2] = strings.ToUpper(output.start.Format("02-Jan-2006"))
+	case "time":
+		// Linux nmon writes the seconds after a dot
+		format := "15:04:05"
+		if strings.Contains(elems[2], ".") {
+			format = "15:04.05"
+		}
+		elems[2] = output.start.Format(format)
+	case "snapshots":
+		elems[2] = strconv.Itoa(output.snapshots)
+	default:
+		return line
+	}
+	return strings.Join(elems, output.delimiter)
+}
+
+// writeHeader writes a header line. A section header is only written if it's not the current one.
+func (output *nmonOutput) writeHeader(line string, section string) error {
+	if len(section) > 0 {
+		if output.headers[section] == line {
+			return nil
+		}
+		output.headers[section] = line
+	}
+	return output.writeLine(line)
+}
+
+// writeLine writes a line in the output
+func (output *nmonOutput) writeLine(line string) error {
+	if _, err := output.writer.WriteString(line + "\n"); err != nil {
+		return &nmon2influxdblib.FileError{File: output.path, Err: err}
+	}
+	return nil
+}
+
+// Close writes the buffered lines and closes the output
+func (output *nmonOutput) Close() error {
+	if output.file == nil {
+		return nil
+	}
+	err := output.writer.Flush()
+	if closeErr := output.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return &nmon2influxdblib.FileError{File: output.path, Err: err}
+	}
+	return nil
+}
+
+// closeOutputs closes the outputs and returns the first error
+func closeOutputs(outputs []*nmonOutput) (err error) {
+	for _, output := range outputs {
+		if closeErr := output.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return
+}
+
+// relabel replaces the snapshot label found at the submatch location loc
+func relabel(line string, loc []int, label string) string {
+	return line[:loc[2]] + label + line[loc[3]:]
+}
+
+// rewriteFile copies the lines of the nmon file to the outputs of their snapshots with the new labels.
+// The header lines read before a snapshot are written in its output if they are not there yet.
+// It returns the number of data lines dropped because their snapshot has no target.
+func rewriteFile(nmonFile nmon2influxdblib.File, targets map[string]target) (dropped int, err error) {
+	scanner, err := nmonFile.GetLineScanner()
+	if err != nil {
+		return
+	}
+	defer scanner.Close()
+
+	var headers headerLines
+	var current *nmonOutput
+	started := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if loc := timeRegexp.FindStringSubmatchIndex(line); loc != nil {
+			started = true
+			snapshotTarget, ok := targets[line[loc[2]:loc[3]]]
+			current = snapshotTarget.output
+			if !ok {
+				continue
+			}
+			current.delimiter = scanner.Delimiter
+			if err = current.sync(&headers); err != nil {
+				return
+			}
+			if err = current.writeLine(relabel(line, loc, snapshotTarget.label)); err != nil {
+				return
+			}
+			continue
+		}
+
+		if statsRegexp.MatchString(line) && !configRegexp.MatchString(line) {
+			loc := statsRegexp.FindStringSubmatchIndex(line)
+			lineTarget, ok := targets[line[loc[2]:loc[3]]]
+			if !ok {
+				dropped++
+				continue
+			}
+			// the data lines written before their ZZZZ line
+			if lineTarget.output != current {
+				lineTarget.output.delimiter = scanner.Delimiter
+				if err = lineTarget.output.sync(&headers); err != nil {
+					return
+				}
+			}
+			if err = lineTarget.output.writeLine(relabel(line, loc, lineTarget.label)); err != nil {
+				return
+			}
+			continue
+		}
+
+		// the AAA and BBB lines found after the first snapshot are only kept in the current output
+		section := ""
+		if elems := strings.SplitN(line, scanner.Delimiter, 3); len(elems) == 3 && !configRegexp.MatchString(line) {
+			section = elems[0]
+		}
+		if !started || len(section) > 0 {
+			headers.add(line, section)
+		}
+		if started && current != nil {
+			if err = current.writeHeader(line, section); err != nil {
+				return
+			}
+		}
+	}
+	if scanErr := scanner.Err(); scanErr != nil {
+		err = &nmon2influxdblib.FileError{File: nmonFile.FullName(), Err: scanErr}
+	}
+	return
+}
+
+// windowStart returns the start of the day or the hour of t
+func windowStart(t time.Time, by string) time.Time {
+	if by == splitByHour {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// splitFile writes a nmon file for each day or hour of the nmon file in dir.
+// It returns the outputs and the number of data lines dropped because their snapshot was not found.
+func splitFile(config *nmon2influxdblib.Config, nmonFile nmon2influxdblib.File, by string, dir string) ([]*nmonOutput, int, error) {
+	nmon, err := InitNmon(config, nmonFile)
+	if err != nil {
+		return nil, 0, err
+	}
+	snapshots, err := nmon.snapshots()
+	if err != nil {
+		return nil, 0, &nmon2influxdblib.FileError{File: nmonFile.FullName(), Err: err}
+	}
+
+	var outputs []*nmonOutput
+	windows := make(map[time.Time]*nmonOutput)
+	targets := make(map[string]target)
+	for _, snapshot := range snapshots {
+		window := windowStart(snapshot.time, by)
+		output, ok := windows[window]
+		if !ok {
+			output = &nmonOutput{path: filepath.Join(dir, nmonFileName(nmon.Hostname, snapshot.time)), start: snapshot.time}
+			windows[window] = output
+			outputs = append(outputs, output)
+		}
+		output.snapshots++
+		targets[snapshot.label] = target{output: output, label: fmt.Sprintf("T%04d", output.snapshots)}
+	}
+
+	dropped, err := rewriteFile(nmonFile, targets)
+	if closeErr := closeOutputs(outputs); err == nil {
+		err = closeErr
+	}
+	return outputs, dropped, err
+}
+
+// Split is the entry point for the split command. Each nmon file is split in a file by day or by hour.
+func Split(c *cli.Context) error {
+	config, err := nmon2influxdblib.ParseParameters(c)
+	if err != nil {
+		return err
+	}
+	by := c.String("by")
+	if by != splitByDay && by != splitByHour {
+		return cli.Exit(fmt.Sprintf("split by %s or %s", splitByDay, splitByHour), 1)
+	}
+	dir := c.String("dir")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return &nmon2influxdblib.FileError{File: dir, Err: err}
+	}
+
+	failed := 0
+	nmonFiles := new(nmon2influxdblib.Files)
+	for _, paramErr := range nmonFiles.Parse(c.Args().Slice(), config.ImportSSHUser, config.ImportSSHKey) {
+		fmt.Printf("%s ! skipped.\n", paramErr)
+		failed++
+	}
+	for _, nmonFile := range nmonFiles.Valid() {
+		outputs, dropped, err := splitFile(config, nmonFile, by, dir)
+		if err != nil {
+			fmt.Printf("%s ! skipped.\n", err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s split in %d files:\n", nmonFile.FullName(), len(outputs))
+		for _, output := range outputs {
+			fmt.Printf("  %s: %d snapshots\n", output.path, output.snapshots)
+		}
+		if dropped > 0 {
+			fmt.Printf("  %d data lines without snapshot dropped\n", dropped)
+		}
+	}
+	if failed > 0 {
+		return cli.Exit(fmt.Sprintf("%d files not split", failed), 1)
+	}
+	return nil
+}
+
+// mergeSource is a nmon file merged with the others
+type mergeSource struct {
+	file      nmon2influxdblib.File
+	snapshots []snapshot
+}
+
+// Merge is the entry point for the merge command. The nmon files of a host are merged in the order of their snapshots.
+// The snapshots found in several files are written once.
+func Merge(c *cli.Context) error {
+	config, err := nmon2influxdblib.ParseParameters(c)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	nmonFiles := new(nmon2influxdblib.Files)
+	for _, paramErr := range nmonFiles.Parse(c.Args().Slice(), config.ImportSSHUser, config.ImportSSHKey) {
+		fmt.Printf("%s ! skipped.\n", paramErr)
+		failed++
+	}
+
+	host := ""
+	var sources []mergeSource
+	for _, nmonFile := range nmonFiles.Valid() {
+		nmon, err := InitNmon(config, nmonFile)
+		if err != nil {
+			fmt.Printf("%s ! skipped.\n", err)
+			failed++
+			continue
+		}
+		snapshots, err := nmon.snapshots()
+		if err != nil {
+			fmt.Printf("%s ! skipped.\n", &nmon2influxdblib.FileError{File: nmonFile.FullName(), Err: err})
+			failed++
+			continue
+		}
+		if len(sources) > 0 && nmon.Hostname != host {
+			return cli.Exit(fmt.Sprintf("%s: host %s instead of %s. Only the files of a host can be merged", nmonFile.FullName(), nmon.Hostname, host), 1)
+		}
+		host = nmon.Hostname
+		sources = append(sources, mergeSource{file: nmonFile, snapshots: snapshots})
+	}
+	if len(sources) == 0 {
+		return cli.Exit("no nmon file to merge", 1)
+	}
+	sort.SliceStable(sources, func(i, j int) bool { return sources[i].snapshots[0].time.Before(sources[j].snapshots[0].time) })
+
+	path := c.String("output")
+	if len(path) == 0 {
+		path = nmonFileName(host, sources[0].snapshots[0].time)
+	}
+	output := &nmonOutput{path: path, start: sources[0].snapshots[0].time}
+
+	// the snapshot numbers continue from a file to the next one
+	targets := make([]map[string]target, len(sources))
+	var last time.Time
+	overlapping := 0
+	for i, source := range sources {
+		targets[i] = make(map[string]target)
+		for _, snapshot := range source.snapshots {
+			if output.snapshots > 0 && !snapshot.time.After(last) {
+				overlapping++
+				continue
+			}
+			output.snapshots++
+			targets[i][snapshot.label] = target{output: output, label: fmt.Sprintf("T%04d", output.snapshots)}
+			last = snapshot.time
+		}
+	}
+
+	dropped := 0
+	for i, source := range sources {
+		var fileDropped int
+		fileDropped, err = rewriteFile(source.file, targets[i])
+		dropped += fileDropped
+		if err != nil {
+			break
+		}
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d files merged in %s: %d snapshots\n", len(sources), output.path, output.snapshots)
+	if overlapping > 0 {
+		fmt.Printf("%d snapshots found in several files or out of order skipped\n", overlapping)
+	}
+	if dropped > 0 {
+		fmt.Printf("%d data lines of the skipped snapshots or without snapshot dropped\n", dropped)
+	}
+	if failed > 0 {
+		return cli.Exit(fmt.Sprintf("%d files not merged", failed), 1)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+)
+
+func TestSnapshotsDaylightSavingTime(t *testing.T) {
+	nmon := newTestNmon(t)
+	if err := nmon.SetLocation("Europe/Paris"); err != nil {
+		t.Fatal(err)
+	}
+	streamLines(nmon, []string{
+		"ZZZZ,T0001,02:00:00,25-OCT-2020",
+		"ZZZZ,T0002,02:30:00,25-OCT-2020",
+		"ZZZZ,T0003,02:00:00,25-OCT-2020",
+		"ZZZZ,T0004,02:30:00,25-OCT-2020",
+	})
+	snapshots, err := nmon.snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the repeated hour follows the first one
+	for i := 1; i < len(snapshots); i++ {
+		if got := snapshots[i].time.Sub(snapshots[i-1].time); got != 30*time.Minute {
+			t.Errorf("%s is %s after %s, want 30m", snapshots[i].label, got, snapshots[i-1].label)
+		}
+	}
+}
+
+func TestRewriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lpar1.nmon")
+	content := "AAA,host,lpar1\n" +
+		"CPU_ALL,CPU Total,User%,Sys%\n" +
+		"ZZZZ,T0001,00:00:01,01-JAN-2020\n" +
+		"CPU_ALL,T0001,1.0,2.0\n" +
+		"ZZZZ,T0002,00:00:02,01-JAN-2020\n" +
+		"CPU_ALL,T0002,3.0,4.0\n" +
+		"CPU_ALL,T0003,5.0,6.0\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := &nmonOutput{path: filepath.Join(dir, "out.nmon"), snapshots: 1}
+	targets := map[string]target{"T0002": {output: output, label: "T0001"}}
+	dropped, err := rewriteFile(nmon2influxdblib.File{Name: path}, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the lines of T0001 and of the unknown T0003
+	if dropped != 2 {
+		t.Errorf("%d lines dropped, want 2", dropped)
+	}
+
+	written, err := ioutil.ReadFile(output.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "AAA,host,lpar1\n" +
+		"CPU_ALL,CPU Total,User%,Sys%\n" +
+		"ZZZZ,T0001,00:00:02,01-JAN-2020\n" +
+		"CPU_ALL,T0001,3.0,4.0\n"
+	if string(written) != want {
+		t.Errorf("output = %q, want %q", written, want)
+	}
+}
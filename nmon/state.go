@@ -0,0 +1,92 @@
+// nmon2influxdb
+// import nmon report in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+	"github.com/urfave/cli/v2"
+)
+
+// openStateStore opens the local state store configured for the state sub commands
+func openStateStore(c *cli.Context) (*nmon2influxdblib.StateStore, error) {
+	config, err := nmon2influxdblib.ParseParameters(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.ImportStateFile) == 0 {
+		return nil, cli.Exit("no local state store: set import_state_file in the configuration file or use --state_file", 1)
+	}
+	return nmon2influxdblib.OpenStateStore(config.ImportStateFile)
+}
+
+// printStates displays the import state of the files
+func printStates(states []nmon2influxdblib.FileState) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "FILE\tHOST\tTIMESTAMP\tCHECKSUM\tUPDATED\tSOURCE\n")
+	for _, state := range states {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", state.File, state.Host, state.Timestamp, state.Checksum, state.Updated.Local().Format("2006-01-02 15:04:05"), state.Source)
+	}
+	return writer.Flush()
+}
+
+// StateList is the entry point for the import state list sub command
+func StateList(c *cli.Context) error {
+	store, err := openStateStore(c)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	states, err := store.States()
+	if err != nil {
+		return err
+	}
+	host := c.String("host")
+	var selected []nmon2influxdblib.FileState
+	for _, state := range states {
+		if len(host) == 0 || state.Host == host {
+			selected = append(selected, state)
+		}
+	}
+	return printStates(selected)
+}
+
+// StateReset is the entry point for the import state reset sub command.
+// A file is selected by its source, its local path or its name.
+func StateReset(c *cli.Context) error {
+	if !c.Bool("all") && c.NArg() == 0 {
+		return cli.Exit("specify the files to reset or --all", 1)
+	}
+	store, err := openStateStore(c)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	files := make(map[string]bool)
+	for _, arg := range c.Args().Slice() {
+		files[arg] = true
+		if path, err := filepath.Abs(arg); err == nil {
+			files[path] = true
+		}
+	}
+	deleted, err := store.DeleteStates(func(state nmon2influxdblib.FileState) bool {
+		return c.Bool("all") || files[state.Source] || files[state.File]
+	})
+	if err != nil {
+		return err
+	}
+	if len(deleted) == 0 {
+		fmt.Println("no file reset")
+		return nil
+	}
+	fmt.Printf("%d files reset:\n", len(deleted))
+	return printStates(deleted)
+}
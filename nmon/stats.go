@@ -4,11 +4,14 @@
 package nmon
 
 import (
+	"encoding/json"
 	"fmt"
-	"os"
+	"regexp"
+	"strings"
 
 	"github.com/adejoux/influxdbclient"
 	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+	client "github.com/influxdata/influxdb1-client/v2"
 	"github.com/urfave/cli/v2"
 )
 
@@ -17,31 +20,45 @@ const querytimeformat = "2006-01-02 15:04:05"
 //Stat get and display metrics statistics
 func Stat(c *cli.Context) error {
 	// parsing parameters
-	config := nmon2influxdblib.ParseParameters(c)
-	nmon := InitNmonTemplate(config)
+	config, err := nmon2influxdblib.ParseParameters(c)
+	if err != nil {
+		return err
+	}
+	nmon, err := InitNmonTemplate(config)
+	if err != nil {
+		return err
+	}
 
 	if len(config.Metric) == 0 {
-		fmt.Printf("No metric specified ! Use -h option for help !\n")
-		os.Exit(1)
+		return cli.Exit("No metric specified ! Use -h option for help !", 1)
 	}
 
-	influxdb := config.ConnectDB(config.InfluxdbDatabase)
+	influxdb, err := config.ConnectDB(config.InfluxdbDatabase)
+	if err != nil {
+		return err
+	}
 	metric := config.Metric
 
 	filters := new(influxdbclient.Filters)
 
 	filters.Add("host", config.StatsHost, "text")
 
-	if len(config.StatsFilter) > 0 {
+	if len(config.StatsFilter) > 0 && !nmon.Wide() {
 		filters.Add("name", config.StatsFilter, "regexp")
 	}
 	fromUnix, _ := nmon.ConvertTimeStamp(config.StatsFrom)
 	fromTime := fromUnix.Format(querytimeformat)
 	toUnix, _ := nmon.ConvertTimeStamp(config.StatsTo)
 	toTime := toUnix.Format(querytimeformat)
-	result, err := influxdb.ReadPoints("value", filters, "name", metric, fromTime, toTime, "")
+
+	var result []*influxdbclient.DataSet
+	if nmon.Wide() {
+		result, err = ReadWidePoints(influxdb, filters, config.StatsFilter, metric, fromTime, toTime)
+	} else {
+		result, err = influxdb.ReadPoints("value", filters, "name", metric, fromTime, toTime, "")
+	}
 	if err != nil {
-		nmon2influxdblib.CheckError(err)
+		return err
 	}
 
 	//generate stats
@@ -51,6 +68,73 @@ func Stat(c *cli.Context) error {
 	return nil
 }
 
+// ReadWidePoints returns the fields of the measurement matching the filter regular expression. Used with the wide schema.
+func ReadWidePoints(influxdb nmon2influxdblib.DB, filters *influxdbclient.Filters, filter string, measurement string, from string, to string) (ds []*influxdbclient.DataSet, err error) {
+	filterRegexp, err := regexp.Compile(filter)
+	if err != nil {
+		return
+	}
+
+	res, err := influxdb.Query(fmt.Sprintf("SHOW FIELD KEYS FROM \"%s\"", measurement))
+	if err != nil || len(res) == 0 || len(res[0].Series) == 0 {
+		return
+	}
+
+	var fields []string
+	for _, row := range res[0].Series[0].Values {
+		field, ok := row[0].(string)
+		if ok && filterRegexp.MatchString(field) {
+			fields = append(fields, fmt.Sprintf("\"%s\"", field))
+		}
+	}
+	if len(fields) == 0 {
+		return
+	}
+
+	cmd := fmt.Sprintf("SELECT %s FROM \"%s\"", strings.Join(fields, ","), measurement)
+	var filterQuery influxdbclient.FilterQuery
+	if len(from) > 0 {
+		filterQuery.Append(fmt.Sprintf("time > '%s'", from))
+	}
+	if len(to) > 0 {
+		filterQuery.Append(fmt.Sprintf("time < '%s'", to))
+	}
+	filterQuery.AddFilters(filters)
+	if len(filterQuery.Content) > 0 {
+		cmd += " WHERE " + filterQuery.Content
+	}
+
+	res, err = influxdb.Query(cmd)
+	if err != nil || len(res) == 0 {
+		return
+	}
+	ds = wideDataSets(res)
+	return
+}
+
+// wideDataSets converts the query result in data sets. The fields missing in a point are skipped instead of counted as 0:
+// sections like JFSFILE don't have all their columns in each point.
+func wideDataSets(res []client.Result) (ds []*influxdbclient.DataSet) {
+	for _, serie := range res[0].Series {
+		dataSet := &influxdbclient.DataSet{Name: serie.Name, Tags: serie.Tags, Datas: make(map[string][]float64)}
+		for _, row := range serie.Values {
+			for i, field := range row {
+				number, ok := field.(json.Number)
+				if i == 0 || !ok {
+					continue
+				}
+				if value, err := number.Float64(); err == nil {
+					dataSet.Datas[serie.Columns[i]] = append(dataSet.Datas[serie.Columns[i]], value)
+				}
+			}
+		}
+		if len(dataSet.Datas) > 0 {
+			ds = append(ds, dataSet)
+		}
+	}
+	return
+}
+
 // DisplayStats displays metrics statistics in text mode.
 func DisplayStats(stats *influxdbclient.DataStats, sort string, limit int) {
 	fmt.Printf("%20s|%10s|%10s|%10s|%10s|%10s\n", "field", "Min", "Mean", "Median", "Max", "Points #")
@@ -0,0 +1,35 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/influxdata/influxdb1-client/models"
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+func TestWideDataSetsSkipMissingFields(t *testing.T) {
+	res := []client.Result{{Series: []models.Row{{
+		Name:    "JFSFILE",
+		Tags:    map[string]string{"host": "lpar1"},
+		Columns: []string{"time", "/", "/data", "/old"},
+		Values: [][]interface{}{
+			{"2020-01-01T00:00:00Z", json.Number("10"), nil, nil},
+			{"2020-01-01T00:00:30Z", json.Number("20"), json.Number("50"), nil},
+		},
+	}}}}
+
+	ds := wideDataSets(res)
+	if len(ds) != 1 {
+		t.Fatalf("%d data sets, want 1", len(ds))
+	}
+	want := map[string][]float64{"/": {10, 20}, "/data": {50}}
+	if !reflect.DeepEqual(ds[0].Datas, want) {
+		t.Errorf("datas = %v, want %v", ds[0].Datas, want)
+	}
+}
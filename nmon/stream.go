@@ -0,0 +1,134 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"log"
+	"strings"
+
+	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+)
+
+// maxPendingLines bounds the number of data lines kept while waiting for their header or timestamp
+const maxPendingLines = 50000
+
+// DataHandler is called for each data line once its section header and its timestamp are known.
+// label identifies the snapshot: use SnapshotTime to convert its time string.
+type DataHandler func(line string, elems []string, label string, timeStr string)
+
+// pendingLines stores the data lines found before their section header or their ZZZZ line
+type pendingLines struct {
+	bySection map[string][]string
+	byLabel   map[string][]string
+	count     int
+	dropped   int
+}
+
+// add stores line in the pending list identified by key
+func (pending *pendingLines) add(list *map[string][]string, key string, line string) {
+	if pending.count >= maxPendingLines {
+		pending.dropped++
+		return
+	}
+	if *list == nil {
+		*list = make(map[string][]string)
+	}
+	(*list)[key] = append((*list)[key], line)
+	pending.count++
+}
+
+// release removes and returns the lines stored under key
+func (pending *pendingLines) release(list map[string][]string, key string) (lines []string) {
+	lines = list[key]
+	if len(lines) > 0 {
+		delete(list, key)
+		pending.count -= len(lines)
+	}
+	return
+}
+
+// Stream reads the nmon file line by line without loading it in memory.
+// File informations, section headers and timestamps are stored in the Nmon structure.
+// Data lines are passed to handler as soon as they can be resolved. Use a nil handler to only parse the headers.
+func (nmon *Nmon) Stream(scanner *nmon2influxdblib.LineScanner, handler DataHandler) error {
+	for scanner.Scan() {
+		nmon.Delimiter = scanner.Delimiter
+		nmon.AddLine(scanner.Text(), handler)
+	}
+	nmon.EndStream()
+	return scanner.Err()
+}
+
+// AddLine processes one line of the nmon file
+func (nmon *Nmon) AddLine(line string, handler DataHandler) {
+	kind, key := nmon.parseLine(line)
+	switch kind {
+	case timeLine:
+		for _, pendingLine := range nmon.pending.release(nmon.pending.byLabel, key) {
+			nmon.resolve(pendingLine, key, handler)
+		}
+	case headerLine:
+		for _, pendingLine := range nmon.pending.release(nmon.pending.bySection, key) {
+			nmon.resolve(pendingLine, statsRegexp.FindStringSubmatch(pendingLine)[1], handler)
+		}
+	case dataLine:
+		nmon.resolve(line, key, handler)
+	case skippedLine:
+		// the section header is not usable: its pending lines will never be imported
+		if len(key) > 0 {
+			nmon.pending.release(nmon.pending.bySection, key)
+		}
+	}
+}
+
+// EndStream reports the lines which never got their header or timestamp
+func (nmon *Nmon) EndStream() {
+	if nmon.Debug {
+		nmon.logInfos()
+	}
+	if nmon.pending.count > 0 || nmon.pending.dropped > 0 {
+		log.Printf("%d lines without section header or timestamp skipped\n", nmon.pending.count+nmon.pending.dropped)
+		nmon.parseError("%d lines without section header or timestamp", nmon.pending.count+nmon.pending.dropped)
+	}
+	nmon.pending = pendingLines{}
+}
+
+// resolve passes the data line to handler or keeps it until its header or timestamp is found
+func (nmon *Nmon) resolve(line string, label string, handler DataHandler) {
+	if handler == nil {
+		return
+	}
+
+	if skipRegexp.MatchString(line) {
+		return
+	}
+
+	elems := strings.Split(line, nmon.Delimiter)
+	name := elems[0]
+	if nmon.ignored[name] {
+		return
+	}
+
+	if nmon.userSkipRegexp != nil && nmon.userSkipRegexp.MatchString(name) {
+		if nmon.Debug && !nmon.skipped[name] {
+			log.Printf("metric skipped : %s\n", name)
+			nmon.skipped[name] = true
+		}
+		return
+	}
+
+	if _, ok := nmon.DataSeries[name]; !ok {
+		nmon.pending.add(&nmon.pending.bySection, name, line)
+		return
+	}
+
+	timeStr, ok := nmon.TimeStamps[label]
+	if !ok {
+		nmon.pending.add(&nmon.pending.byLabel, label, line)
+		return
+	}
+
+	handler(line, elems, label, timeStr)
+}
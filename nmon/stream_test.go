@@ -0,0 +1,307 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adejoux/nmon2influxdb/nmon2influxdblib"
+)
+
+// newTestNmon returns a Nmon structure parsing all the sections in UTC
+func newTestNmon(t *testing.T) *Nmon {
+	t.Helper()
+	config := nmon2influxdblib.InitConfig()
+	config.Timezone = "UTC"
+	config.ImportSkipMetrics = ""
+	nmon, err := NewNmonImport(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nmon
+}
+
+// streamLines passes the lines to the parser and returns the resolved data lines with their timestamp
+func streamLines(nmon *Nmon, lines []string) (resolved []string) {
+	handler := func(line string, elems []string, label string, timeStr string) {
+		resolved = append(resolved, line+" @ "+timeStr)
+	}
+	for _, line := range lines {
+		nmon.AddLine(line, handler)
+	}
+	return
+}
+
+func TestStreamPendingLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		want    []string
+		pending int
+	}{
+		{
+			name: "ordered",
+			lines: []string{
+				"CPU_ALL,CPU Total,User%,Sys%",
+				"ZZZZ,T0001,00:00:01,01-JAN-2020",
+				"CPU_ALL,T0001,1.0,2.0",
+			},
+			want: []string{"CPU_ALL,T0001,1.0,2.0 @ 00:00:01,01-JAN-2020"},
+		},
+		{
+			name: "data before header",
+			lines: []string{
+				"ZZZZ,T0001,00:00:01,01-JAN-2020",
+				"CPU_ALL,T0001,1.0,2.0",
+				"CPU_ALL,CPU Total,User%,Sys%",
+			},
+			want: []string{"CPU_ALL,T0001,1.0,2.0 @ 00:00:01,01-JAN-2020"},
+		},
+		{
+			name: "data before timestamp",
+			lines: []string{
+				"CPU_ALL,CPU Total,User%,Sys%",
+				"CPU_ALL,T0001,1.0,2.0",
+				"ZZZZ,T0001,00:00:01,01-JAN-2020",
+			},
+			want: []string{"CPU_ALL,T0001,1.0,2.0 @ 00:00:01,01-JAN-2020"},
+		},
+		{
+			name: "out of order labels",
+			lines: []string{
+				"CPU_ALL,CPU Total,User%,Sys%",
+				"ZZZZ,T0001,00:00:01,01-JAN-2020",
+				"CPU_ALL,T0002,3.0,4.0",
+				"CPU_ALL,T0001,1.0,2.0",
+				"ZZZZ,T0002,00:00:02,01-JAN-2020",
+			},
+			want: []string{
+				"CPU_ALL,T0001,1.0,2.0 @ 00:00:01,01-JAN-2020",
+				"CPU_ALL,T0002,3.0,4.0 @ 00:00:02,01-JAN-2020",
+			},
+		},
+		{
+			name: "header never found",
+			lines: []string{
+				"ZZZZ,T0001,00:00:01,01-JAN-2020",
+				"MEM,T0001,1.0,2.0",
+			},
+			pending: 1,
+		},
+		{
+			name: "timestamp never found",
+			lines: []string{
+				"CPU_ALL,CPU Total,User%,Sys%",
+				"CPU_ALL,T0001,1.0,2.0",
+			},
+			pending: 1,
+		},
+		{
+			name: "unusable header releases its lines",
+			lines: []string{
+				"ZZZZ,T0001,00:00:01,01-JAN-2020",
+				"DISKBUSY,T0001,1.0,2.0",
+				"DISKBUSY,Disk %Busy,,hdisk1",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nmon := newTestNmon(t)
+			got := streamLines(nmon, test.lines)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("resolved lines = %q, want %q", got, test.want)
+			}
+			if nmon.pending.count != test.pending {
+				t.Errorf("pending lines = %d, want %d", nmon.pending.count, test.pending)
+			}
+			nmon.EndStream()
+			if test.pending > 0 && nmon.errorCount == 0 {
+				t.Errorf("pending lines not reported")
+			}
+		})
+	}
+}
+
+func TestStreamPendingLinesCap(t *testing.T) {
+	nmon := newTestNmon(t)
+	lines := []string{"ZZZZ,T0001,00:00:01,01-JAN-2020"}
+	for i := 0; i < maxPendingLines+10; i++ {
+		lines = append(lines, fmt.Sprintf("CPU_ALL,T0001,%d", i))
+	}
+	if got := streamLines(nmon, lines); len(got) != 0 {
+		t.Fatalf("%d lines resolved without header", len(got))
+	}
+	if nmon.pending.count != maxPendingLines || nmon.pending.dropped != 10 {
+		t.Errorf("pending = %d, dropped = %d, want %d and 10", nmon.pending.count, nmon.pending.dropped, maxPendingLines)
+	}
+
+	got := streamLines(nmon, []string{"CPU_ALL,CPU Total,User%"})
+	if len(got) != maxPendingLines {
+		t.Errorf("%d lines resolved by the header, want %d", len(got), maxPendingLines)
+	}
+	if nmon.pending.count != 0 {
+		t.Errorf("%d lines still pending", nmon.pending.count)
+	}
+}
+
+func TestStreamHeaderRedefinition(t *testing.T) {
+	nmon := newTestNmon(t)
+	streamLines(nmon, []string{
+		"DISKBUSY,Disk %Busy,hdisk0",
+		"ZZZZ,T0001,00:00:01,01-JAN-2020",
+		"DISKBUSY,T0001,1.0",
+		"DISKBUSY,Disk %Busy,hdisk0,hdisk1",
+	})
+	want := []string{"hdisk0", "hdisk1"}
+	if got := nmon.DataSeries["DISKBUSY"].Columns; !reflect.DeepEqual(got, want) {
+		t.Errorf("columns = %q, want %q", got, want)
+	}
+}
+
+// pointRecorder keeps the value of the points added by AddStatsPoints by measurement, name and time
+type pointRecorder map[string]interface{}
+
+func (recorder pointRecorder) AddPoint(measurement string, timestamp time.Time, fields map[string]interface{}, tags map[string]string) {
+	recorder[measurement+" "+tags["name"]+" "+timestamp.Format("15:04:05")] = fields["value"]
+}
+
+func (recorder pointRecorder) WritePoints() error { return nil }
+
+func (recorder pointRecorder) PointsCount() int64 { return int64(len(recorder)) }
+
+func (recorder pointRecorder) ClearPoints() {}
+
+func TestStreamAddedDevices(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  map[string]interface{}
+	}{
+		{
+			name: "redefined header",
+			lines: []string{
+				"DISKBUSY,Disk %Busy,hdisk0",
+				"ZZZZ,T0001,00:00:01,01-JAN-2020",
+				"DISKBUSY,T0001,1.0",
+				"ZZZZ,T0002,00:00:02,01-JAN-2020",
+				"DISKBUSY,T0002,2.0",
+				"DISKBUSY,Disk %Busy,hdisk0,hdisk3",
+				"ZZZZ,T0003,00:00:03,01-JAN-2020",
+				"DISKBUSY,T0003,3.0,33.0",
+			},
+			want: map[string]interface{}{
+				"DISKBUSY hdisk0 00:00:01": 1.0,
+				"DISKBUSY hdisk0 00:00:02": 2.0,
+				"DISKBUSY hdisk0 00:00:03": 3.0,
+				"DISKBUSY hdisk3 00:00:03": 33.0,
+			},
+		},
+		{
+			name: "columns of a sibling section",
+			lines: []string{
+				"DISKBUSY,Disk %Busy,hdisk0",
+				"DISKREAD,Disk Read KB/s,hdisk0,hdisk1,hdisk2",
+				"ZZZZ,T0001,00:00:01,01-JAN-2020",
+				"DISKBUSY,T0001,1.0",
+				"ZZZZ,T0002,00:00:02,01-JAN-2020",
+				"DISKBUSY,T0002,2.0,20.0,200.0",
+			},
+			want: map[string]interface{}{
+				"DISKBUSY hdisk0 00:00:01": 1.0,
+				"DISKBUSY hdisk0 00:00:02": 2.0,
+				"DISKBUSY hdisk1 00:00:02": 20.0,
+				"DISKBUSY hdisk2 00:00:02": 200.0,
+			},
+		},
+		{
+			name: "columns named by position",
+			lines: []string{
+				"DISKBUSY,Disk %Busy,hdisk0",
+				"ZZZZ,T0001,00:00:01,01-JAN-2020",
+				"DISKBUSY,T0001,1.0,10.0,",
+			},
+			want: map[string]interface{}{
+				"DISKBUSY hdisk0 00:00:01":  1.0,
+				"DISKBUSY column2 00:00:01": 10.0,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nmon := newTestNmon(t)
+			recorder := make(pointRecorder)
+			for _, line := range test.lines {
+				nmon.AddLine(line, func(line string, elems []string, label string, timeStr string) {
+					timestamp, err := nmon.ConvertTimeStamp(timeStr)
+					if err != nil {
+						t.Fatal(err)
+					}
+					nmon.AddStatsPoints(recorder, elems[0], elems, timestamp, line)
+				})
+			}
+			if !reflect.DeepEqual(map[string]interface{}(recorder), test.want) {
+				t.Errorf("points = %v, want %v", recorder, test.want)
+			}
+		})
+	}
+}
+
+func TestStreamDelimiter(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		delimiter string
+		want      []string
+	}{
+		{
+			name: "comma",
+			content: "AAA,host,lpar1\n" +
+				"CPU_ALL,CPU Total,User%,Sys%\n" +
+				"ZZZZ,T0001,00:00:01,01-JAN-2020\n" +
+				"CPU_ALL,T0001,12.5,3\n",
+			delimiter: ",",
+			want:      []string{"CPU_ALL", "T0001", "12.5", "3"},
+		},
+		{
+			name: "semicolon with decimal commas",
+			content: "AAA;host;lpar1\n" +
+				"CPU_ALL;CPU Total;User%;Sys%\n" +
+				"ZZZZ;T0001;00:00:01;01-JAN-2020\n" +
+				"CPU_ALL;T0001;12,5;3\n",
+			delimiter: ";",
+			want:      []string{"CPU_ALL", "T0001", "12.5", "3"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nmon := newTestNmon(t)
+			var got []string
+			scanner := nmon2influxdblib.NewLineScanner(strings.NewReader(test.content))
+			err := nmon.Stream(scanner, func(line string, elems []string, label string, timeStr string) {
+				got = elems
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nmon.Delimiter != test.delimiter {
+				t.Errorf("delimiter = %q, want %q", nmon.Delimiter, test.delimiter)
+			}
+			if nmon.Hostname != "lpar1" {
+				t.Errorf("host = %q, want lpar1", nmon.Hostname)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("values = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var archiveRegexp = regexp.MustCompile(`\.(tar|tar\.gz|tgz|tar\.bz2|tbz2|tar\.xz|txz|tar\.zst|zip)$`)
+var aaaDateRegexp = regexp.MustCompile(`^AAA.date.(\S+)`)
+var aaaTimeRegexp = regexp.MustCompile(`^AAA.time.(\S+)`)
+
+// nmon start time format found in AAA lines
+const aaaTimeFormat = "02-Jan-2006 15:04.05"
+
+// maxHeaderLines is the number of lines read to find the start time of an archived nmon file
+const maxHeaderLines = 100
+
+// IsArchive returns true if the file is a tar or zip archive containing nmon files
+func IsArchive(name string) bool {
+	return archiveRegexp.MatchString(name)
+}
+
+// isZip returns true for zip archives. Other archives are tar files, compressed or not.
+func isZip(name string) bool {
+	return strings.HasSuffix(name, ".zip")
+}
+
+// isNmonMember returns true if the archive member looks like a nmon file
+func isNmonMember(name string) bool {
+	ext := path.Ext(name)
+	return ext == ".nmon" || (compressedExtensions[ext] && strings.HasSuffix(strings.TrimSuffix(name, ext), ".nmon"))
+}
+
+// archiveMember stores an archive member with the nmon start time used to sort them.
+// The position and the checksum of the member are recorded to open it without reading the previous members again.
+type archiveMember struct {
+	name     string
+	start    time.Time
+	offset   int64
+	size     int64
+	checksum string
+}
+
+// AddArchive adds the nmon files found in the archive. They are sorted by nmon start time.
+func (nmonFiles *Files) AddArchive(archive File) error {
+	members, err := archive.members()
+	if err != nil {
+		var fileErr *FileError
+		var sshErr *SSHError
+		if errors.As(err, &fileErr) || errors.As(err, &sshErr) {
+			return err
+		}
+		name := archive.Name
+		if len(archive.Host) > 0 {
+			name = archive.Host + ":" + name
+		}
+		return &FileError{File: name, Err: fmt.Errorf("unable to read archive: %w", err)}
+	}
+	sort.SliceStable(members, func(i, j int) bool { return members[i].start.Before(members[j].start) })
+
+	for _, member := range members {
+		file := archive
+		file.Member = member.name
+		file.FileType = path.Ext(member.name)
+		file.offset = member.offset
+		file.size = member.size
+		file.checksum = member.checksum
+		*nmonFiles = append(*nmonFiles, file)
+	}
+	return nil
+}
+
+// members lists the nmon files of the archive in a single pass. It reads their start time, position and checksum.
+func (archive *File) members() (members []archiveMember, err error) {
+	reader, err := archive.openArchive()
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	for {
+		name, modTime, content, err := reader.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return members, err
+		}
+		if !isNmonMember(name) {
+			continue
+		}
+		// all the bytes of the member go through the tail to compute its checksum
+		tail := &tailWriter{size: checksumSize}
+		tee := io.TeeReader(content, tail)
+		start, found := startTime(tee)
+		if !found {
+			start = modTime
+		}
+		if _, err := io.Copy(ioutil.Discard, tee); err != nil {
+			return members, err
+		}
+		members = append(members, archiveMember{name: name, start: start, offset: reader.offset, size: reader.size, checksum: hashTail(tail.tail)})
+	}
+}
+
+// startTime reads the nmon start time in the AAA lines
+func startTime(content io.Reader) (start time.Time, found bool) {
+	reader, closer, err := Decompress(content)
+	if err != nil {
+		return
+	}
+	defer closer.Close()
+
+	var date, hour string
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for i := 0; i < maxHeaderLines && scanner.Scan(); i++ {
+		line := scanner.Text()
+		if matched := aaaDateRegexp.FindStringSubmatch(line); matched != nil {
+			date = matched[1]
+		}
+		if matched := aaaTimeRegexp.FindStringSubmatch(line); matched != nil {
+			hour = matched[1]
+		}
+		if len(date) > 0 && len(hour) > 0 {
+			start, err = time.Parse(aaaTimeFormat, date+" "+hour)
+			return start, err == nil
+		}
+	}
+	return
+}
+
+// archiveReader iterates over the regular files of a tar or zip archive
+type archiveReader struct {
+	tar     *tar.Reader
+	zip     []*zip.File
+	current io.ReadCloser
+	closers readCloser
+	// position of the current tar member in the uncompressed tar stream
+	counter *countingReader
+	offset  int64
+	size    int64
+}
+
+// countingReader counts the bytes read
+type countingReader struct {
+	io.Reader
+	count int64
+}
+
+// Read reads from the underlying reader and counts the bytes
+func (reader *countingReader) Read(p []byte) (int, error) {
+	n, err := reader.Reader.Read(p)
+	reader.count += int64(n)
+	return n, err
+}
+
+// openArchive opens the archive. tar archives can be compressed with any supported format.
+func (archive *File) openArchive() (*archiveReader, error) {
+	raw, closer, err := archive.openRaw()
+	if err != nil {
+		return nil, err
+	}
+	reader := &archiveReader{closers: readCloser{closers: []io.Closer{closer}}}
+
+	if isZip(archive.Name) {
+		readerAt, ok := raw.(io.ReaderAt)
+		if !ok {
+			reader.Close()
+			return nil, fmt.Errorf("%s: random access not available", archive.Name)
+		}
+		size, err := raw.Seek(0, io.SeekEnd)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+		zipReader, err := zip.NewReader(readerAt, size)
+		if err != nil {
+			reader.Close()
+			return nil, err
+		}
+		reader.zip = zipReader.File
+		return reader, nil
+	}
+
+	decompressed, decompressor, err := Decompress(raw)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	reader.closers.closers = append(reader.closers.closers, decompressor)
+	// the tar reader doesn't read ahead: the count is the position of the member content after Next
+	reader.counter = &countingReader{Reader: decompressed}
+	reader.tar = tar.NewReader(reader.counter)
+	return reader, nil
+}
+
+// Next returns the next regular file of the archive. It returns io.EOF at the end of the archive.
+func (reader *archiveReader) Next() (name string, modTime time.Time, content io.Reader, err error) {
+	if reader.current != nil {
+		reader.current.Close()
+		reader.current = nil
+	}
+
+	if reader.tar != nil {
+		for {
+			header, err := reader.tar.Next()
+			if err != nil {
+				return "", modTime, nil, err
+			}
+			if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+				reader.offset, reader.size = reader.counter.count, header.Size
+				return header.Name, header.ModTime, reader.tar, nil
+			}
+		}
+	}
+
+	for len(reader.zip) > 0 {
+		member := reader.zip[0]
+		reader.zip = reader.zip[1:]
+		if member.FileInfo().IsDir() {
+			continue
+		}
+		reader.current, err = member.Open()
+		if err != nil {
+			return "", modTime, nil, err
+		}
+		return member.Name, member.Modified, reader.current, nil
+	}
+	return "", modTime, nil, io.EOF
+}
+
+// Close closes the archive
+func (reader *archiveReader) Close() error {
+	if reader.current != nil {
+		reader.current.Close()
+	}
+	return reader.closers.Close()
+}
+
+// openMember returns a reader on the raw content of the archive member.
+// tar members are read from the position recorded by AddArchive and zip members from the zip directory.
+func (archive *File) openMember() (io.ReadCloser, error) {
+	if isZip(archive.Name) {
+		return archive.openZipMember()
+	}
+
+	raw, closer, err := archive.openRaw()
+	if err != nil {
+		return nil, err
+	}
+	// an uncompressed tar archive is read from the member position
+	if Compression(bufio.NewReader(raw)) == "" {
+		if _, err := raw.Seek(archive.offset, io.SeekStart); err != nil {
+			closer.Close()
+			return nil, &FileError{File: archive.FullName(), Err: err}
+		}
+		return &readCloser{Reader: io.LimitReader(raw, archive.size), closers: []io.Closer{closer}}, nil
+	}
+
+	if _, err := raw.Seek(0, io.SeekStart); err != nil {
+		closer.Close()
+		return nil, &FileError{File: archive.FullName(), Err: err}
+	}
+	decompressed, decompressor, err := Decompress(raw)
+	if err != nil {
+		closer.Close()
+		return nil, &FileError{File: archive.FullName(), Err: err}
+	}
+	member := &readCloser{Reader: io.LimitReader(decompressed, archive.size), closers: []io.Closer{closer, decompressor}}
+	// a compressed stream can't be read from the middle
+	if _, err := io.CopyN(ioutil.Discard, decompressed, archive.offset); err != nil {
+		member.Close()
+		return nil, &FileError{File: archive.FullName(), Err: err}
+	}
+	return member, nil
+}
+
+// openZipMember returns a reader on the uncompressed content of the zip member
+func (archive *File) openZipMember() (io.ReadCloser, error) {
+	reader, err := archive.openArchive()
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range reader.zip {
+		if member.Name != archive.Member {
+			continue
+		}
+		content, err := member.Open()
+		if err != nil {
+			reader.Close()
+			return nil, &FileError{File: archive.FullName(), Err: err}
+		}
+		return &readCloser{Reader: content, closers: []io.Closer{reader, content}}, nil
+	}
+	reader.Close()
+	return nil, fmt.Errorf("%s not found in archive %s", archive.Member, archive.Name)
+}
+
+// tailWriter keeps the last bytes written
+type tailWriter struct {
+	size int
+	tail []byte
+}
+
+// Write appends p and drops the oldest bytes
+func (writer *tailWriter) Write(p []byte) (int, error) {
+	writer.tail = append(writer.tail, p...)
+	if len(writer.tail) > writer.size {
+		writer.tail = append(writer.tail[:0], writer.tail[len(writer.tail)-writer.size:]...)
+	}
+	return len(p), nil
+}
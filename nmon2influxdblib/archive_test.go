@@ -0,0 +1,198 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// archiveTestMember is a file stored in the test archives
+type archiveTestMember struct {
+	name    string
+	host    string
+	content []byte
+}
+
+// gzipBytes compresses content with gzip
+func gzipBytes(t *testing.T, content string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write([]byte(content))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// nmonContent returns a nmon file started at date with enough lines to be bigger than the checksum size
+func nmonContent(host string, date string) string {
+	content := "AAA,host," + host + "\nAAA,date," + date + "\nAAA,time,10:00.00\n"
+	for i := 0; i < 100; i++ {
+		content += "CPU_ALL,T0001,1.0,2.0,3.0,4.0\n"
+	}
+	return content
+}
+
+// archiveTestMembers returns the members of the test archives. The second nmon file started first.
+func archiveTestMembers(t *testing.T) []archiveTestMember {
+	return []archiveTestMember{
+		{"./lpar1_200102.nmon", "lpar1", []byte(nmonContent("lpar1", "02-JAN-2020"))},
+		{"README", "", []byte("not a nmon file\n")},
+		{"lpar2_200101.nmon.gz", "lpar2", gzipBytes(t, nmonContent("lpar2", "01-JAN-2020"))},
+	}
+}
+
+// writeTar writes the members in a tar archive, compressed with gzip if compress is true
+func writeTar(t *testing.T, path string, members []archiveTestMember, compress bool) {
+	t.Helper()
+	var buf bytes.Buffer
+	var writer io.Writer = &buf
+	var gzipWriter *gzip.Writer
+	if compress {
+		gzipWriter = gzip.NewWriter(&buf)
+		writer = gzipWriter
+	}
+	tarWriter := tar.NewWriter(writer)
+	for _, member := range members {
+		header := &tar.Header{Name: member.name, Mode: 0644, Size: int64(len(member.content)), ModTime: time.Now(), Typeflag: tar.TypeReg}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tarWriter.Write(member.content)
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gzipWriter != nil {
+		gzipWriter.Close()
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeZip writes the members in a zip archive
+func writeZip(t *testing.T, path string, members []archiveTestMember) {
+	t.Helper()
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for _, member := range members {
+		writer, err := zipWriter.Create(member.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write(member.content)
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveMembers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	members := archiveTestMembers(t)
+	// the same files out of an archive give the expected checksums
+	checksums := make(map[string]string)
+	for _, member := range members {
+		path := filepath.Join(dir, filepath.Base(member.name))
+		if err := ioutil.WriteFile(path, member.content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		plain := File{Name: path}
+		checksums[member.name], err = plain.Checksum()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archives := map[string]func(path string){
+		"nmon.tar":    func(path string) { writeTar(t, path, members, false) },
+		"nmon.tar.gz": func(path string) { writeTar(t, path, members, true) },
+		"nmon.zip":    func(path string) { writeZip(t, path, members) },
+	}
+	for name, write := range archives {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			write(path)
+
+			nmonFiles := new(Files)
+			if errs := nmonFiles.Parse([]string{path}, "", ""); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			files := nmonFiles.Valid()
+			if len(files) != 2 {
+				t.Fatalf("%d nmon files found, want 2", len(files))
+			}
+			// sorted by nmon start time
+			want := []archiveTestMember{members[2], members[0]}
+			for i, file := range files {
+				if file.Member != want[i].name {
+					t.Errorf("member %d = %s, want %s", i, file.Member, want[i].name)
+				}
+				checksum, err := file.Checksum()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if checksum != checksums[want[i].name] {
+					t.Errorf("%s: checksum %s, want %s as out of the archive", file.Member, checksum, checksums[want[i].name])
+				}
+
+				lines, err := file.Content()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(lines) != 103 || lines[1] != "AAA,host,"+want[i].host {
+					t.Errorf("%s: unexpected content of %d lines", file.Member, len(lines))
+				}
+			}
+		})
+	}
+}
+
+func TestArchiveUnreadable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "broken.tar.gz")
+	content := gzipBytes(t, "not a tar archive")
+	if err := ioutil.WriteFile(path, content[:len(content)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	nmonFiles := new(Files)
+	errs := nmonFiles.Parse([]string{path}, "", "")
+	if len(errs) != 1 {
+		t.Fatalf("%d errors, want 1", len(errs))
+	}
+	var fileErr *FileError
+	if !errors.As(errs[0], &fileErr) || fileErr.File != path {
+		t.Errorf("error %v is not a FileError on %s", errs[0], path)
+	}
+	if len(*nmonFiles) != 0 {
+		t.Errorf("%d files added from a broken archive", len(*nmonFiles))
+	}
+}
@@ -0,0 +1,239 @@
+// nmon2influxdb
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Calculations allows to put multiple calculated metrics in the configuration file
+type Calculations []Calculation
+
+// Calculation defines a metric computed from the other columns of the same measurement and timestamp
+type Calculation struct {
+	Measurement string
+	Name        string
+	Expression  string
+	Expr        *Expression `toml:",skip"`
+}
+
+// CalculatedValue is the result of a calculation
+type CalculatedValue struct {
+	Name  string
+	Value float64
+}
+
+// ParseCalculations compiles the expressions and returns the calculations by measurement
+func ParseCalculations(calculations Calculations) (map[string]Calculations, error) {
+	parsed := make(map[string]Calculations)
+	for _, calculation := range calculations {
+		if len(calculation.Measurement) == 0 || len(calculation.Name) == 0 {
+			return nil, fmt.Errorf("calculated metric without measurement or name: %s", calculation.Expression)
+		}
+		expr, err := ParseExpression(calculation.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("calculated metric %s: %s", calculation.Name, err)
+		}
+		calculation.Expr = expr
+		parsed[calculation.Measurement] = append(parsed[calculation.Measurement], calculation)
+	}
+	return parsed, nil
+}
+
+// Evaluate computes the calculations with the values of the columns. A calculation can use the result of the previous ones.
+// Calculations using a missing column or dividing by zero are skipped.
+func (calculations Calculations) Evaluate(values map[string]float64) (results []CalculatedValue) {
+	if len(calculations) == 0 {
+		return
+	}
+	columns := make(map[string]float64, len(values)+len(calculations))
+	for column, value := range values {
+		columns[column] = value
+	}
+	for _, calculation := range calculations {
+		value, ok := calculation.Expr.Eval(columns)
+		if !ok {
+			continue
+		}
+		columns[calculation.Name] = value
+		results = append(results, CalculatedValue{Name: calculation.Name, Value: value})
+	}
+	return
+}
+
+// Expression is an arithmetic expression on columns: + - * /, parenthesis, numbers and column names.
+// Column names containing spaces or operators are written between brackets: [Real free %].
+type Expression struct {
+	op          byte
+	value       float64
+	column      string
+	left, right *Expression
+}
+
+// expression node types
+const (
+	numberNode = 'n'
+	columnNode = 'c'
+	negateNode = '~'
+)
+
+// ParseExpression compiles an expression
+func ParseExpression(s string) (*Expression, error) {
+	parser := &exprParser{input: s}
+	expr, err := parser.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	parser.skipSpaces()
+	if parser.pos < len(parser.input) {
+		return nil, fmt.Errorf("unexpected %q at position %d in %s", parser.input[parser.pos], parser.pos+1, s)
+	}
+	return expr, nil
+}
+
+// Eval computes the expression. It returns false if a column is missing or if the result is not a number.
+func (expr *Expression) Eval(columns map[string]float64) (float64, bool) {
+	switch expr.op {
+	case numberNode:
+		return expr.value, true
+	case columnNode:
+		value, ok := columns[expr.column]
+		return value, ok
+	case negateNode:
+		value, ok := expr.left.Eval(columns)
+		return -value, ok
+	}
+
+	left, ok := expr.left.Eval(columns)
+	if !ok {
+		return 0, false
+	}
+	right, ok := expr.right.Eval(columns)
+	if !ok {
+		return 0, false
+	}
+	var result float64
+	switch expr.op {
+	case '+':
+		result = left + right
+	case '-':
+		result = left - right
+	case '*':
+		result = left * right
+	case '/':
+		if right == 0 {
+			return 0, false
+		}
+		result = left / right
+	}
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, false
+	}
+	return result, true
+}
+
+// exprParser is a recursive descent parser for expressions
+type exprParser struct {
+	input string
+	pos   int
+}
+
+func (parser *exprParser) skipSpaces() {
+	for parser.pos < len(parser.input) && parser.input[parser.pos] == ' ' {
+		parser.pos++
+	}
+}
+
+// peek returns the next non space character or 0 at the end of the input
+func (parser *exprParser) peek() byte {
+	parser.skipSpaces()
+	if parser.pos < len(parser.input) {
+		return parser.input[parser.pos]
+	}
+	return 0
+}
+
+// parseSum parses additions and subtractions
+func (parser *exprParser) parseSum() (*Expression, error) {
+	left, err := parser.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for op := parser.peek(); op == '+' || op == '-'; op = parser.peek() {
+		parser.pos++
+		right, err := parser.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = &Expression{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseProduct parses multiplications and divisions
+func (parser *exprParser) parseProduct() (*Expression, error) {
+	left, err := parser.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for op := parser.peek(); op == '*' || op == '/'; op = parser.peek() {
+		parser.pos++
+		right, err := parser.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = &Expression{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseFactor parses numbers, columns, negations and parenthesis
+func (parser *exprParser) parseFactor() (*Expression, error) {
+	switch c := parser.peek(); {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression %s", parser.input)
+	case c == '-':
+		parser.pos++
+		operand, err := parser.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return &Expression{op: negateNode, left: operand}, nil
+	case c == '(':
+		parser.pos++
+		expr, err := parser.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if parser.peek() != ')' {
+			return nil, fmt.Errorf("missing ) in %s", parser.input)
+		}
+		parser.pos++
+		return expr, nil
+	case c == '[':
+		end := strings.IndexByte(parser.input[parser.pos:], ']')
+		if end < 0 {
+			return nil, fmt.Errorf("missing ] in %s", parser.input)
+		}
+		column := parser.input[parser.pos+1 : parser.pos+end]
+		parser.pos += end + 1
+		return &Expression{op: columnNode, column: column}, nil
+	}
+
+	start := parser.pos
+	for parser.pos < len(parser.input) && !strings.ContainsRune(" +-*/()[]", rune(parser.input[parser.pos])) {
+		parser.pos++
+	}
+	token := parser.input[start:parser.pos]
+	if len(token) == 0 {
+		return nil, fmt.Errorf("unexpected %q at position %d in %s", parser.input[start], start+1, parser.input)
+	}
+	if value, err := strconv.ParseFloat(token, 64); err == nil {
+		return &Expression{op: numberNode, value: value}, nil
+	}
+	return &Expression{op: columnNode, column: token}, nil
+}
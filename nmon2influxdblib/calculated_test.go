@@ -0,0 +1,88 @@
+// nmon2influxdb
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpressionEval(t *testing.T) {
+	columns := map[string]float64{"User%": 20, "Sys%": 10, "Wait%": 5, "Real free %": 25, "zero": 0}
+	tests := []struct {
+		expression string
+		want       float64
+		ok         bool
+	}{
+		{"User% + Sys%", 30, true},
+		{"100 - User% - Sys%", 70, true},
+		{"User% + Sys% * 2", 40, true},
+		{"(User% + Sys%) * 2", 60, true},
+		{"User% / Sys% / 2", 1, true},
+		{"-User% + 50", 30, true},
+		{"--5", 5, true},
+		{"[Real free %] * 4", 100, true},
+		{"  1.5e2 ", 150, true},
+		{"User% / zero", 0, false},
+		{"Missing + 1", 0, false},
+		{"zero * Missing", 0, false},
+	}
+	for _, test := range tests {
+		expr, err := ParseExpression(test.expression)
+		if err != nil {
+			t.Errorf("ParseExpression(%q): %s", test.expression, err)
+			continue
+		}
+		got, ok := expr.Eval(columns)
+		if ok != test.ok || got != test.want {
+			t.Errorf("Eval(%q) = %v %v, want %v %v", test.expression, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	for _, expression := range []string{"", "User% +", "(User% + Sys%", "[Real free %", "User% Sys%", "User% + * 2", ")"} {
+		if _, err := ParseExpression(expression); err == nil {
+			t.Errorf("ParseExpression(%q) succeeded", expression)
+		}
+	}
+}
+
+func TestCalculationsEvaluate(t *testing.T) {
+	parsed, err := ParseCalculations(Calculations{
+		{Measurement: "MEM", Name: "used", Expression: "memtotal - memfree"},
+		{Measurement: "MEM", Name: "used%", Expression: "used / memtotal * 100"},
+		{Measurement: "MEM", Name: "broken", Expression: "swaptotal / 0"},
+		{Measurement: "CPU_ALL", Name: "busy", Expression: "User% + Sys%"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed["MEM"]) != 3 || len(parsed["CPU_ALL"]) != 1 {
+		t.Fatalf("calculations by measurement = %v", parsed)
+	}
+
+	values := map[string]float64{"memtotal": 200, "memfree": 50, "swaptotal": 10}
+	got := parsed["MEM"].Evaluate(values)
+	want := []CalculatedValue{{Name: "used", Value: 150}, {Name: "used%", Value: 75}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Evaluate() = %v, want %v", got, want)
+	}
+	if _, ok := values["used"]; ok {
+		t.Errorf("the column values were modified")
+	}
+}
+
+func TestParseCalculationsErrors(t *testing.T) {
+	invalid := []Calculation{
+		{Name: "used", Expression: "memtotal - memfree"},
+		{Measurement: "MEM", Expression: "memtotal - memfree"},
+		{Measurement: "MEM", Name: "used", Expression: "memtotal -"},
+	}
+	for _, calculation := range invalid {
+		if _, err := ParseCalculations(Calculations{calculation}); err == nil {
+			t.Errorf("ParseCalculations(%+v) succeeded", calculation)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// compression formats
+const (
+	Gzip  = "gzip"
+	Bzip2 = "bzip2"
+	Xz    = "xz"
+	Zstd  = "zstd"
+)
+
+// magicNumbers are the first bytes identifying the compression formats
+var magicNumbers = []struct {
+	format string
+	magic  []byte
+}{
+	{Gzip, []byte{0x1f, 0x8b}},
+	{Bzip2, []byte("BZh")},
+	{Xz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{Zstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+// compressedExtensions are the file extensions of compressed nmon files
+var compressedExtensions = map[string]bool{
+	gzipfile: true,
+	".bz2":   true,
+	".xz":    true,
+	".zst":   true,
+	".zstd":  true,
+}
+
+// closerFunc allows to use a function as io.Closer
+type closerFunc func() error
+
+// Close calls the function
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// Compression returns the compression format found in the first bytes of reader or an empty string for plain text
+func Compression(reader *bufio.Reader) string {
+	header, _ := reader.Peek(6)
+	for _, magicNumber := range magicNumbers {
+		if bytes.HasPrefix(header, magicNumber.magic) {
+			return magicNumber.format
+		}
+	}
+	return ""
+}
+
+// Decompress returns a reader on the uncompressed content of reader. The compression is detected from the magic bytes.
+// The closer releases the decompressor resources. It doesn't close reader.
+func Decompress(reader io.Reader) (io.Reader, io.Closer, error) {
+	bufReader := bufio.NewReader(reader)
+	noop := closerFunc(func() error { return nil })
+
+	switch Compression(bufReader) {
+	case Gzip:
+		gr, err := gzip.NewReader(bufReader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gr, gr, nil
+	case Bzip2:
+		return bzip2.NewReader(bufReader), noop, nil
+	case Xz:
+		xr, err := xz.NewReader(bufReader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return xr, noop, nil
+	case Zstd:
+		zr, err := zstd.NewReader(bufReader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, closerFunc(func() error { zr.Close(); return nil }), nil
+	}
+	return bufReader, noop, nil
+}
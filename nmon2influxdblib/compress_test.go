@@ -0,0 +1,95 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const compressContent = "AAA,host,lpar1\n"
+
+// bzip2Content is compressContent compressed by bzip2: the standard library has no bzip2 writer
+var bzip2Content = []byte{
+	0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0xc2, 0x5d,
+	0x56, 0x3c, 0x00, 0x00, 0x03, 0x5d, 0x80, 0x00, 0x10, 0x00, 0x04, 0x20,
+	0x00, 0x20, 0x00, 0x20, 0x44, 0xdc, 0x00, 0x20, 0x00, 0x22, 0x00, 0x19,
+	0x04, 0x0d, 0x03, 0x41, 0xe3, 0x8b, 0xa4, 0x9b, 0x4d, 0x00, 0xf7, 0x8b,
+	0xb9, 0x22, 0x9c, 0x28, 0x48, 0x61, 0x2e, 0xab, 0x1e, 0x00,
+}
+
+// compressWith returns compressContent compressed by the writer returned by newWriter
+func compressWith(t *testing.T, newWriter func(w io.Writer) (io.WriteCloser, error)) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer, err := newWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write([]byte(compressContent)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		format  string
+	}{
+		{"plain", []byte(compressContent), ""},
+		{"gzip", compressWith(t, func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil }), Gzip},
+		{"bzip2", bzip2Content, Bzip2},
+		{"xz", compressWith(t, func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) }), Xz},
+		{"zstd", compressWith(t, func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) }), Zstd},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if format := Compression(bufio.NewReader(bytes.NewReader(test.content))); format != test.format {
+				t.Errorf("Compression() = %q, want %q", format, test.format)
+			}
+			reader, closer, err := Decompress(bytes.NewReader(test.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closer.Close()
+			content, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != compressContent {
+				t.Errorf("content = %q, want %q", content, compressContent)
+			}
+		})
+	}
+}
+
+func TestCompressionShortContent(t *testing.T) {
+	for _, content := range []string{"", "A", "BZ", "\x1f"} {
+		if format := Compression(bufio.NewReader(strings.NewReader(content))); format != "" {
+			t.Errorf("Compression(%q) = %q, want plain text", content, format)
+		}
+	}
+}
+
+func TestDecompressCorrupted(t *testing.T) {
+	// a gzip magic number followed by an invalid header
+	if _, _, err := Decompress(bytes.NewReader([]byte{0x1f, 0x8b, 0x00, 0x00})); err == nil {
+		t.Error("no error for a corrupted gzip header")
+	}
+}
@@ -6,11 +6,14 @@ package nmon2influxdblib
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/user"
 	"path/filepath"
+	"regexp"
+	"time"
 
 	"github.com/adejoux/influxdbclient"
 	"github.com/naoina/toml"
@@ -33,6 +36,11 @@ type Config struct {
 	InfluxdbSecure        bool
 	InfluxdbSkipCertCheck bool
 	InfluxdbDatabase      string
+	InfluxdbVersion       int
+	InfluxdbToken         string
+	InfluxdbOrg           string
+	InfluxdbWriteRetries  int
+	InfluxdbRetryDelay    int
 	GrafanaUser           string
 	GrafanaPassword       string
 	GrafanaURL            string `toml:"grafana_URL"`
@@ -51,10 +59,29 @@ type Config struct {
 	ImportAllCpus         bool
 	ImportBuildDashboard  bool
 	ImportForce           bool
+	ImportFollow          bool
+	ImportInventory       bool
+	ImportDryRun          bool   `toml:",omitempty"`
+	ImportReplace         bool   `toml:",omitempty"`
+	ImportReportFormat    string `toml:",omitempty"`
+	ImportName            string
 	ImportSkipMetrics     string
+	ImportSchema          string
 	ImportLogDatabase     string
 	ImportLogRetention    string
+	JournalDatabase       string
+	JournalRetention      string
+	ImportStateFile       string
+	ImportAnonymize       bool
+	ImportResample        string
+	ImportAggregation     string
+	ImportRawPrefix       string
+	ImportRawDatabase     string
+	AnonymizeMapping      string
 	ImportDataRetention   string
+	ImportJobs            int
+	ImportWriteRate       int
+	ImportProcessTags     string
 	ImportSSHUser         string `toml:"import_ssh_user"`
 	ImportSSHKey          string `toml:"import_ssh_key"`
 	DashboardWriteFile    bool
@@ -64,10 +91,17 @@ type Config struct {
 	StatsFrom             string
 	StatsTo               string
 	StatsHost             string
-	Metric                string `toml:"metric,omitempty"`
-	ListFilter            string `toml:",omitempty"`
-	ListHost              string `toml:",omitempty"`
-	Inputs                Inputs `toml:"input"`
+	Metric                string          `toml:"metric,omitempty"`
+	ListFilter            string          `toml:",omitempty"`
+	ListHost              string          `toml:",omitempty"`
+	OutputFile            string          `toml:",omitempty"`
+	RemoteWriteURL        string          `toml:"remote_write_url"`
+	RemoteWriteMetric     string          `toml:"remote_write_metric"`
+	Inputs                Inputs          `toml:"input"`
+	TimezoneRules         TimezoneRules   `toml:"timezone_rule"`
+	Calculations          Calculations    `toml:"calculated"`
+	ProcessPatterns       ProcessPatterns `toml:"process_pattern"`
+	ImportFileTimezones   []string        `toml:",omitempty"`
 }
 
 // Inputs allows to put multiple input in the configuration file
@@ -81,6 +115,18 @@ type Input struct {
 	Tags        Tags `toml:"tag"`
 }
 
+// ProcessPatterns allows to put multiple process patterns in the configuration file
+type ProcessPatterns []ProcessPattern
+
+// ProcessPattern adds a tag to the TOP points whose UARG command line matches the regular expression.
+// Value can use the submatches like $1.
+type ProcessPattern struct {
+	Tag    string
+	Match  string
+	Value  string
+	Regexp *regexp.Regexp `toml:",skip"`
+}
+
 // InitConfig setup initial configuration with sane values
 func InitConfig() Config {
 	currUser, _ := user.Current()
@@ -96,6 +142,9 @@ func InitConfig() Config {
 		InfluxdbDatabase:      "nmon_reports",
 		InfluxdbSecure:        false,
 		InfluxdbSkipCertCheck: false,
+		InfluxdbVersion:       1,
+		InfluxdbWriteRetries:  DefaultWriteRetries,
+		InfluxdbRetryDelay:    DefaultRetryDelay,
 		HMCUser:               "hscroot",
 		HMCPassword:           "abc123",
 		HMCDatabase:           "nmon2influxdbHMC",
@@ -110,18 +159,27 @@ func InitConfig() Config {
 		ImportAllCpus:         false,
 		ImportBuildDashboard:  false,
 		ImportForce:           false,
+		ImportInventory:       false,
 		ImportLogDatabase:     "nmon2influxdb_log",
 		ImportLogRetention:    "2d",
+		JournalDatabase:       "nmon2influxdb_journal",
+		JournalRetention:      "52w",
+		ImportJobs:            1,
+		ImportWriteRate:       0,
 		ImportSSHUser:         currUser.Username,
 		ImportSSHKey:          sshKey,
+		AnonymizeMapping:      filepath.Join(home, ".nmon2influxdb_mapping.json"),
 		DashboardWriteFile:    false,
 		ImportSkipMetrics:     "JFSINODE|TOP|PCPU",
+		ImportSchema:          "narrow",
+		ImportAggregation:     "mean",
 		StatsLimit:            20,
 		StatsSort:             "mean",
 		StatsFilter:           "",
 		StatsFrom:             "",
 		StatsTo:               "",
 		StatsHost:             "",
+		RemoteWriteMetric:     "nmon_{measurement}",
 	}
 }
 
@@ -152,52 +210,62 @@ func IsFile(file string) bool {
 }
 
 //BuildCfgFile creates a default configuration file
-func (config *Config) BuildCfgFile(cfgfile string) {
+func (config *Config) BuildCfgFile(cfgfile string) error {
 	file, err := os.Create(cfgfile)
-	CheckError(err)
+	if err != nil {
+		return &ConfigError{File: cfgfile, Err: err}
+	}
 	defer file.Close()
 	writer := bufio.NewWriter(file)
 	b, err := toml.Marshal(*config)
-	CheckError(err)
+	if err != nil {
+		return &ConfigError{File: cfgfile, Err: err}
+	}
 	r := bytes.NewReader(b)
 	r.WriteTo(writer)
-	writer.Flush()
+	if err := writer.Flush(); err != nil {
+		return &ConfigError{File: cfgfile, Err: err}
+	}
 	log.Printf("Generating default configuration file : %s\n", cfgfile)
+	return nil
 }
 
 // LoadCfgFile loads current configuration file settings
-func (config *Config) LoadCfgFile() (cfgfile string) {
+func (config *Config) LoadCfgFile() (cfgfile string, err error) {
 
 	cfgfile = GetCfgFile()
 
 	//it would be only if no conf file exists. And it will build a configuration file in the home directory
 	if !IsFile(cfgfile) {
-		config.BuildCfgFile(cfgfile)
+		if err = config.BuildCfgFile(cfgfile); err != nil {
+			return
+		}
 	}
 
-	file, err := os.Open(cfgfile)
-	if err != nil {
+	file, openErr := os.Open(cfgfile)
+	if openErr != nil {
 		log.Printf("Error opening configuration file %s\n", cfgfile)
 		return
 	}
 
 	defer file.Close()
-	buf, err := ioutil.ReadAll(file)
-	if err != nil {
-		CheckError(err)
+	buf, readErr := ioutil.ReadAll(file)
+	if readErr != nil {
+		return cfgfile, &ConfigError{File: cfgfile, Err: readErr}
 	}
 
-	if err := toml.Unmarshal(buf, &config); err != nil {
-		log.Printf("syntax error in configuration file: %s \n", err.Error())
-		os.Exit(1)
+	if syntaxErr := toml.Unmarshal(buf, &config); syntaxErr != nil {
+		return cfgfile, &ConfigError{File: cfgfile, Err: fmt.Errorf("syntax error: %w", syntaxErr)}
 	}
 	return
 }
 
 // AddDashboardParams initialize default parameters for dashboard
-func (config *Config) AddDashboardParams() {
+func (config *Config) AddDashboardParams() error {
 	dfltConfig := InitConfig()
-	dfltConfig.LoadCfgFile()
+	if _, err := dfltConfig.LoadCfgFile(); err != nil {
+		return err
+	}
 
 	config.GrafanaAccess = dfltConfig.GrafanaAccess
 	config.GrafanaURL = dfltConfig.GrafanaURL
@@ -205,13 +273,16 @@ func (config *Config) AddDashboardParams() {
 	config.GrafanaUser = dfltConfig.GrafanaUser
 	config.GrafanaPassword = dfltConfig.GrafanaPassword
 	config.DashboardWriteFile = dfltConfig.DashboardWriteFile
+	return nil
 }
 
 // ParseParameters parse parameter from command line in Config struct
-func ParseParameters(c *cli.Context) (config *Config) {
+func ParseParameters(c *cli.Context) (config *Config, err error) {
 	config = new(Config)
 	*config = InitConfig()
-	config.LoadCfgFile()
+	if _, err = config.LoadCfgFile(); err != nil {
+		return
+	}
 
 	config.Metric = c.String("metric")
 	config.StatsHost = c.String("statshost")
@@ -224,12 +295,37 @@ func ParseParameters(c *cli.Context) (config *Config) {
 		config.ImportAllCpus = c.Bool("cpus")
 	}
 	config.ImportBuildDashboard = c.Bool("build")
+	if c.IsSet("inventory") {
+		config.ImportInventory = c.Bool("inventory")
+	}
 	config.ImportSkipMetrics = c.String("skip_metrics")
+	config.ImportSchema = c.String("schema")
 	config.ImportLogDatabase = c.String("log_database")
 	config.ImportLogRetention = c.String("log_retention")
+	config.JournalDatabase = c.String("journal_database")
+	config.JournalRetention = c.String("journal_retention")
+	config.ImportStateFile = c.String("state_file")
+	if c.IsSet("anonymize") {
+		config.ImportAnonymize = c.Bool("anonymize")
+	}
+	config.AnonymizeMapping = c.String("mapping")
+	config.ImportResample = c.String("resample")
+	config.ImportAggregation = c.String("agg")
+	config.ImportRawPrefix = c.String("raw_prefix")
+	config.ImportRawDatabase = c.String("raw_database")
 	config.DashboardWriteFile = c.Bool("file")
 	config.ListFilter = c.String("filter")
 	config.ImportForce = c.Bool("force")
+	config.ImportFollow = c.Bool("follow")
+	config.ImportDryRun = c.Bool("dry-run")
+	config.ImportReplace = c.Bool("replace")
+	config.ImportReportFormat = c.String("format")
+	config.ImportName = c.String("name")
+	config.ImportFileTimezones = c.StringSlice("file_tz")
+	config.ImportJobs = c.Int("jobs")
+	config.ImportWriteRate = c.Int("rate")
+	config.OutputFile = c.String("output")
+	config.RemoteWriteURL = c.String("remote_write")
 	config.ListHost = c.String("host")
 	config.GrafanaUser = c.String("guser")
 	config.GrafanaPassword = c.String("gpassword")
@@ -260,7 +356,7 @@ func ParseParameters(c *cli.Context) (config *Config) {
 
 		debugFile, err := os.OpenFile(config.DebugFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
 		if err != nil {
-			log.Fatalf("error opening file: %v", err)
+			return config, fmt.Errorf("error opening debug file: %w", err)
 		}
 		// never closing the file here to be able to change the log output in all packages
 		// No better solution for now.
@@ -271,15 +367,23 @@ func ParseParameters(c *cli.Context) (config *Config) {
 	}
 
 	if config.ImportBuildDashboard {
-		config.AddDashboardParams()
+		err = config.AddDashboardParams()
 	}
 
 	return
 
 }
 
-// ConnectDB connect to the specified influxdb database
-func (config *Config) ConnectDB(db string) *influxdbclient.InfluxDB {
+// ConnectDB connect to the specified influxdb database. With InfluxDB 2.x and 3.x, db is the bucket name.
+func (config *Config) ConnectDB(db string) (DB, error) {
+	if config.InfluxdbVersion >= 2 {
+		influxdb, err := NewInfluxDBv2(config.InfluxdbURL(), config.InfluxdbToken, config.InfluxdbOrg, db, config.InfluxdbSkipCertCheck, config.Debug)
+		if err != nil {
+			return nil, &DBError{Database: db, Err: err}
+		}
+		return influxdb, nil
+	}
+
 	influxdbConfig := influxdbclient.InfluxDBConfig{
 		Host:          config.InfluxdbServer,
 		Port:          config.InfluxdbPort,
@@ -290,14 +394,50 @@ func (config *Config) ConnectDB(db string) *influxdbclient.InfluxDB {
 		Secure:        config.InfluxdbSecure,
 		SkipCertCheck: config.InfluxdbSkipCertCheck,
 	}
-	influxdb, err := influxdbclient.NewInfluxDB(influxdbConfig)
-	CheckError(err)
+	influxdb, err := NewInfluxDBv1(influxdbConfig, config.InfluxdbURL())
+	if err != nil {
+		return nil, &DBError{Database: db, Err: err}
+	}
+
+	return influxdb, nil
+}
+
+// NewRetryWriter returns a RetryWriter using the retry parameters
+func (config *Config) NewRetryWriter(writer PointWriter) *RetryWriter {
+	return NewRetryWriter(writer, config.InfluxdbWriteRetries, time.Duration(config.InfluxdbRetryDelay)*time.Second)
+}
+
+// NewRemoteWriter returns a Prometheus remote write client using the configuration parameters
+func (config *Config) NewRemoteWriter() *RemoteWriter {
+	return NewRemoteWriter(config.RemoteWriteURL, config.RemoteWriteMetric, config.InfluxdbSkipCertCheck)
+}
+
+// InfluxdbURL returns the InfluxDB server URL
+func (config *Config) InfluxdbURL() string {
+	scheme := "http"
+	if config.InfluxdbSecure {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%s", scheme, config.InfluxdbServer, config.InfluxdbPort)
+}
 
-	return &influxdb
+// connectBucket connects to a InfluxDB 2.x or 3.x bucket. The bucket is created with InfluxDB 2.x.
+// InfluxDB 3.x creates the database on the first write and has no retention policy to update.
+func (config *Config) connectBucket(bucket string, retention string) (DB, error) {
+	db, err := config.ConnectDB(bucket)
+	if err != nil {
+		return nil, err
+	}
+	if config.InfluxdbVersion == 2 {
+		if err := db.(*InfluxDBv2).EnsureBucket(retention); err != nil {
+			return nil, &DBError{Database: bucket, Err: err}
+		}
+	}
+	return db, nil
 }
 
 // GetDB create or get the influxdb database used for nmon data
-func (config *Config) GetDB(dbType string) *influxdbclient.InfluxDB {
+func (config *Config) GetDB(dbType string) (DB, error) {
 
 	db := config.InfluxdbDatabase
 	retention := config.ImportDataRetention
@@ -306,44 +446,83 @@ func (config *Config) GetDB(dbType string) *influxdbclient.InfluxDB {
 		db = config.HMCDatabase
 		retention = config.HMCDataRetention
 	}
+	// the raw points of the resampled imports keep the retention of their database
+	if dbType == "raw" {
+		db = config.ImportRawDatabase
+		retention = ""
+	}
 
-	influxdb := config.ConnectDB(db)
+	if config.InfluxdbVersion >= 2 {
+		return config.connectBucket(db, retention)
+	}
+
+	conn, err := config.ConnectDB(db)
+	if err != nil {
+		return nil, err
+	}
+	influxdb := conn.(*InfluxDBv1)
 
 	if exist, _ := influxdb.ExistDB(db); exist != true {
 		log.Printf("Creating InfluxDB database %s\n", db)
-		_, createErr := influxdb.CreateDB(db)
-		CheckError(createErr)
+		if _, createErr := influxdb.CreateDB(db); createErr != nil {
+			return nil, &DBError{Database: db, Err: createErr}
+		}
 	}
 
 	// update default retention policy if ImportDataRetention is set
 	if len(retention) > 0 {
 		// Get default retention policy name
 		policyName, policyErr := influxdb.GetDefaultRetentionPolicy()
-		CheckError(policyErr)
+		if policyErr != nil {
+			return nil, &DBError{Database: db, Err: policyErr}
+		}
 		log.Printf("Updating  %s retention policy to keep only the last %s days. Timestamp based.\n", policyName, retention)
-		_, err := influxdb.UpdateRetentionPolicy(policyName, retention, true)
-		CheckError(err)
+		if _, err := influxdb.UpdateRetentionPolicy(policyName, retention, true); err != nil {
+			return nil, &DBError{Database: db, Err: err}
+		}
 	}
-	return influxdb
+	return influxdb, nil
 }
 
 // GetLogDB create or get the influxdb database like defined in config
-func (config *Config) GetLogDB() *influxdbclient.InfluxDB {
+func (config *Config) GetLogDB() (DB, error) {
+	return config.getLogDB(config.ImportLogDatabase, config.ImportLogRetention, "log_retention")
+}
+
+// GetJournalDB create or get the influxdb database storing the import journal. It has its own retention.
+func (config *Config) GetJournalDB() (DB, error) {
+	return config.getLogDB(config.JournalDatabase, config.JournalRetention, "journal_retention")
+}
+
+// getLogDB create or get a database of the import log. A new database gets the retention policy named policy.
+func (config *Config) getLogDB(db string, retention string, policy string) (DB, error) {
+
+	if config.InfluxdbVersion >= 2 {
+		return config.connectBucket(db, retention)
+	}
 
-	influxdb := config.ConnectDB(config.ImportLogDatabase)
+	conn, err := config.ConnectDB(db)
+	if err != nil {
+		return nil, err
+	}
+	influxdb := conn.(*InfluxDBv1)
 
-	if exist, _ := influxdb.ExistDB(config.ImportLogDatabase); exist != true {
-		_, err := influxdb.CreateDB(config.ImportLogDatabase)
-		CheckError(err)
-		_, err = influxdb.SetRetentionPolicy("log_retention", config.ImportLogRetention, true)
-		CheckError(err)
+	if exist, _ := influxdb.ExistDB(db); exist != true {
+		_, err = influxdb.CreateDB(db)
+		if err == nil {
+			_, err = influxdb.SetRetentionPolicy(policy, retention, true)
+		}
 	} else {
-		logPolicyName, logPolicyErr := influxdb.GetDefaultRetentionPolicy()
-		CheckError(logPolicyErr)
-		_, err := influxdb.UpdateRetentionPolicy(logPolicyName, config.ImportLogRetention, true)
-		CheckError(err)
+		var logPolicyName string
+		logPolicyName, err = influxdb.GetDefaultRetentionPolicy()
+		if err == nil {
+			_, err = influxdb.UpdateRetentionPolicy(logPolicyName, retention, true)
+		}
+	}
+	if err != nil {
+		return nil, &DBError{Database: db, Err: err}
 	}
-	return influxdb
+	return influxdb, nil
 }
 
 // Sanitized returns a copy of the config struct without the password. Used for debug
@@ -355,5 +534,6 @@ func (config *Config) Sanitized() (debugConfig Config) {
 	debugConfig.GrafanaPassword = secretPassword
 	debugConfig.InfluxdbUser = secretUser
 	debugConfig.InfluxdbPassword = secretPassword
+	debugConfig.InfluxdbToken = secretPassword
 	return
 }
@@ -0,0 +1,79 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// DryRunWriter is a PointWriter counting the points and the series by measurement instead of writing them
+type DryRunWriter struct {
+	Measurements map[string]*MeasurementStats
+	First        time.Time
+	Last         time.Time
+	pending      int64
+}
+
+// MeasurementStats contains the number of points and series of a measurement
+type MeasurementStats struct {
+	Points int64
+	series map[string]bool
+}
+
+// NewDryRunWriter returns an empty DryRunWriter
+func NewDryRunWriter() *DryRunWriter {
+	return &DryRunWriter{Measurements: make(map[string]*MeasurementStats)}
+}
+
+// AddPoint counts the point and its series
+func (writer *DryRunWriter) AddPoint(measurement string, timestamp time.Time, fields map[string]interface{}, tags map[string]string) {
+	stats, ok := writer.Measurements[measurement]
+	if !ok {
+		stats = &MeasurementStats{series: make(map[string]bool)}
+		writer.Measurements[measurement] = stats
+	}
+	stats.Points++
+	stats.series[seriesKey(tags)] = true
+	writer.pending++
+
+	if writer.First.IsZero() || timestamp.Before(writer.First) {
+		writer.First = timestamp
+	}
+	if timestamp.After(writer.Last) {
+		writer.Last = timestamp
+	}
+}
+
+// seriesKey returns the sorted tags identifying a series in a measurement
+func seriesKey(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key, value := range tags {
+		keys = append(keys, key+"="+value)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// WritePoints does nothing: points are only counted
+func (writer *DryRunWriter) WritePoints() error {
+	return nil
+}
+
+// PointsCount returns the number of points added since the last ClearPoints
+func (writer *DryRunWriter) PointsCount() int64 {
+	return writer.pending
+}
+
+// ClearPoints resets the number of points returned by PointsCount. The statistics are kept.
+func (writer *DryRunWriter) ClearPoints() {
+	writer.pending = 0
+}
+
+// Series returns the number of series of the measurement
+func (stats *MeasurementStats) Series() int {
+	return len(stats.series)
+}
@@ -0,0 +1,84 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ConfigError is returned when the configuration file can't be read or written
+type ConfigError struct {
+	File string
+	Err  error
+}
+
+// Error returns the message of the error
+func (err *ConfigError) Error() string {
+	return fmt.Sprintf("configuration file %s: %s", err.File, err.Err)
+}
+
+// Unwrap returns the underlying error
+func (err *ConfigError) Unwrap() error {
+	return err.Err
+}
+
+// DBError is returned when a InfluxDB database or bucket can't be connected or prepared
+type DBError struct {
+	Database string
+	Err      error
+}
+
+// Error returns the message of the error
+func (err *DBError) Error() string {
+	return fmt.Sprintf("InfluxDB database %s: %s", err.Database, err.Err)
+}
+
+// Unwrap returns the underlying error
+func (err *DBError) Unwrap() error {
+	return err.Err
+}
+
+// FileError is returned when a nmon file or a directory can't be read
+type FileError struct {
+	File string
+	Err  error
+}
+
+// Error returns the message of the error
+func (err *FileError) Error() string {
+	return fmt.Sprintf("%s: %s", err.File, err.Err)
+}
+
+// Unwrap returns the underlying error
+func (err *FileError) Unwrap() error {
+	return err.Err
+}
+
+// newFileError returns a FileError. The file name isn't repeated for the errors of the os package.
+func newFileError(file string, err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return &FileError{File: file, Err: err}
+}
+
+// SSHError is returned when the SFTP session to a remote host can't be opened
+type SSHError struct {
+	Host string
+	Err  error
+}
+
+// Error returns the message of the error
+func (err *SSHError) Error() string {
+	return fmt.Sprintf("ssh %s: %s", err.Host, err.Err)
+}
+
+// Unwrap returns the underlying error
+func (err *SSHError) Unwrap() error {
+	return err.Err
+}
@@ -6,16 +6,15 @@ package nmon2influxdblib
 
 import (
 	"bufio"
-	"compress/gzip"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
@@ -36,6 +35,7 @@ const gzipfile = ".gz"
 // File structure used to select nmon files to import
 type File struct {
 	Name      string
+	Member    string
 	FileType  string
 	Host      string
 	SSHUser   string
@@ -43,117 +43,294 @@ type File struct {
 	checksum  string
 	Delimiter string
 	lines     []string
+	// position of a tar archive member in the uncompressed archive
+	offset int64
+	size   int64
+	// Reader is used instead of opening the file when the content is streamed
+	Reader io.Reader
 }
 
 // Files array of File
 type Files []File
 
-//Add a file in the NmonFIles structure
-func (nmonFiles *Files) Add(file string, fileType string) {
+//Add a file in the NmonFIles structure. The nmon files of tar and zip archives are added instead of the archive.
+func (nmonFiles *Files) Add(file string, fileType string) error {
+	if IsArchive(file) {
+		return nmonFiles.AddArchive(File{Name: file, FileType: fileType})
+	}
 	*nmonFiles = append(*nmonFiles, File{Name: file, FileType: fileType})
+	return nil
 }
 
-//AddRemote a remote file in the NmonFIles structure
-func (nmonFiles *Files) AddRemote(file string, fileType string, host string, user string, key string) {
+//AddRemote a remote file in the NmonFIles structure. The nmon files of tar and zip archives are added instead of the archive.
+func (nmonFiles *Files) AddRemote(file string, fileType string, host string, user string, key string) error {
+	if IsArchive(file) {
+		return nmonFiles.AddArchive(File{Name: file, FileType: fileType, Host: host, SSHUser: user, SSHKey: key})
+	}
 	*nmonFiles = append(*nmonFiles, File{Name: file, FileType: fileType, Host: host, SSHUser: user, SSHKey: key})
+	return nil
+}
+
+// Stdin is the file name used to read nmon data from the standard input
+const Stdin = "-"
+
+// AddStream adds nmon data read from stdin or a named pipe. The content can be compressed.
+func (nmonFiles *Files) AddStream(name string, reader io.Reader) {
+	*nmonFiles = append(*nmonFiles, File{Name: name, FileType: ".nmon", Reader: reader})
+}
+
+// NameStreams sets the name used in the import log for the streamed files
+func (nmonFiles Files) NameStreams(name string) {
+	for i := range nmonFiles {
+		if nmonFiles[i].Reader != nil {
+			nmonFiles[i].Name = name
+		}
+	}
+}
+
+// FullName returns the file name. Archive members are named archive:member.
+func (nmonFile *File) FullName() string {
+	if len(nmonFile.Member) > 0 {
+		return nmonFile.Name + ":" + strings.TrimPrefix(nmonFile.Member, "./")
+	}
+	return nmonFile.Name
+}
+
+// LogName returns the name used in the import log. Archive members are qualified with the archive name.
+func (nmonFile *File) LogName() string {
+	if len(nmonFile.Member) > 0 {
+		return path.Base(nmonFile.Name) + ":" + strings.TrimPrefix(nmonFile.Member, "./")
+	}
+	return path.Base(nmonFile.Name)
 }
 
-//Valid returns only valid fiels for nmon import
+// Source returns the location of the file: the absolute local path or host:path. Archive members are named archive:member.
+func (nmonFile *File) Source() string {
+	source := nmonFile.Name
+	if len(nmonFile.Host) > 0 {
+		source = nmonFile.Host + ":" + source
+	} else if nmonFile.Reader == nil {
+		if abs, err := filepath.Abs(source); err == nil {
+			source = abs
+		}
+	}
+	if len(nmonFile.Member) > 0 {
+		source += ":" + strings.TrimPrefix(nmonFile.Member, "./")
+	}
+	return source
+}
+
+//Valid returns only valid fiels for nmon import. The compression format is detected when the file is opened.
 func (nmonFiles *Files) Valid() (validFiles Files) {
 	for _, v := range *nmonFiles {
-		if v.FileType == ".nmon" || v.FileType == gzipfile {
+		if v.FileType == ".nmon" || compressedExtensions[v.FileType] {
 			validFiles = append(validFiles, v)
 		}
 	}
 	return validFiles
 }
 
-// FileScanner struct to manage
-type FileScanner struct {
-	*os.File
-	*bufio.Scanner
-}
+// maxLineSize is the maximum size of a nmon line. BBB and UARG lines can be very long.
+const maxLineSize = 1024 * 1024
 
-// RemoteFileScanner struct for remote files
-type RemoteFileScanner struct {
-	*sftp.File
+// LineScanner reads a nmon file line by line from any io.Reader.
+// The delimiter is detected on the first line.
+type LineScanner struct {
 	*bufio.Scanner
+	Delimiter string
+	line      string
+	closer    io.Closer
 }
 
-// GetRemoteScanner open an nmon file based on file extension and provides a bufio Scanner
-func (nmonFile *File) GetRemoteScanner() (*RemoteFileScanner, error) {
+// NewLineScanner returns a LineScanner reading from reader
+func NewLineScanner(reader io.Reader) *LineScanner {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	return &LineScanner{Scanner: scanner}
+}
 
-	sftpConn := InitSFTP(nmonFile.SSHUser, nmonFile.Host, nmonFile.SSHKey)
-	file, err := sftpConn.Open(nmonFile.Name)
-	if err != nil {
-		return nil, err
+// Scan advances to the next line. Decimal commas are replaced by dots in data lines if the delimiter is a semicolon.
+func (scanner *LineScanner) Scan() bool {
+	if !scanner.Scanner.Scan() {
+		return false
 	}
-
-	if nmonFile.FileType == gzipfile {
-		gr, err := gzip.NewReader(file)
-		if err != nil {
-			return nil, err
+	line := scanner.Scanner.Text()
+	if len(scanner.Delimiter) == 0 {
+		if delimiterRegexp.MatchString(line) {
+			matched := delimiterRegexp.FindStringSubmatch(line)
+			scanner.Delimiter = matched[1]
+		} else {
+			scanner.Delimiter = ","
 		}
-		reader := bufio.NewReader(gr)
-		return &RemoteFileScanner{file, bufio.NewScanner(reader)}, nil
 	}
 
-	reader := bufio.NewReader(file)
-	return &RemoteFileScanner{file, bufio.NewScanner(reader)}, nil
+	if scanner.Delimiter == ";" && statsRegexp.MatchString(line) {
+		line = strings.Replace(line, ",", ".", -1)
+	}
+	scanner.line = line
+	return true
 }
 
-//Checksum generates SHA1 file checksum
-func (nmonFile *File) Checksum() (fileHash string) {
-	if len(nmonFile.checksum) > 0 {
-		return nmonFile.checksum
+// Text returns the current line
+func (scanner *LineScanner) Text() string {
+	return scanner.line
+}
+
+// Close closes the underlying file if any
+func (scanner *LineScanner) Close() error {
+	if scanner.closer == nil {
+		return nil
 	}
-	var result []byte
-	if len(nmonFile.Host) > 0 {
-		scanner, err := nmonFile.GetRemoteScanner()
-		CheckError(err)
-		scanner.Seek(-1024, 2)
-		hash := sha1.New()
-		if _, err = io.Copy(hash, scanner); err != nil {
-			return
-		}
-		fileHash = hex.EncodeToString(hash.Sum(result))
-	} else {
-		scanner, err := nmonFile.GetScanner()
-		CheckError(err)
-		scanner.Seek(-1024, 2)
-		hash := sha1.New()
-		if _, err = io.Copy(hash, scanner); err != nil {
-			return
+	return scanner.closer.Close()
+}
+
+// readCloser closes all the readers used to access a file content
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+// Close closes the readers in reverse order
+func (rc *readCloser) Close() (err error) {
+	for i := len(rc.closers) - 1; i >= 0; i-- {
+		if closeErr := rc.closers[i].Close(); closeErr != nil {
+			err = closeErr
 		}
-		fileHash = hex.EncodeToString(hash.Sum(result))
 	}
-	nmonFile.checksum = fileHash
 	return
 }
 
-// GetScanner open an nmon file based on file extension and provides a bufio Scanner
-func (nmonFile *File) GetScanner() (*FileScanner, error) {
+// openRaw opens the local or remote file without decompressing it
+func (nmonFile *File) openRaw() (io.ReadSeeker, io.Closer, error) {
+	if len(nmonFile.Host) > 0 {
+		sftpConn, err := InitSFTP(nmonFile.SSHUser, nmonFile.Host, nmonFile.SSHKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		file, err := sftpConn.Open(nmonFile.Name)
+		if err != nil {
+			sftpConn.Close()
+			return nil, nil, newFileError(nmonFile.Host+":"+nmonFile.Name, err)
+		}
+		return file, &readCloser{closers: []io.Closer{sftpConn, file}}, nil
+	}
 
 	file, err := os.Open(nmonFile.Name)
+	if err != nil {
+		return nil, nil, newFileError(nmonFile.Name, err)
+	}
+	return file, file, nil
+}
+
+// Open returns a reader on the uncompressed content of a local or remote nmon file, or of an archive member.
+// gzip, bzip2, xz and zstd compressions are detected from the file content.
+func (nmonFile *File) Open() (io.ReadCloser, error) {
+	var raw io.Reader
+	var closer io.Closer
+	var err error
+	if len(nmonFile.Member) > 0 {
+		member, memberErr := nmonFile.openMember()
+		raw, closer, err = member, member, memberErr
+	} else {
+		raw, closer, err = nmonFile.openRaw()
+	}
 	if err != nil {
 		return nil, err
 	}
+	rc := &readCloser{closers: []io.Closer{closer}}
 
-	if nmonFile.FileType == gzipfile {
-		gr, err := gzip.NewReader(file)
+	reader, decompressor, err := Decompress(raw)
+	if err != nil {
+		rc.Close()
+		return nil, &FileError{File: nmonFile.FullName(), Err: err}
+	}
+	rc.Reader = reader
+	rc.closers = append(rc.closers, decompressor)
+	return rc, nil
+}
+
+// GetLineScanner returns a LineScanner on the nmon file content
+func (nmonFile *File) GetLineScanner() (*LineScanner, error) {
+	if nmonFile.Reader != nil {
+		reader, decompressor, err := Decompress(nmonFile.Reader)
 		if err != nil {
 			return nil, err
 		}
-		reader := bufio.NewReader(gr)
-		return &FileScanner{file, bufio.NewScanner(reader)}, nil
+		rc := &readCloser{Reader: reader, closers: []io.Closer{decompressor}}
+		if closer, ok := nmonFile.Reader.(io.Closer); ok && nmonFile.Reader != os.Stdin {
+			rc.closers = []io.Closer{closer, decompressor}
+		}
+		scanner := NewLineScanner(rc)
+		scanner.closer = rc
+		return scanner, nil
 	}
+	reader, err := nmonFile.Open()
+	if err != nil {
+		return nil, err
+	}
+	scanner := NewLineScanner(reader)
+	scanner.closer = reader
+	return scanner, nil
+}
 
-	reader := bufio.NewReader(file)
-	return &FileScanner{file, bufio.NewScanner(reader)}, nil
+// checksumSize is the number of bytes at the end of a file used to compute its checksum
+const checksumSize = 1024
+
+//Checksum generates SHA1 checksum of the last 1024 bytes of the file as it is stored, compressed or not.
+//Archive members are hashed the same way, over their content extracted from the archive: a file has the same checksum in and out of an archive.
+//The checksums of the archive members are computed when the archive is listed.
+func (nmonFile *File) Checksum() (fileHash string, err error) {
+	if len(nmonFile.checksum) > 0 {
+		return nmonFile.checksum, nil
+	}
+	if len(nmonFile.Member) > 0 {
+		member, memberErr := nmonFile.openMember()
+		if memberErr != nil {
+			return "", memberErr
+		}
+		defer member.Close()
+		tail := &tailWriter{size: checksumSize}
+		if _, err = io.Copy(tail, member); err != nil {
+			return "", &FileError{File: nmonFile.FullName(), Err: err}
+		}
+		nmonFile.checksum = hashTail(tail.tail)
+		return nmonFile.checksum, nil
+	}
+
+	file, closer, err := nmonFile.openRaw()
+	if err != nil {
+		return "", err
+	}
+	defer closer.Close()
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err == nil {
+		// small files are hashed from their beginning
+		offset := size - checksumSize
+		if offset < 0 {
+			offset = 0
+		}
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		return "", newFileError(nmonFile.Name, err)
+	}
+	tail, err := ioutil.ReadAll(file)
+	if err != nil {
+		return "", newFileError(nmonFile.Name, err)
+	}
+	nmonFile.checksum = hashTail(tail)
+	return nmonFile.checksum, nil
 }
 
-// Parse parameters
-func (nmonFiles *Files) Parse(args []string, sshUser string, key string) {
+// hashTail returns the SHA1 checksum of the last bytes of a file
+func hashTail(tail []byte) string {
+	hash := sha1.Sum(tail)
+	return hex.EncodeToString(hash[:])
+}
+
+// Parse parameters. The parameters which can't be read are skipped and their errors returned.
+func (nmonFiles *Files) Parse(args []string, sshUser string, key string) (errs []error) {
 	for _, param := range args {
 		if remoteFileRegexp.MatchString(param) {
 			matched := remoteFileRegexp.FindStringSubmatch(param)
@@ -166,53 +343,86 @@ func (nmonFiles *Files) Parse(args []string, sshUser string, key string) {
 			}
 			matchedParam := matched[2]
 
-			sftpConn := InitSFTP(sshUser, host, key)
+			sftpConn, err := InitSFTP(sshUser, host, key)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
 			paraminfo, err := sftpConn.Stat(matchedParam)
-			CheckError(err)
 			if err != nil {
-				if os.IsNotExist(err) {
-					fmt.Printf("%s doesn't exist ! skipped.\n", param)
-				}
+				sftpConn.Close()
+				errs = append(errs, newFileError(param, err))
 				continue
 			}
 			if paraminfo.IsDir() {
 				entries, err := sftpConn.ReadDir(matchedParam)
-				CheckError(err)
+				if err != nil {
+					sftpConn.Close()
+					errs = append(errs, newFileError(param, err))
+					continue
+				}
 				for _, entry := range entries {
 					if !entry.IsDir() {
 						file := path.Join(matchedParam, entry.Name())
-						nmonFiles.AddRemote(file, path.Ext(file), host, sshUser, key)
+						if err := nmonFiles.AddRemote(file, path.Ext(file), host, sshUser, key); err != nil {
+							errs = append(errs, err)
+						}
 					}
 				}
 				sftpConn.Close()
 				continue
 			}
-			nmonFiles.AddRemote(matchedParam, path.Ext(matchedParam), host, sshUser, key)
+			// the archive members are listed with their own connection
 			sftpConn.Close()
+			if err := nmonFiles.AddRemote(matchedParam, path.Ext(matchedParam), host, sshUser, key); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		if param == Stdin {
+			nmonFiles.AddStream(param, os.Stdin)
 			continue
 		}
 
 		paraminfo, err := os.Stat(param)
 		if err != nil {
-			if os.IsNotExist(err) {
-				fmt.Printf("%s doesn't exist ! skipped.\n", param)
+			errs = append(errs, newFileError(param, err))
+			continue
+		}
+
+		if paraminfo.Mode()&os.ModeNamedPipe != 0 {
+			// opening a named pipe waits for a writer
+			fifo, err := os.Open(param)
+			if err != nil {
+				errs = append(errs, newFileError(param, err))
+				continue
 			}
+			nmonFiles.AddStream(param, fifo)
 			continue
 		}
 
 		if paraminfo.IsDir() {
 			entries, err := ioutil.ReadDir(param)
-			CheckError(err)
+			if err != nil {
+				errs = append(errs, newFileError(param, err))
+				continue
+			}
 			for _, entry := range entries {
 				if !entry.IsDir() {
 					file := path.Join(param, entry.Name())
-					nmonFiles.Add(file, path.Ext(file))
+					if err := nmonFiles.Add(file, path.Ext(file)); err != nil {
+						errs = append(errs, err)
+					}
 				}
 			}
 			continue
 		}
-		nmonFiles.Add(param, path.Ext(param))
+		if err := nmonFiles.Add(param, path.Ext(param)); err != nil {
+			errs = append(errs, err)
+		}
 	}
+	return
 }
 
 //SSHConfig contains SSH parameters
@@ -222,13 +432,13 @@ type SSHConfig struct {
 }
 
 //InitSFTP init sftp session
-func InitSFTP(sshUser string, host string, key string) *sftp.Client {
+func InitSFTP(sshUser string, host string, key string) (*sftp.Client, error) {
 	var auths []ssh.AuthMethod
 
 	if IsFile(key) {
 		pemBytes, err := ioutil.ReadFile(key)
 		if err != nil {
-			log.Fatal(err)
+			return nil, &SSHError{Host: host, Err: err}
 		}
 		signer, err := ssh.ParsePrivateKey(pemBytes)
 
@@ -252,71 +462,40 @@ func InitSFTP(sshUser string, host string, key string) *sftp.Client {
 	sshhost := fmt.Sprintf("%s:22", host)
 	conn, err := ssh.Dial("tcp", sshhost, config)
 	if err != nil {
-		log.Fatalf("dial failed:%v", err)
+		return nil, &SSHError{Host: host, Err: fmt.Errorf("dial failed: %w", err)}
 	}
 
 	c, err := sftp.NewClient(conn)
 	if err != nil {
-		log.Fatalf("unable to start sftp subsytem: %v", err)
+		conn.Close()
+		return nil, &SSHError{Host: host, Err: fmt.Errorf("unable to start sftp subsystem: %w", err)}
 	}
-	return c
+	return c, nil
 }
 
-//Content returns the nmon files content sorted in an slice of string format
-func (nmonFile *File) Content() []string {
+//Content returns the nmon files content sorted in an slice of string format.
+//The whole file is loaded in memory: use GetLineScanner to read big files.
+func (nmonFile *File) Content() ([]string, error) {
 	if len(nmonFile.lines) > 0 {
-		return nmonFile.lines
+		return nmonFile.lines, nil
 	}
 
-	if len(nmonFile.Host) > 0 {
-		scanner, err := nmonFile.GetRemoteScanner()
-		CheckError(err)
-		scanner.Split(bufio.ScanLines)
-		first := true
-		for scanner.Scan() {
-			line := scanner.Text()
-			if first {
-				if delimiterRegexp.MatchString(line) {
-					matched := delimiterRegexp.FindStringSubmatch(line)
-					nmonFile.Delimiter = matched[1]
-				} else {
-					nmonFile.Delimiter = ","
-				}
-				first = false
-			}
-
-			if nmonFile.Delimiter == ";" {
-				line = strings.Replace(line, ",", ".", -1)
-			}
-			nmonFile.lines = append(nmonFile.lines, line)
-		}
-		scanner.Close()
-	} else {
-		scanner, err := nmonFile.GetScanner()
-		CheckError(err)
-		scanner.Split(bufio.ScanLines)
-		first := true
-		for scanner.Scan() {
-			line := scanner.Text()
-			if first {
-				if delimiterRegexp.MatchString(line) {
-					matched := delimiterRegexp.FindStringSubmatch(line)
-					nmonFile.Delimiter = matched[1]
-				} else {
-					nmonFile.Delimiter = ","
-				}
-				first = false
-			}
-
-			if statsRegexp.MatchString(line) && nmonFile.Delimiter == ";" {
-				line = strings.Replace(line, ",", ".", -1)
-			}
-			nmonFile.lines = append(nmonFile.lines, line)
-		}
-		scanner.Close()
+	scanner, err := nmonFile.GetLineScanner()
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	scanner.Close()
+	if err := scanner.Err(); err != nil {
+		return nil, &FileError{File: nmonFile.FullName(), Err: err}
 	}
+	nmonFile.lines = lines
+	nmonFile.Delimiter = scanner.Delimiter
 
 	sort.Strings(nmonFile.lines)
 
-	return nmonFile.lines
+	return nmonFile.lines, nil
 }
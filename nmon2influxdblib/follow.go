@@ -0,0 +1,176 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// FollowInterval is the delay between two checks for new data in a followed file
+const FollowInterval = time.Second
+
+// FollowReader reads a nmon file while it's recorded. At the end of the file, it waits for new data instead of returning io.EOF.
+// The file is reopened when it's truncated or replaced. If a directory is followed, the reader switches to the newest nmon file of the directory.
+type FollowReader struct {
+	Name     string
+	Dir      string
+	Interval time.Duration
+	// Idle is called each time the reader waits for new data. The reading ends if it returns false.
+	Idle func() bool
+	// Rotated is called with the name of the new file when the reader switches to another file, before reading it
+	Rotated func(name string)
+	// Stop ends the reading
+	Stop    <-chan struct{}
+	file    *os.File
+	info    os.FileInfo
+	offset  int64
+	newline bool
+}
+
+// NewFollowReader opens the file to follow. If name is a directory, the newest nmon file of the directory is followed.
+func NewFollowReader(name string) (*FollowReader, error) {
+	follower := &FollowReader{Name: name, Interval: FollowInterval}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		follower.Dir = name
+		follower.Name, err = newestNmonFile(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return follower, follower.open(follower.Name)
+}
+
+// newestNmonFile returns the last modified nmon file of the directory
+func newestNmonFile(dir string) (string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var newest os.FileInfo
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".nmon" {
+			continue
+		}
+		if newest == nil || entry.ModTime().After(newest.ModTime()) {
+			newest = entry
+		}
+	}
+	if newest == nil {
+		return "", os.ErrNotExist
+	}
+	return path.Join(dir, newest.Name()), nil
+}
+
+// open starts reading the file from the beginning
+func (follower *FollowReader) open(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if follower.file != nil {
+		follower.file.Close()
+		// the last line of the previous file may be incomplete
+		follower.newline = true
+	}
+	follower.Name = name
+	follower.file = file
+	follower.info = info
+	follower.offset = 0
+	return nil
+}
+
+// Read reads the file and waits for new data at the end of the file
+func (follower *FollowReader) Read(p []byte) (int, error) {
+	for {
+		if follower.newline && len(p) > 0 {
+			follower.newline = false
+			p[0] = '\n'
+			return 1, nil
+		}
+
+		n, err := follower.file.Read(p)
+		follower.offset += int64(n)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		if follower.rotate() {
+			continue
+		}
+
+		if follower.Idle != nil && !follower.Idle() {
+			return 0, io.EOF
+		}
+		select {
+		case <-follower.Stop:
+			return 0, io.EOF
+		case <-time.After(follower.Interval):
+		}
+	}
+}
+
+// rotate reopens the file if it was truncated or replaced, or switches to a newer file of the followed directory.
+// It returns true if a file was reopened.
+func (follower *FollowReader) rotate() bool {
+	name := follower.Name
+	if len(follower.Dir) > 0 {
+		if newest, err := newestNmonFile(follower.Dir); err == nil {
+			name = newest
+		}
+	}
+
+	info, err := os.Stat(name)
+	if err != nil {
+		// the file is being replaced
+		return false
+	}
+
+	if name != follower.Name || !os.SameFile(info, follower.info) {
+		log.Printf("following new file %s\n", name)
+		if err := follower.open(name); err != nil {
+			log.Printf("unable to open %s: %s\n", name, err)
+			return false
+		}
+		if follower.Rotated != nil {
+			follower.Rotated(name)
+		}
+		return true
+	}
+
+	if info.Size() < follower.offset {
+		log.Printf("file %s truncated\n", name)
+		if _, err := follower.file.Seek(0, io.SeekStart); err != nil {
+			return false
+		}
+		follower.offset = 0
+		follower.newline = true
+		return true
+	}
+	return false
+}
+
+// Close closes the followed file
+func (follower *FollowReader) Close() error {
+	return follower.file.Close()
+}
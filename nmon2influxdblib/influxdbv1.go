@@ -0,0 +1,170 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adejoux/influxdbclient"
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+// InfluxDBv1 is the InfluxDB 1.x client. It adds raw InfluxQL queries to influxdbclient.InfluxDB.
+// Points are written with the /write endpoint to get the HTTP status of the errors.
+type InfluxDBv1 struct {
+	*influxdbclient.InfluxDB
+	name       string
+	client     client.Client
+	url        string
+	user       string
+	password   string
+	httpClient *http.Client
+	lines      []string
+	precision  string
+}
+
+// NewInfluxDBv1 initialize a InfluxDBv1 structure
+func NewInfluxDBv1(cfg influxdbclient.InfluxDBConfig, url string) (*InfluxDBv1, error) {
+	influxdb, err := influxdbclient.NewInfluxDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	queryClient, err := client.NewHTTPClient(client.HTTPConfig{
+		Addr:               url,
+		Username:           cfg.User,
+		Password:           cfg.Pass,
+		InsecureSkipVerify: cfg.SkipCertCheck,
+	})
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: cfg.SkipCertCheck},
+	}
+	return &InfluxDBv1{
+		InfluxDB:   &influxdb,
+		name:       cfg.Database,
+		client:     queryClient,
+		url:        strings.TrimRight(url, "/"),
+		user:       cfg.User,
+		password:   cfg.Pass,
+		httpClient: &http.Client{Transport: transport, Timeout: 5 * time.Minute},
+		precision:  LinePrecision,
+	}, nil
+}
+
+// AddPoint adds a point to the batch
+func (db *InfluxDBv1) AddPoint(measurement string, timestamp time.Time, fields map[string]interface{}, tags map[string]string) {
+	line, err := formatLine(measurement, timestamp, fields, tags, db.precision)
+	if err != nil {
+		log.Println("Error: ", err.Error())
+		return
+	}
+	db.lines = append(db.lines, line)
+}
+
+// WritePoints sends the batch to the database
+func (db *InfluxDBv1) WritePoints() error {
+	if len(db.lines) == 0 {
+		return nil
+	}
+	params := url.Values{}
+	params.Set("db", db.name)
+	params.Set("precision", db.precision)
+	req, err := http.NewRequest("POST", db.url+"/write?"+params.Encode(), strings.NewReader(strings.Join(db.lines, "\n")))
+	if err != nil {
+		return err
+	}
+	if len(db.user) > 0 {
+		req.SetBasicAuth(db.user, db.password)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	resp, err := db.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp, "InfluxDB write "+db.name)
+}
+
+// SetPrecision sets the precision of the timestamps written, like s or ns. The default is LinePrecision.
+func (db *InfluxDBv1) SetPrecision(precision string) {
+	db.precision = precision
+}
+
+// PointsCount returns the number of points in the batch
+func (db *InfluxDBv1) PointsCount() int64 {
+	return int64(len(db.lines))
+}
+
+// ClearPoints empties the batch
+func (db *InfluxDBv1) ClearPoints() {
+	db.lines = db.lines[:0]
+}
+
+// Query performs a InfluxQL query on the database
+func (db *InfluxDBv1) Query(cmd string) (res []client.Result, err error) {
+	if db.Debug {
+		log.Printf("query: %s\n", cmd)
+	}
+	response, err := db.client.Query(client.NewQuery(cmd, db.name, ""))
+	if err != nil {
+		return
+	}
+	if response.Error() != nil {
+		return res, response.Error()
+	}
+	return response.Results, nil
+}
+
+// Delete removes the points of the measurement matching the tags between from and to.
+// An empty measurement selects all the measurements and a zero time is not a limit.
+func (db *InfluxDBv1) Delete(measurement string, tags map[string]string, from time.Time, to time.Time) error {
+	_, err := db.Query(deleteQuery(measurement, tags, from, to))
+	return err
+}
+
+// deleteQuery returns the InfluxQL DELETE query of Delete
+func deleteQuery(measurement string, tags map[string]string, from time.Time, to time.Time) string {
+	var conditions []string
+	for key, value := range tags {
+		conditions = append(conditions, fmt.Sprintf("%s=%s", quoteIdentifier(key), quoteString(value)))
+	}
+	sort.Strings(conditions)
+	if !from.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("time >= '%s'", from.UTC().Format(time.RFC3339)))
+	}
+	if !to.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("time <= '%s'", to.UTC().Format(time.RFC3339)))
+	}
+
+	cmd := "DELETE"
+	if len(measurement) > 0 {
+		cmd += " FROM " + quoteIdentifier(measurement)
+	}
+	if len(conditions) > 0 {
+		cmd += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	return cmd
+}
+
+// quoteIdentifier returns a measurement or a tag key between double quotes for InfluxQL queries
+func quoteIdentifier(identifier string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(identifier) + `"`
+}
+
+// quoteString returns a tag value between single quotes for InfluxQL queries
+func quoteString(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(value) + "'"
+}
@@ -0,0 +1,38 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeleteQuery(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		measurement string
+		tags        map[string]string
+		from        time.Time
+		to          time.Time
+		want        string
+	}{
+		{"host", "", map[string]string{"host": "lpar1"}, time.Time{}, time.Time{}, `DELETE WHERE "host"='lpar1'`},
+		{"measurement and time frame", "CPU_ALL", map[string]string{"host": "lpar1"}, from, to,
+			`DELETE FROM "CPU_ALL" WHERE "host"='lpar1' AND time >= '2020-01-01T00:00:00Z' AND time <= '2020-01-02T00:00:00Z'`},
+		{"sorted tags", "timestamp", map[string]string{"source": "", "file": "lpar1.nmon"}, time.Time{}, time.Time{},
+			`DELETE FROM "timestamp" WHERE "file"='lpar1.nmon' AND "source"=''`},
+		{"quoted", `my"measurement`, map[string]string{`my"key`: `o'brien\`}, time.Time{}, time.Time{},
+			`DELETE FROM "my\"measurement" WHERE "my\"key"='o\'brien\\'`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := deleteQuery(test.measurement, test.tags, test.from, test.to); got != test.want {
+				t.Errorf("deleteQuery() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,378 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adejoux/influxdbclient"
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+var durationRegexp = regexp.MustCompile(`(\d+)(w|d|h|m|s)`)
+
+// InfluxDBv2 is a client for InfluxDB 2.x and 3.x.
+// Points are written with the /api/v2/write endpoint and read with InfluxQL queries on the v1 compatibility API.
+type InfluxDBv2 struct {
+	URL       string
+	Token     string
+	Org       string
+	Bucket    string
+	Debug     bool
+	client    *http.Client
+	lines     []string
+	precision string
+}
+
+// NewInfluxDBv2 initialize a InfluxDBv2 structure and check the server is reachable
+func NewInfluxDBv2(serverURL string, token string, org string, bucket string, skipCertCheck bool, debug bool) (*InfluxDBv2, error) {
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: skipCertCheck},
+	}
+	db := &InfluxDBv2{
+		URL:       strings.TrimRight(serverURL, "/"),
+		Token:     token,
+		Org:       org,
+		Bucket:    bucket,
+		Debug:     debug,
+		client:    &http.Client{Transport: transport, Timeout: 5 * time.Minute},
+		precision: LinePrecision,
+	}
+
+	_, err := db.request("GET", "/ping", nil, nil, "")
+	return db, err
+}
+
+// request sends a HTTP request to InfluxDB and returns the response body
+func (db *InfluxDBv2) request(method string, path string, params url.Values, body io.Reader, contentType string) ([]byte, error) {
+	reqURL := db.URL + path
+	if len(params) > 0 {
+		reqURL += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(method, reqURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(db.Token) > 0 {
+		req.Header.Set("Authorization", "Token "+db.Token)
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := db.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return contents, &HTTPError{StatusCode: resp.StatusCode, Message: fmt.Sprintf("InfluxDB %s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(contents)))}
+	}
+	return contents, nil
+}
+
+// AddPoint adds a point to the batch
+func (db *InfluxDBv2) AddPoint(measurement string, timestamp time.Time, fields map[string]interface{}, tags map[string]string) {
+	line, err := formatLine(measurement, timestamp, fields, tags, db.precision)
+	if err != nil {
+		log.Println("Error: ", err.Error())
+		return
+	}
+	db.lines = append(db.lines, line)
+}
+
+// WritePoints sends the batch to the bucket
+func (db *InfluxDBv2) WritePoints() error {
+	if len(db.lines) == 0 {
+		return nil
+	}
+	params := url.Values{}
+	params.Set("bucket", db.Bucket)
+	params.Set("precision", db.precision)
+	if len(db.Org) > 0 {
+		params.Set("org", db.Org)
+	}
+	body := strings.NewReader(strings.Join(db.lines, "\n"))
+	_, err := db.request("POST", "/api/v2/write", params, body, "text/plain; charset=utf-8")
+	return err
+}
+
+// SetPrecision sets the precision of the timestamps written, like s or ns. The default is LinePrecision.
+func (db *InfluxDBv2) SetPrecision(precision string) {
+	db.precision = precision
+}
+
+// PointsCount returns the number of points in the batch
+func (db *InfluxDBv2) PointsCount() int64 {
+	return int64(len(db.lines))
+}
+
+// ClearPoints empties the batch
+func (db *InfluxDBv2) ClearPoints() {
+	db.lines = db.lines[:0]
+}
+
+// Query performs a InfluxQL query on the bucket
+func (db *InfluxDBv2) Query(cmd string) (res []client.Result, err error) {
+	if db.Debug {
+		log.Printf("query: %s\n", cmd)
+	}
+	params := url.Values{}
+	params.Set("db", db.Bucket)
+	params.Set("q", cmd)
+	contents, err := db.request("GET", "/query", params, nil, "")
+	if err != nil {
+		return
+	}
+
+	var response client.Response
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	dec.UseNumber()
+	if err = dec.Decode(&response); err != nil {
+		return
+	}
+	if response.Error() != nil {
+		return res, response.Error()
+	}
+	return response.Results, nil
+}
+
+// ReadPoints perform a query on measurements and return points inside a dataset
+func (db *InfluxDBv2) ReadPoints(fields string, filters *influxdbclient.Filters, groupby string, serie string, from string, to string, function string) (ds []*influxdbclient.DataSet, err error) {
+	var cmd string
+	if len(function) > 0 {
+		cmd = fmt.Sprintf("SELECT %s(\"%s\") FROM \"%s\"", function, fields, serie)
+	} else {
+		cmd = fmt.Sprintf("SELECT \"%s\" FROM \"%s\"", fields, serie)
+	}
+
+	var filterQuery influxdbclient.FilterQuery
+	if len(from) > 0 {
+		filterQuery.Append(fmt.Sprintf("time > '%s'", from))
+	}
+	if len(to) > 0 {
+		filterQuery.Append(fmt.Sprintf("time < '%s'", to))
+	}
+	if len(*filters) > 0 {
+		filterQuery.AddFilters(filters)
+	}
+	if len(filterQuery.Content) > 0 {
+		cmd += " WHERE " + filterQuery.Content
+	}
+	if len(groupby) > 0 {
+		cmd += fmt.Sprintf(" GROUP BY \"%s\"", groupby)
+	}
+
+	res, err := db.Query(cmd)
+	if err != nil || len(res) == 0 {
+		return
+	}
+	ds = influxdbclient.ConvertToDataSet(res)
+	return
+}
+
+// ReadLastPoint perform a query on measurements and return the last point as string
+func (db *InfluxDBv2) ReadLastPoint(fields string, filters *influxdbclient.Filters, serie string) (result string, err error) {
+	cmd := fmt.Sprintf("SELECT last(\"%s\") FROM \"%s\"", fields, serie)
+	if len(*filters) > 0 {
+		var filterQuery influxdbclient.FilterQuery
+		filterQuery.AddFilters(filters)
+		cmd += fmt.Sprintf(" WHERE %s", filterQuery.Content)
+	}
+
+	res, err := db.Query(cmd)
+	if err != nil {
+		return
+	}
+	if len(res) == 0 || len(res[0].Series) == 0 {
+		return
+	}
+	result, _ = res[0].Series[0].Values[0][1].(string)
+	return
+}
+
+// ListMeasurement returns all measurements inside a TextSet
+func (db *InfluxDBv2) ListMeasurement(filters *influxdbclient.Filters) (tset *influxdbclient.TextSet, err error) {
+	cmd := "SHOW MEASUREMENTS"
+	if len(*filters) > 0 {
+		var filterQuery influxdbclient.FilterQuery
+		filterQuery.AddFilters(filters)
+		cmd += " WHERE " + filterQuery.Content
+	}
+
+	res, err := db.Query(cmd)
+	if err != nil {
+		return
+	}
+	return influxdbclient.ConvertToTextSet(res), nil
+}
+
+// Delete removes the points of the measurement matching the tags between from and to with the /api/v2/delete API.
+// An empty measurement selects all the measurements and a zero time is not a limit. Not available with InfluxDB 3.x.
+func (db *InfluxDBv2) Delete(measurement string, tags map[string]string, from time.Time, to time.Time) error {
+	if from.IsZero() {
+		from = time.Unix(0, 0)
+	}
+	if to.IsZero() {
+		to = time.Unix(0, math.MaxInt64)
+	}
+
+	params := url.Values{}
+	params.Set("bucket", db.Bucket)
+	if len(db.Org) > 0 {
+		params.Set("org", db.Org)
+	}
+	body, _ := json.Marshal(map[string]string{
+		"start":     from.UTC().Format(time.RFC3339Nano),
+		"stop":      to.UTC().Format(time.RFC3339Nano),
+		"predicate": deletePredicate(measurement, tags),
+	})
+	_, err := db.request("POST", "/api/v2/delete", params, bytes.NewReader(body), "application/json")
+	return err
+}
+
+// deletePredicate returns the predicate of Delete. The tag keys and values are quoted like the measurement.
+func deletePredicate(measurement string, tags map[string]string) string {
+	var conditions []string
+	if len(measurement) > 0 {
+		conditions = append(conditions, "_measurement="+quoteIdentifier(measurement))
+	}
+	var keys []string
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		conditions = append(conditions, quoteIdentifier(key)+"="+quoteIdentifier(tags[key]))
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+type bucketRetentionRule struct {
+	Type         string `json:"type"`
+	EverySeconds int64  `json:"everySeconds"`
+}
+
+type bucket struct {
+	ID             string                `json:"id,omitempty"`
+	OrgID          string                `json:"orgID,omitempty"`
+	Name           string                `json:"name"`
+	RetentionRules []bucketRetentionRule `json:"retentionRules"`
+}
+
+// orgID returns the identifier of the organization
+func (db *InfluxDBv2) orgID() (string, error) {
+	params := url.Values{}
+	params.Set("org", db.Org)
+	contents, err := db.request("GET", "/api/v2/orgs", params, nil, "")
+	if err != nil {
+		return "", err
+	}
+	var orgs struct {
+		Orgs []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"orgs"`
+	}
+	if err := json.Unmarshal(contents, &orgs); err != nil {
+		return "", err
+	}
+	for _, org := range orgs.Orgs {
+		if org.Name == db.Org {
+			return org.ID, nil
+		}
+	}
+	return "", fmt.Errorf("InfluxDB organization %s not found", db.Org)
+}
+
+// EnsureBucket creates the bucket if it doesn't exist and updates its retention.
+// An empty retention keeps the current bucket retention. Only used with InfluxDB 2.x.
+func (db *InfluxDBv2) EnsureBucket(retention string) error {
+	orgID, err := db.orgID()
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("orgID", orgID)
+	params.Set("name", db.Bucket)
+	contents, err := db.request("GET", "/api/v2/buckets", params, nil, "")
+	if err != nil {
+		return err
+	}
+	var buckets struct {
+		Buckets []bucket `json:"buckets"`
+	}
+	if err := json.Unmarshal(contents, &buckets); err != nil {
+		return err
+	}
+
+	var rules []bucketRetentionRule
+	if len(retention) > 0 {
+		seconds, err := ParseRetention(retention)
+		if err != nil {
+			return err
+		}
+		rules = []bucketRetentionRule{{Type: "expire", EverySeconds: seconds}}
+		if seconds == 0 {
+			rules = []bucketRetentionRule{}
+		}
+	}
+
+	if len(buckets.Buckets) == 0 {
+		log.Printf("Creating InfluxDB bucket %s\n", db.Bucket)
+		if rules == nil {
+			rules = []bucketRetentionRule{}
+		}
+		body, _ := json.Marshal(bucket{OrgID: orgID, Name: db.Bucket, RetentionRules: rules})
+		_, err = db.request("POST", "/api/v2/buckets", nil, bytes.NewReader(body), "application/json")
+		return err
+	}
+
+	if rules == nil {
+		return nil
+	}
+	log.Printf("Updating %s bucket retention to %s\n", db.Bucket, retention)
+	body, _ := json.Marshal(bucket{Name: db.Bucket, RetentionRules: rules})
+	_, err = db.request("PATCH", "/api/v2/buckets/"+buckets.Buckets[0].ID, nil, bytes.NewReader(body), "application/json")
+	return err
+}
+
+// ParseRetention converts a InfluxQL duration like 2d or 1w12h in seconds. INF means no expiration and returns 0.
+func ParseRetention(retention string) (seconds int64, err error) {
+	if strings.ToUpper(retention) == "INF" {
+		return 0, nil
+	}
+	units := map[string]int64{"w": 7 * 86400, "d": 86400, "h": 3600, "m": 60, "s": 1}
+	matches := durationRegexp.FindAllStringSubmatch(retention, -1)
+	if len(matches) == 0 || len(durationRegexp.ReplaceAllString(retention, "")) > 0 {
+		return 0, fmt.Errorf("invalid retention duration: %s", retention)
+	}
+	for _, match := range matches {
+		value, _ := strconv.ParseInt(match[1], 10, 64)
+		seconds += value * units[match[2]]
+	}
+	return
+}
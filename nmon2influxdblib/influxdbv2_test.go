@@ -0,0 +1,28 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import "testing"
+
+func TestDeletePredicate(t *testing.T) {
+	tests := []struct {
+		name        string
+		measurement string
+		tags        map[string]string
+		want        string
+	}{
+		{"host", "", map[string]string{"host": "lpar1"}, `"host"="lpar1"`},
+		{"measurement", "CPU_ALL", map[string]string{"host": "lpar1"}, `_measurement="CPU_ALL" AND "host"="lpar1"`},
+		{"sorted tags", "timestamp", map[string]string{"source": "", "file": "lpar1.nmon"}, `_measurement="timestamp" AND "file"="lpar1.nmon" AND "source"=""`},
+		{"quoted", `my"measurement`, map[string]string{`my"key`: `a"b\`}, `_measurement="my\"measurement" AND "my\"key"="a\"b\\"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := deletePredicate(test.measurement, test.tags); got != test.want {
+				t.Errorf("deletePredicate() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
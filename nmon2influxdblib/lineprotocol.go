@@ -0,0 +1,132 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+// LinePrecision is the timestamp precision used for the points. Same as the InfluxDB client batches.
+const LinePrecision = "s"
+
+// FormatLine returns the point in InfluxDB line protocol
+func FormatLine(measurement string, timestamp time.Time, fields map[string]interface{}, tags map[string]string) (string, error) {
+	return formatLine(measurement, timestamp, fields, tags, LinePrecision)
+}
+
+// formatLine returns the point in InfluxDB line protocol with a timestamp of the given precision
+func formatLine(measurement string, timestamp time.Time, fields map[string]interface{}, tags map[string]string, precision string) (string, error) {
+	point, err := client.NewPoint(measurement, tags, fields, timestamp)
+	if err != nil {
+		return "", err
+	}
+	return point.PrecisionString(precision), nil
+}
+
+// LineProtocolFile writes points in InfluxDB line protocol. The file is gzipped if its name ends with .gz
+type LineProtocolFile struct {
+	mu      sync.Mutex
+	file    *os.File
+	gzip    *gzip.Writer
+	writer  *bufio.Writer
+	Name    string
+	written int64
+}
+
+// CreateLineProtocolFile creates the output file
+func CreateLineProtocolFile(name string) (*LineProtocolFile, error) {
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	lpFile := &LineProtocolFile{file: file, Name: name}
+
+	var writer io.Writer = file
+	if strings.HasSuffix(name, gzipfile) {
+		lpFile.gzip = gzip.NewWriter(file)
+		writer = lpFile.gzip
+	}
+	lpFile.writer = bufio.NewWriter(writer)
+	return lpFile, nil
+}
+
+// NewWriter returns a PointWriter buffering points before writing them in the file.
+// Each concurrent import needs its own writer.
+func (lpFile *LineProtocolFile) NewWriter() *FileWriter {
+	return &FileWriter{file: lpFile}
+}
+
+// WriteLines appends lines to the file
+func (lpFile *LineProtocolFile) WriteLines(lines []string) error {
+	lpFile.mu.Lock()
+	defer lpFile.mu.Unlock()
+	for _, line := range lines {
+		if _, err := lpFile.writer.WriteString(line + "\n"); err != nil {
+			return err
+		}
+	}
+	lpFile.written += int64(len(lines))
+	return nil
+}
+
+// Close flushes the buffers and closes the file. It returns a FileError.
+func (lpFile *LineProtocolFile) Close() error {
+	lpFile.mu.Lock()
+	defer lpFile.mu.Unlock()
+	err := lpFile.writer.Flush()
+	if lpFile.gzip != nil {
+		if gzErr := lpFile.gzip.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if closeErr := lpFile.file.Close(); err == nil {
+		err = closeErr
+	}
+	log.Printf("%d points written in %s\n", lpFile.written, lpFile.Name)
+	if err != nil {
+		return newFileError(lpFile.Name, err)
+	}
+	return nil
+}
+
+// FileWriter is a PointWriter storing points in a LineProtocolFile
+type FileWriter struct {
+	file  *LineProtocolFile
+	lines []string
+}
+
+// AddPoint converts the point in line protocol and buffers it
+func (writer *FileWriter) AddPoint(measurement string, timestamp time.Time, fields map[string]interface{}, tags map[string]string) {
+	line, err := FormatLine(measurement, timestamp, fields, tags)
+	if err != nil {
+		log.Println("Error: ", err.Error())
+		return
+	}
+	writer.lines = append(writer.lines, line)
+}
+
+// WritePoints writes the buffered points in the file
+func (writer *FileWriter) WritePoints() error {
+	return writer.file.WriteLines(writer.lines)
+}
+
+// PointsCount returns the number of buffered points
+func (writer *FileWriter) PointsCount() int64 {
+	return int64(len(writer.lines))
+}
+
+// ClearPoints empties the buffer
+func (writer *FileWriter) ClearPoints() {
+	writer.lines = writer.lines[:0]
+}
@@ -0,0 +1,137 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// kinds of identifiers replaced by pseudonyms
+const (
+	HostIdentifier   = "host"
+	SerialIdentifier = "serial"
+	IPIdentifier     = "ip"
+	IPv6Identifier   = "ipv6"
+	MACIdentifier    = "mac"
+	UserIdentifier   = "user"
+	GroupIdentifier  = "group"
+	PathIdentifier   = "path"
+)
+
+// pseudonymFormats are the formats of the pseudonyms built from their number
+var pseudonymFormats = map[string]func(n int) string{
+	HostIdentifier:   func(n int) string { return fmt.Sprintf("host%03d", n) },
+	SerialIdentifier: func(n int) string { return fmt.Sprintf("SN%06d", n) },
+	// the benchmark network 198.18.0.0/15 isn't used by real hosts
+	IPIdentifier: func(n int) string { return fmt.Sprintf("198.%d.%d.%d", 18+n>>16&1, n>>8&255, n&255) },
+	// the documentation prefix 2001:db8::/32 and the locally administered MAC addresses aren't used by real hosts
+	IPv6Identifier:  func(n int) string { return fmt.Sprintf("2001:db8::%x:%x", n>>16, n&0xffff) },
+	MACIdentifier:   func(n int) string { return fmt.Sprintf("02:00:00:%02x:%02x:%02x", n>>16&255, n>>8&255, n&255) },
+	UserIdentifier:  func(n int) string { return fmt.Sprintf("user%03d", n) },
+	GroupIdentifier: func(n int) string { return fmt.Sprintf("group%03d", n) },
+	PathIdentifier:  func(n int) string { return fmt.Sprintf("/fs%03d", n) },
+}
+
+// Mapping keeps the pseudonyms of the identifiers found in the nmon files. It's saved in a JSON file
+// so the same identifiers always get the same pseudonyms and the pseudonyms can be reversed.
+// It can be used by several goroutines.
+type Mapping struct {
+	path       string
+	mutex      sync.Mutex
+	changed    bool
+	Pseudonyms map[string]map[string]string `json:"pseudonyms"`
+}
+
+// LoadMapping reads the mapping file. A missing file is an empty mapping.
+func LoadMapping(path string) (*Mapping, error) {
+	mapping := &Mapping{path: path, Pseudonyms: make(map[string]map[string]string)}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return mapping, nil
+	}
+	if err != nil {
+		return nil, &FileError{File: path, Err: err}
+	}
+	if err := json.Unmarshal(content, mapping); err != nil {
+		return nil, &FileError{File: path, Err: fmt.Errorf("invalid mapping file: %w", err)}
+	}
+	if mapping.Pseudonyms == nil {
+		mapping.Pseudonyms = make(map[string]map[string]string)
+	}
+	return mapping, nil
+}
+
+// Pseudonym returns the pseudonym of the identifier, or a new one if it's not known yet. Empty values are kept.
+func (mapping *Mapping) Pseudonym(kind string, value string) string {
+	if len(value) == 0 {
+		return value
+	}
+	mapping.mutex.Lock()
+	defer mapping.mutex.Unlock()
+	pseudonyms, ok := mapping.Pseudonyms[kind]
+	if !ok {
+		pseudonyms = make(map[string]string)
+		mapping.Pseudonyms[kind] = pseudonyms
+	}
+	if pseudonym, ok := pseudonyms[value]; ok {
+		return pseudonym
+	}
+	pseudonym := pseudonymFormats[kind](len(pseudonyms) + 1)
+	pseudonyms[value] = pseudonym
+	mapping.changed = true
+	return pseudonym
+}
+
+// Lookup returns the pseudonym of a known identifier
+func (mapping *Mapping) Lookup(kind string, value string) (string, bool) {
+	mapping.mutex.Lock()
+	defer mapping.mutex.Unlock()
+	pseudonym, ok := mapping.Pseudonyms[kind][value]
+	return pseudonym, ok
+}
+
+// Known returns the identifiers of a kind with a pseudonym
+func (mapping *Mapping) Known(kind string) []string {
+	mapping.mutex.Lock()
+	defer mapping.mutex.Unlock()
+	values := make([]string, 0, len(mapping.Pseudonyms[kind]))
+	for value := range mapping.Pseudonyms[kind] {
+		values = append(values, value)
+	}
+	return values
+}
+
+// Save writes the mapping file if new pseudonyms were added. It's only readable by its owner.
+func (mapping *Mapping) Save() error {
+	mapping.mutex.Lock()
+	defer mapping.mutex.Unlock()
+	if !mapping.changed {
+		return nil
+	}
+	content, err := json.MarshalIndent(mapping, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(mapping.path); len(dir) > 0 {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return &FileError{File: mapping.path, Err: err}
+		}
+	}
+	// the previous mapping is kept if the write fails
+	tmpPath := mapping.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0600); err != nil {
+		return &FileError{File: mapping.path, Err: err}
+	}
+	if err := os.Rename(tmpPath, mapping.path); err != nil {
+		return &FileError{File: mapping.path, Err: err}
+	}
+	mapping.changed = false
+	return nil
+}
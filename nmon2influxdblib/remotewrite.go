@@ -0,0 +1,229 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+var placeholderRegexp = regexp.MustCompile(`\{([^}]+)\}`)
+var invalidMetricRegexp = regexp.MustCompile(`[^a-zA-Z0-9_:]+`)
+var invalidLabelRegexp = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// RemoteWriter is a PointWriter sending points to a Prometheus remote write endpoint.
+// The metric name is built from the Metric template: {measurement}, {field} and any tag name between braces are replaced by their value.
+// Tags used in the template are not added as labels. Fields other than value are appended to the metric name when {field} is not used.
+type RemoteWriter struct {
+	URL    string
+	Metric string
+	client *http.Client
+	series map[string]*timeSeries
+	count  int64
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+type sample struct {
+	value     float64
+	timestamp int64
+}
+
+type timeSeries struct {
+	labels  []label
+	samples []sample
+}
+
+// NewRemoteWriter returns a RemoteWriter for the remote write url
+func NewRemoteWriter(url string, metric string, skipCertCheck bool) *RemoteWriter {
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: skipCertCheck},
+	}
+	return &RemoteWriter{
+		URL:    url,
+		Metric: metric,
+		client: &http.Client{Transport: transport, Timeout: 5 * time.Minute},
+		series: make(map[string]*timeSeries),
+	}
+}
+
+// MetricName returns the metric name and the remaining tags for a field of a point
+func (writer *RemoteWriter) MetricName(measurement string, field string, tags map[string]string) (string, map[string]string) {
+	labels := make(map[string]string, len(tags))
+	for name, value := range tags {
+		labels[name] = value
+	}
+
+	hasField := false
+	metric := placeholderRegexp.ReplaceAllStringFunc(writer.Metric, func(placeholder string) string {
+		key := placeholder[1 : len(placeholder)-1]
+		switch key {
+		case "measurement":
+			return measurement
+		case "field":
+			hasField = true
+			return field
+		}
+		value := labels[key]
+		delete(labels, key)
+		return value
+	})
+	if !hasField && field != "value" {
+		metric += "_" + field
+	}
+
+	metric = invalidMetricRegexp.ReplaceAllString(metric, "_")
+	if len(metric) > 0 && metric[0] >= '0' && metric[0] <= '9' {
+		metric = "_" + metric
+	}
+	return metric, labels
+}
+
+// AddPoint converts each numeric field of the point in a sample. Text fields are skipped.
+func (writer *RemoteWriter) AddPoint(measurement string, timestamp time.Time, fields map[string]interface{}, tags map[string]string) {
+	for field, value := range fields {
+		var floatValue float64
+		switch v := value.(type) {
+		case float64:
+			floatValue = v
+		case float32:
+			floatValue = float64(v)
+		case int:
+			floatValue = float64(v)
+		case int64:
+			floatValue = float64(v)
+		case bool:
+			if v {
+				floatValue = 1
+			}
+		default:
+			continue
+		}
+
+		metric, tagLabels := writer.MetricName(measurement, field, tags)
+		labels := []label{{name: "__name__", value: metric}}
+		for name, value := range tagLabels {
+			name = invalidLabelRegexp.ReplaceAllString(name, "_")
+			if len(value) == 0 || len(name) == 0 {
+				continue
+			}
+			labels = append(labels, label{name: name, value: value})
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+		var key strings.Builder
+		for _, l := range labels {
+			key.WriteString(l.name + "\xff" + l.value + "\xff")
+		}
+		serie, ok := writer.series[key.String()]
+		if !ok {
+			serie = &timeSeries{labels: labels}
+			writer.series[key.String()] = serie
+		}
+		serie.samples = append(serie.samples, sample{value: floatValue, timestamp: timestamp.UnixNano() / int64(time.Millisecond)})
+		writer.count++
+	}
+}
+
+// WritePoints sends the samples in a snappy compressed protobuf WriteRequest
+func (writer *RemoteWriter) WritePoints() error {
+	if writer.count == 0 {
+		return nil
+	}
+
+	body := snappy.Encode(nil, writer.encode())
+	req, err := http.NewRequest("POST", writer.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := writer.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp, "remote write "+writer.URL)
+}
+
+// PointsCount returns the number of samples waiting to be written
+func (writer *RemoteWriter) PointsCount() int64 {
+	return writer.count
+}
+
+// ClearPoints removes the samples
+func (writer *RemoteWriter) ClearPoints() {
+	writer.series = make(map[string]*timeSeries)
+	writer.count = 0
+}
+
+// encode builds the WriteRequest protobuf message. Samples are sorted by timestamp in each time serie.
+func (writer *RemoteWriter) encode() []byte {
+	keys := make([]string, 0, len(writer.series))
+	for key := range writer.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var request []byte
+	for _, key := range keys {
+		serie := writer.series[key]
+		sort.SliceStable(serie.samples, func(i, j int) bool { return serie.samples[i].timestamp < serie.samples[j].timestamp })
+
+		var ts []byte
+		for _, l := range serie.labels {
+			var lb []byte
+			lb = appendBytes(lb, 1, []byte(l.name))
+			lb = appendBytes(lb, 2, []byte(l.value))
+			ts = appendBytes(ts, 1, lb)
+		}
+		for _, s := range serie.samples {
+			var sb []byte
+			sb = appendTag(sb, 1, 1)
+			var fixed [8]byte
+			binary.LittleEndian.PutUint64(fixed[:], math.Float64bits(s.value))
+			sb = append(sb, fixed[:]...)
+			sb = appendTag(sb, 2, 0)
+			sb = appendVarint(sb, uint64(s.timestamp))
+			ts = appendBytes(ts, 2, sb)
+		}
+		request = appendBytes(request, 1, ts)
+	}
+	return request
+}
+
+// appendTag appends a protobuf field key
+func appendTag(buf []byte, field int, wireType int) []byte {
+	return appendVarint(buf, uint64(field<<3|wireType))
+}
+
+// appendVarint appends a protobuf varint
+func appendVarint(buf []byte, value uint64) []byte {
+	var varint [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(varint[:], value)
+	return append(buf, varint[:n]...)
+}
+
+// appendBytes appends a length delimited protobuf field
+func appendBytes(buf []byte, field int, value []byte) []byte {
+	buf = appendTag(buf, field, 2)
+	buf = appendVarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
@@ -0,0 +1,198 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// decodedSerie is a time serie read back from a WriteRequest
+type decodedSerie struct {
+	labels  map[string]string
+	samples []sample
+}
+
+// readField reads a protobuf field key and returns the field number, the wire type and the remaining bytes
+func readField(t *testing.T, buf []byte) (int, int, []byte) {
+	t.Helper()
+	key, n := binary.Uvarint(buf)
+	if n <= 0 {
+		t.Fatalf("invalid field key in % x", buf)
+	}
+	return int(key >> 3), int(key & 7), buf[n:]
+}
+
+// readBytes reads a length delimited value and returns it with the remaining bytes
+func readBytes(t *testing.T, buf []byte) ([]byte, []byte) {
+	t.Helper()
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || int(length) > len(buf[n:]) {
+		t.Fatalf("invalid length in % x", buf)
+	}
+	return buf[n : n+int(length)], buf[n+int(length):]
+}
+
+// decodeWriteRequest reads the time series of a WriteRequest message
+func decodeWriteRequest(t *testing.T, request []byte) (series []decodedSerie) {
+	t.Helper()
+	for len(request) > 0 {
+		field, wireType, rest := readField(t, request)
+		if field != 1 || wireType != 2 {
+			t.Fatalf("unexpected WriteRequest field %d with wire type %d", field, wireType)
+		}
+		var ts []byte
+		ts, request = readBytes(t, rest)
+
+		serie := decodedSerie{labels: make(map[string]string)}
+		for len(ts) > 0 {
+			field, wireType, rest := readField(t, ts)
+			if wireType != 2 {
+				t.Fatalf("unexpected TimeSeries wire type %d", wireType)
+			}
+			var message []byte
+			message, ts = readBytes(t, rest)
+			switch field {
+			case 1:
+				var name, value []byte
+				_, _, rest := readField(t, message)
+				name, rest = readBytes(t, rest)
+				_, _, rest = readField(t, rest)
+				value, _ = readBytes(t, rest)
+				serie.labels[string(name)] = string(value)
+			case 2:
+				_, _, rest := readField(t, message)
+				value := math.Float64frombits(binary.LittleEndian.Uint64(rest))
+				_, _, rest = readField(t, rest[8:])
+				timestamp, _ := binary.Uvarint(rest)
+				serie.samples = append(serie.samples, sample{value: value, timestamp: int64(timestamp)})
+			default:
+				t.Fatalf("unexpected TimeSeries field %d", field)
+			}
+		}
+		series = append(series, serie)
+	}
+	return
+}
+
+func TestAppendVarint(t *testing.T) {
+	tests := []struct {
+		value uint64
+		want  []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{300, []byte{0xac, 0x02}},
+	}
+	for _, test := range tests {
+		if got := appendVarint(nil, test.value); !bytes.Equal(got, test.want) {
+			t.Errorf("appendVarint(%d) = % x, want % x", test.value, got, test.want)
+		}
+	}
+}
+
+func TestRemoteWriterEncodeBytes(t *testing.T) {
+	writer := NewRemoteWriter("", "{measurement}", false)
+	writer.AddPoint("a", time.Unix(0, 2*int64(time.Millisecond)), map[string]interface{}{"value": 1.0}, nil)
+
+	want := []byte{
+		0x0a, 0x1c, // timeseries, 28 bytes
+		0x0a, 0x0d, // label, 13 bytes
+		0x0a, 0x08, '_', '_', 'n', 'a', 'm', 'e', '_', '_',
+		0x12, 0x01, 'a',
+		0x12, 0x0b, // sample, 11 bytes
+		0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf0, 0x3f, // value 1.0
+		0x10, 0x02, // timestamp 2ms
+	}
+	if got := writer.encode(); !bytes.Equal(got, want) {
+		t.Errorf("encode() = % x, want % x", got, want)
+	}
+}
+
+func TestRemoteWriterEncode(t *testing.T) {
+	writer := NewRemoteWriter("", "nmon_{measurement}", false)
+	tags := map[string]string{"host": "lpar1", "empty": "", "bad-name": "x"}
+	writer.AddPoint("CPU_ALL", time.Unix(20, 0), map[string]interface{}{"User%": 2.5, "text": "skipped"}, tags)
+	writer.AddPoint("CPU_ALL", time.Unix(10, 0), map[string]interface{}{"User%": int64(3)}, tags)
+	writer.AddPoint("MEM", time.Unix(10, 0), map[string]interface{}{"value": true}, map[string]string{"host": "lpar1"})
+
+	if writer.PointsCount() != 3 {
+		t.Errorf("PointsCount() = %d, want 3", writer.PointsCount())
+	}
+	want := []decodedSerie{
+		{
+			labels:  map[string]string{"__name__": "nmon_CPU_ALL_User_", "bad_name": "x", "host": "lpar1"},
+			samples: []sample{{value: 3, timestamp: 10000}, {value: 2.5, timestamp: 20000}},
+		},
+		{
+			labels:  map[string]string{"__name__": "nmon_MEM", "host": "lpar1"},
+			samples: []sample{{value: 1, timestamp: 10000}},
+		},
+	}
+	if got := decodeWriteRequest(t, writer.encode()); !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded series = %+v, want %+v", got, want)
+	}
+}
+
+func TestRemoteWriterMetricName(t *testing.T) {
+	tests := []struct {
+		template string
+		field    string
+		tags     map[string]string
+		metric   string
+		labels   map[string]string
+	}{
+		{"nmon_{measurement}", "value", map[string]string{"host": "lpar1"}, "nmon_DISKBUSY", map[string]string{"host": "lpar1"}},
+		{"nmon_{measurement}", "busy", map[string]string{"host": "lpar1"}, "nmon_DISKBUSY_busy", map[string]string{"host": "lpar1"}},
+		{"{measurement}_{field}", "value", nil, "DISKBUSY_value", map[string]string{}},
+		{"{host}.{measurement}", "value", map[string]string{"host": "lpar1", "name": "hdisk0"}, "lpar1_DISKBUSY", map[string]string{"name": "hdisk0"}},
+		{"{name}", "value", map[string]string{"name": "0hdisk"}, "_0hdisk", map[string]string{}},
+	}
+	for _, test := range tests {
+		writer := NewRemoteWriter("", test.template, false)
+		metric, labels := writer.MetricName("DISKBUSY", test.field, test.tags)
+		if metric != test.metric || !reflect.DeepEqual(labels, test.labels) {
+			t.Errorf("%s: MetricName() = %s %v, want %s %v", test.template, metric, labels, test.metric, test.labels)
+		}
+	}
+}
+
+func TestRemoteWriterWritePoints(t *testing.T) {
+	var body []byte
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	writer := NewRemoteWriter(server.URL, "{measurement}", false)
+	writer.AddPoint("MEM", time.Unix(1, 0), map[string]interface{}{"value": 42.0}, nil)
+	if err := writer.WritePoints(); err != nil {
+		t.Fatal(err)
+	}
+	if headers.Get("Content-Encoding") != "snappy" || headers.Get("Content-Type") != "application/x-protobuf" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+	request, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(request, writer.encode()) {
+		t.Errorf("sent request % x, want % x", request, writer.encode())
+	}
+}
@@ -0,0 +1,185 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// aggregations of the resampled points
+const (
+	AggregateMean = "mean"
+	AggregateMax  = "max"
+	AggregateP95  = "p95"
+)
+
+// aggregations are the functions computing the value of a window
+var aggregations = map[string]func(values []float64) float64{
+	AggregateMean: func(values []float64) float64 {
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		return sum / float64(len(values))
+	},
+	AggregateMax: func(values []float64) float64 {
+		max := values[0]
+		for _, value := range values[1:] {
+			max = math.Max(max, value)
+		}
+		return max
+	},
+	// nearest rank percentile
+	AggregateP95: func(values []float64) float64 {
+		sorted := append([]float64(nil), values...)
+		sort.Float64s(sorted)
+		return sorted[int(math.Ceil(0.95*float64(len(sorted))))-1]
+	},
+}
+
+// ParseResample checks the resample window and the aggregation. An empty window means no resampling.
+func ParseResample(resample string, aggregation string) (time.Duration, error) {
+	if len(resample) == 0 {
+		return 0, nil
+	}
+	window, err := time.ParseDuration(resample)
+	if err != nil || window < time.Second {
+		return 0, fmt.Errorf("invalid resample window %s: use a duration like 5m or 1h", resample)
+	}
+	if _, ok := aggregations[aggregation]; !ok {
+		return 0, fmt.Errorf("invalid aggregation %s: use %s, %s or %s", aggregation, AggregateMean, AggregateMax, AggregateP95)
+	}
+	return window, nil
+}
+
+// ResampleWriter is a PointWriter aggregating the points of each series over fixed time windows.
+// The windows are aligned on multiples of their duration since the epoch and their points are timestamped with their start.
+// A window is written when a point of its series is in a later window, or when Flush is called.
+// The raw points can also be written in measurements with RawPrefix, or in the Raw writer.
+// A zero window writes the points without resampling.
+type ResampleWriter struct {
+	PointWriter
+	Window    time.Duration
+	RawPrefix string
+	Raw       PointWriter
+	aggregate func(values []float64) float64
+	windows   map[string]*resampleWindow
+}
+
+// resampleWindow keeps the field values of a series during a window
+type resampleWindow struct {
+	measurement string
+	start       time.Time
+	tags        map[string]string
+	values      map[string][]float64
+	// text fields keep their last value
+	texts map[string]interface{}
+}
+
+// WindowStart returns the start of the window of t. The windows are aligned on the epoch: time.Truncate aligns them on the zero time.
+func WindowStart(t time.Time, window time.Duration) time.Time {
+	nanos := t.UnixNano()
+	return time.Unix(0, nanos-nanos%int64(window)).In(t.Location())
+}
+
+// NewResampleWriter returns a ResampleWriter writing the aggregated points in writer
+func NewResampleWriter(writer PointWriter, window time.Duration, aggregation string) *ResampleWriter {
+	return &ResampleWriter{PointWriter: writer, Window: window, aggregate: aggregations[aggregation], windows: make(map[string]*resampleWindow)}
+}
+
+// AddPoint adds the point to the window of its series. A window of the series older than this point is written.
+func (writer *ResampleWriter) AddPoint(measurement string, timestamp time.Time, fields map[string]interface{}, tags map[string]string) {
+	if writer.Raw != nil {
+		writer.Raw.AddPoint(measurement, timestamp, fields, tags)
+	} else if len(writer.RawPrefix) > 0 {
+		writer.PointWriter.AddPoint(writer.RawPrefix+measurement, timestamp, fields, tags)
+	}
+	if writer.Window <= 0 {
+		writer.PointWriter.AddPoint(measurement, timestamp, fields, tags)
+		return
+	}
+
+	start := WindowStart(timestamp, writer.Window)
+	key := measurement + "," + seriesKey(tags)
+	window, ok := writer.windows[key]
+	if ok && !window.start.Equal(start) {
+		writer.write(window)
+		ok = false
+	}
+	if !ok {
+		window = &resampleWindow{measurement: measurement, start: start, tags: tags, values: make(map[string][]float64)}
+		writer.windows[key] = window
+	}
+	for name, value := range fields {
+		switch number := value.(type) {
+		case float64:
+			window.values[name] = append(window.values[name], number)
+		case int64:
+			window.values[name] = append(window.values[name], float64(number))
+		case int:
+			window.values[name] = append(window.values[name], float64(number))
+		default:
+			if window.texts == nil {
+				window.texts = make(map[string]interface{})
+			}
+			window.texts[name] = value
+		}
+	}
+}
+
+// write adds the aggregated point of the window to the points to write
+func (writer *ResampleWriter) write(window *resampleWindow) {
+	fields := make(map[string]interface{}, len(window.values)+len(window.texts))
+	for name, value := range window.texts {
+		fields[name] = value
+	}
+	for name, values := range window.values {
+		fields[name] = writer.aggregate(values)
+	}
+	writer.PointWriter.AddPoint(window.measurement, window.start, fields, window.tags)
+}
+
+// Flush adds the aggregated points of all the windows, even if they are not complete
+func (writer *ResampleWriter) Flush() {
+	windows := make([]*resampleWindow, 0, len(writer.windows))
+	for _, window := range writer.windows {
+		windows = append(windows, window)
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].start.Before(windows[j].start) })
+	for _, window := range windows {
+		writer.write(window)
+	}
+	writer.windows = make(map[string]*resampleWindow)
+}
+
+// WritePoints writes the raw points and the aggregated points of the complete windows
+func (writer *ResampleWriter) WritePoints() error {
+	if writer.Raw != nil && writer.Raw.PointsCount() > 0 {
+		if err := writer.Raw.WritePoints(); err != nil {
+			return fmt.Errorf("raw points: %w", err)
+		}
+	}
+	return writer.PointWriter.WritePoints()
+}
+
+// PointsCount returns the number of points waiting to be written
+func (writer *ResampleWriter) PointsCount() int64 {
+	count := writer.PointWriter.PointsCount()
+	if writer.Raw != nil {
+		count += writer.Raw.PointsCount()
+	}
+	return count
+}
+
+// ClearPoints removes the points waiting to be written. The windows are kept.
+func (writer *ResampleWriter) ClearPoints() {
+	if writer.Raw != nil {
+		writer.Raw.ClearPoints()
+	}
+	writer.PointWriter.ClearPoints()
+}
@@ -0,0 +1,167 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseResample(t *testing.T) {
+	tests := []struct {
+		resample    string
+		aggregation string
+		want        time.Duration
+		wantErr     bool
+	}{
+		{"", "unknown", 0, false},
+		{"5m", AggregateMean, 5 * time.Minute, false},
+		{"1h", AggregateP95, time.Hour, false},
+		{"500ms", AggregateMean, 0, true},
+		{"five", AggregateMean, 0, true},
+		{"5m", "median", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.resample+" "+test.aggregation, func(t *testing.T) {
+			got, err := ParseResample(test.resample, test.aggregation)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseResample() error = %v, wantErr %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("ParseResample() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestResampleWriterAggregations(t *testing.T) {
+	tests := []struct {
+		aggregation string
+		want        float64
+	}{
+		{AggregateMean, 5.5},
+		{AggregateMax, 10},
+		{AggregateP95, 10},
+	}
+	start := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.aggregation, func(t *testing.T) {
+			writer := &rejectingWriter{}
+			resampler := NewResampleWriter(writer, 10*time.Minute, test.aggregation)
+			for i := 1; i <= 10; i++ {
+				resampler.AddPoint("CPU_ALL", start.Add(time.Duration(i-1)*time.Minute), map[string]interface{}{"user": float64(i)}, map[string]string{"host": "lpar1"})
+			}
+			if len(writer.points) != 0 {
+				t.Fatalf("%d points written before the end of the window", len(writer.points))
+			}
+			resampler.Flush()
+			if len(writer.points) != 1 {
+				t.Fatalf("%d points written, want 1", len(writer.points))
+			}
+			if got := writer.points[0].fields["user"]; got != test.want {
+				t.Errorf("user = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestResampleWriterWindows(t *testing.T) {
+	writer := &rejectingWriter{}
+	resampler := NewResampleWriter(writer, 7*time.Minute, AggregateMean)
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2020-01-01 00:00:00 UTC is 3756754 windows of 7m and 2 minutes after the epoch
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).In(paris)
+	for i := 0; i < 8; i++ {
+		for _, host := range []string{"lpar1", "lpar2"} {
+			fields := map[string]interface{}{"user": float64(i), "version": "v" + host}
+			resampler.AddPoint("CPU_ALL", start.Add(time.Duration(i)*time.Minute), fields, map[string]string{"host": host})
+		}
+	}
+
+	// the first windows of both series are written by the points of their next windows
+	if len(writer.points) != 2 {
+		t.Fatalf("%d points written before Flush, want 2", len(writer.points))
+	}
+	resampler.Flush()
+	if len(writer.points) != 4 {
+		t.Fatalf("%d points written, want 4", len(writer.points))
+	}
+
+	windows := []struct {
+		start time.Time
+		user  float64
+	}{
+		{time.Date(2019, 12, 31, 23, 58, 0, 0, time.UTC), 2},
+		{time.Date(2020, 1, 1, 0, 5, 0, 0, time.UTC), 6},
+	}
+	for _, point := range writer.points {
+		if point.timestamp.UnixNano()%int64(7*time.Minute) != 0 {
+			t.Errorf("window %s not aligned on the epoch", point.timestamp)
+		}
+		if point.timestamp.Location() != paris {
+			t.Errorf("window %s not in the location of the points", point.timestamp)
+		}
+		found := false
+		for _, window := range windows {
+			if point.timestamp.Equal(window.start) {
+				found = true
+				if point.fields["user"] != window.user {
+					t.Errorf("user of window %s = %v, want %v", window.start, point.fields["user"], window.user)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("unexpected window %s", point.timestamp)
+		}
+		if want := "v" + point.tags["host"]; point.fields["version"] != want {
+			t.Errorf("version of %s = %v, want %s", point.tags["host"], point.fields["version"], want)
+		}
+	}
+}
+
+func TestResampleWriterRaw(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tags := map[string]string{"host": "lpar1"}
+
+	writer := &rejectingWriter{}
+	resampler := NewResampleWriter(writer, time.Hour, AggregateMean)
+	resampler.RawPrefix = "raw_"
+	resampler.AddPoint("MEM", start, map[string]interface{}{"free": 1.0}, tags)
+	resampler.Flush()
+	if len(writer.points) != 2 || writer.points[0].measurement != "raw_MEM" || writer.points[1].measurement != "MEM" {
+		t.Errorf("points = %+v, want raw_MEM and MEM", writer.points)
+	}
+
+	writer = &rejectingWriter{}
+	raw := &rejectingWriter{}
+	resampler = NewResampleWriter(writer, time.Hour, AggregateMean)
+	resampler.RawPrefix = "raw_"
+	resampler.Raw = raw
+	resampler.AddPoint("MEM", start, map[string]interface{}{"free": 1.0}, tags)
+	resampler.Flush()
+	if len(raw.points) != 1 || raw.points[0].measurement != "MEM" {
+		t.Errorf("raw points = %+v, want MEM", raw.points)
+	}
+	if got := resampler.PointsCount(); got != 2 {
+		t.Errorf("PointsCount() = %d, want 2", got)
+	}
+	if err := resampler.WritePoints(); err != nil {
+		t.Fatal(err)
+	}
+	if raw.written != 1 || writer.written != 1 {
+		t.Errorf("%d raw and %d resampled points written, want 1 and 1", raw.written, writer.written)
+	}
+
+	// a zero window writes the points as they are
+	writer = &rejectingWriter{}
+	resampler = NewResampleWriter(writer, 0, AggregateMean)
+	resampler.AddPoint("MEM", start, map[string]interface{}{"free": 1.0}, tags)
+	if len(writer.points) != 1 || !writer.points[0].timestamp.Equal(start) {
+		t.Errorf("points = %+v, want the MEM point", writer.points)
+	}
+}
@@ -0,0 +1,220 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// default write retry policy
+const (
+	DefaultWriteRetries = 5
+	DefaultRetryDelay   = 1
+	maxRetryDelay       = time.Minute
+	maxRejectedMessages = 10
+	// a rejected batch is split at most maxSplitDepth times
+	maxSplitDepth = 10
+)
+
+// HTTPError is returned when the server answers a request with an error status
+type HTTPError struct {
+	StatusCode int
+	Message    string
+}
+
+// Error returns the message of the error
+func (err *HTTPError) Error() string {
+	return err.Message
+}
+
+// checkResponse returns a HTTPError if the response status is an error
+func checkResponse(resp *http.Response, context string) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	contents, _ := ioutil.ReadAll(resp.Body)
+	return &HTTPError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(fmt.Sprintf("%s: %s %s", context, resp.Status, contents))}
+}
+
+// ways to handle a write error
+const (
+	retryWrite = iota
+	splitWrite
+	failWrite
+)
+
+// writeErrorKind tells how to handle a write error. Network errors, timeouts, throttling and server errors are retried.
+// Points rejected by the server are isolated by splitting the batch. Authentication errors and missing databases stop the write.
+func writeErrorKind(err error) int {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return retryWrite
+	}
+	switch httpErr.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return retryWrite
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return failWrite
+	}
+	if httpErr.StatusCode >= 500 {
+		return retryWrite
+	}
+	return splitWrite
+}
+
+// RetryWriter is a PointWriter retrying the failed writes with an exponential backoff.
+// When the server rejects a batch, it's split to write the valid points and drop the invalid ones.
+type RetryWriter struct {
+	PointWriter
+	Retries int
+	Delay   time.Duration
+	// Rejected is the number of points dropped because the server rejected them
+	Rejected         int64
+	RejectedMessages []string
+	points           []bufferedPoint
+	random           *rand.Rand
+}
+
+// bufferedPoint is a point kept to be sent again
+type bufferedPoint struct {
+	measurement string
+	timestamp   time.Time
+	fields      map[string]interface{}
+	tags        map[string]string
+}
+
+// NewRetryWriter returns a RetryWriter retrying the writes of writer up to retries times. The first retry is done after delay.
+func NewRetryWriter(writer PointWriter, retries int, delay time.Duration) *RetryWriter {
+	return &RetryWriter{PointWriter: writer, Retries: retries, Delay: delay, random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// AddPoint keeps the point until the next write
+func (writer *RetryWriter) AddPoint(measurement string, timestamp time.Time, fields map[string]interface{}, tags map[string]string) {
+	writer.points = append(writer.points, bufferedPoint{measurement: measurement, timestamp: timestamp, fields: fields, tags: tags})
+}
+
+// WritePoints writes the points. An error is returned if the write still fails after the retries, or if it can't be retried.
+func (writer *RetryWriter) WritePoints() error {
+	if len(writer.points) == 0 {
+		return nil
+	}
+	return writer.write(writer.points)
+}
+
+// PointsCount returns the number of points waiting to be written
+func (writer *RetryWriter) PointsCount() int64 {
+	return int64(len(writer.points))
+}
+
+// ClearPoints removes the points
+func (writer *RetryWriter) ClearPoints() {
+	writer.points = writer.points[:0]
+	writer.PointWriter.ClearPoints()
+}
+
+// TakeRejected returns the number of rejected points and the first error messages, and resets them
+func (writer *RetryWriter) TakeRejected() (rejected int64, messages []string) {
+	rejected, messages = writer.Rejected, writer.RejectedMessages
+	writer.Rejected, writer.RejectedMessages = 0, nil
+	return
+}
+
+// write sends the points. A rejected batch is split to isolate the invalid points.
+func (writer *RetryWriter) write(points []bufferedPoint) error {
+	err := writer.send(points)
+	if err == nil || writeErrorKind(err) != splitWrite {
+		return err
+	}
+	return writer.split(points, err, 0)
+}
+
+// send writes the points and retries if needed
+func (writer *RetryWriter) send(points []bufferedPoint) error {
+	for attempt := 0; ; attempt++ {
+		writer.PointWriter.ClearPoints()
+		for _, point := range points {
+			writer.PointWriter.AddPoint(point.measurement, point.timestamp, point.fields, point.tags)
+		}
+		err := writer.PointWriter.WritePoints()
+		if err == nil || writeErrorKind(err) != retryWrite {
+			return err
+		}
+		if attempt >= writer.Retries {
+			return fmt.Errorf("write failed after %d retries: %w", attempt, err)
+		}
+		delay := writer.backoff(attempt)
+		log.Printf("write error: %s. Retrying in %s\n", err, delay.Round(time.Millisecond))
+		time.Sleep(delay)
+	}
+}
+
+// split writes each half of a batch rejected with err. The points are dropped when the batch can't be split anymore,
+// or when both halves are rejected with the same error, as the whole batch is then invalid for the same reason.
+func (writer *RetryWriter) split(points []bufferedPoint, err error, depth int) error {
+	if len(points) == 1 || depth >= maxSplitDepth {
+		writer.reject(points, err)
+		return nil
+	}
+	half := len(points) / 2
+	halves := [2][]bufferedPoint{points[:half], points[half:]}
+	var errs [2]error
+	for i, points := range halves {
+		errs[i] = writer.send(points)
+		if errs[i] != nil && writeErrorKind(errs[i]) != splitWrite {
+			return errs[i]
+		}
+	}
+	if errs[0] != nil && errs[1] != nil && errs[0].Error() == errs[1].Error() {
+		writer.reject(points, errs[0])
+		return nil
+	}
+	for i, points := range halves {
+		if errs[i] == nil {
+			continue
+		}
+		if err := writer.split(points, errs[i], depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reject drops the points rejected by the server
+func (writer *RetryWriter) reject(points []bufferedPoint, err error) {
+	writer.Rejected += int64(len(points))
+	writer.addRejectedMessage(fmt.Sprintf("%s: %s", points[0].measurement, err))
+}
+
+// addRejectedMessage keeps the first distinct messages of the rejected points
+func (writer *RetryWriter) addRejectedMessage(message string) {
+	if len(writer.RejectedMessages) >= maxRejectedMessages {
+		return
+	}
+	for _, known := range writer.RejectedMessages {
+		if known == message {
+			return
+		}
+	}
+	writer.RejectedMessages = append(writer.RejectedMessages, message)
+}
+
+// backoff returns the delay before a retry. It doubles at each attempt up to maxRetryDelay, with a random jitter.
+func (writer *RetryWriter) backoff(attempt int) time.Duration {
+	if writer.Delay <= 0 {
+		return 0
+	}
+	delay := writer.Delay << uint(attempt)
+	if delay <= 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay/2 + time.Duration(writer.random.Int63n(int64(delay/2)+1))
+}
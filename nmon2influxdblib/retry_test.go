@@ -0,0 +1,170 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// rejectingWriter rejects the batches containing a point with an invalid field
+type rejectingWriter struct {
+	points  []bufferedPoint
+	written int
+	writes  int
+	// message returns the error message for an invalid point
+	message func(point bufferedPoint) string
+}
+
+func (writer *rejectingWriter) AddPoint(measurement string, timestamp time.Time, fields map[string]interface{}, tags map[string]string) {
+	writer.points = append(writer.points, bufferedPoint{measurement: measurement, timestamp: timestamp, fields: fields, tags: tags})
+}
+
+func (writer *rejectingWriter) WritePoints() error {
+	writer.writes++
+	for _, point := range writer.points {
+		if _, ok := point.fields["invalid"]; ok {
+			return &HTTPError{StatusCode: http.StatusBadRequest, Message: writer.message(point)}
+		}
+	}
+	writer.written += len(writer.points)
+	return nil
+}
+
+func (writer *rejectingWriter) PointsCount() int64 {
+	return int64(len(writer.points))
+}
+
+func (writer *rejectingWriter) ClearPoints() {
+	writer.points = nil
+}
+
+func TestRetryWriterSplit(t *testing.T) {
+	tests := []struct {
+		name     string
+		points   int
+		invalid  func(i int) bool
+		message  func(point bufferedPoint) string
+		written  int
+		rejected int64
+		// maximum number of writes sent to the server
+		writes int
+	}{
+		{
+			name:     "one invalid point",
+			points:   64,
+			invalid:  func(i int) bool { return i == 10 },
+			message:  func(point bufferedPoint) string { return "unable to parse " + point.tags["id"] },
+			written:  63,
+			rejected: 1,
+			writes:   2*6 + 1,
+		},
+		{
+			name:     "same error for all the points",
+			points:   1024,
+			invalid:  func(i int) bool { return true },
+			message:  func(point bufferedPoint) string { return "field type conflict" },
+			written:  0,
+			rejected: 1024,
+			writes:   3,
+		},
+		{
+			name:     "split depth",
+			points:   4096,
+			invalid:  func(i int) bool { return true },
+			message:  func(point bufferedPoint) string { return "unable to parse " + point.tags["id"] },
+			written:  0,
+			rejected: 4096,
+			writes:   2 << maxSplitDepth,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &rejectingWriter{message: test.message}
+			writer := NewRetryWriter(server, 0, 0)
+			for i := 0; i < test.points; i++ {
+				fields := map[string]interface{}{"value": 1.0}
+				if test.invalid(i) {
+					fields["invalid"] = true
+				}
+				writer.AddPoint("CPU_ALL", time.Unix(int64(i), 0), fields, map[string]string{"id": strconv.Itoa(i)})
+			}
+			if err := writer.WritePoints(); err != nil {
+				t.Fatal(err)
+			}
+			if server.written != test.written || writer.Rejected != test.rejected {
+				t.Errorf("written = %d, rejected = %d, want %d and %d", server.written, writer.Rejected, test.written, test.rejected)
+			}
+			if server.writes > test.writes {
+				t.Errorf("%d writes, want at most %d", server.writes, test.writes)
+			}
+		})
+	}
+}
+
+func TestRetryWriterFail(t *testing.T) {
+	server := &rejectingWriter{message: func(point bufferedPoint) string { return "unauthorized" }}
+	writer := NewRetryWriter(&statusWriter{PointWriter: server, status: http.StatusUnauthorized}, 3, 0)
+	writer.AddPoint("CPU_ALL", time.Unix(0, 0), map[string]interface{}{"value": 1.0}, nil)
+	if err := writer.WritePoints(); err == nil {
+		t.Fatal("write succeeded")
+	}
+	if server.writes != 1 {
+		t.Errorf("%d writes, want 1", server.writes)
+	}
+}
+
+func TestRetryWriterRetries(t *testing.T) {
+	server := &rejectingWriter{}
+	writer := NewRetryWriter(&statusWriter{PointWriter: server, status: http.StatusServiceUnavailable}, 3, 0)
+	writer.AddPoint("CPU_ALL", time.Unix(0, 0), map[string]interface{}{"value": 1.0}, nil)
+	err := writer.WritePoints()
+	if err == nil {
+		t.Fatal("write succeeded")
+	}
+	// the status code is still available after the retries
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("error %v is not an HTTP error with status %d", err, http.StatusServiceUnavailable)
+	}
+	if server.writes != 4 {
+		t.Errorf("%d writes, want 4", server.writes)
+	}
+}
+
+// statusWriter fails all the writes with a status code
+type statusWriter struct {
+	PointWriter
+	status int
+}
+
+func (writer *statusWriter) WritePoints() error {
+	writer.PointWriter.WritePoints()
+	return &HTTPError{StatusCode: writer.status, Message: http.StatusText(writer.status)}
+}
+
+func TestRetryWriterBackoff(t *testing.T) {
+	writer := NewRetryWriter(nil, 5, time.Second)
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{10, maxRetryDelay},
+		{100, maxRetryDelay},
+	}
+	for _, test := range tests {
+		delay := writer.backoff(test.attempt)
+		if delay < test.max/2 || delay > test.max {
+			t.Errorf("backoff(%d) = %s, want between %s and %s", test.attempt, delay, test.max/2, test.max)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultStateFile is the usual location of the local state store
+const DefaultStateFile = "/var/lib/nmon2influxdb/state.db"
+
+// stateLockTimeout is the time waited for another process using the state store
+const stateLockTimeout = 10 * time.Second
+
+// state store buckets
+var (
+	filesBucket   = []byte("files")
+	journalBucket = []byte("journal")
+)
+
+// JournalEntry is an import recorded in the import journal
+type JournalEntry struct {
+	Time     time.Time `json:"time"`
+	File     string    `json:"file"`
+	Host     string    `json:"host"`
+	Source   string    `json:"source"`
+	Status   string    `json:"status"`
+	Points   int64     `json:"points"`
+	Rejected int64     `json:"rejected,omitempty"`
+	Sections string    `json:"sections"`
+	Duration float64   `json:"duration"`
+	Error    string    `json:"error,omitempty"`
+	// Start and End are the times of the first and last imported snapshots. They are zero for the older entries.
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// FileState is the import state of a nmon file kept in the local state store
+type FileState struct {
+	File      string    `json:"file"`
+	Source    string    `json:"source"`
+	Host      string    `json:"host"`
+	Timestamp string    `json:"timestamp"`
+	Checksum  string    `json:"checksum"`
+	Updated   time.Time `json:"updated"`
+}
+
+// StateStore is a local file keeping the import state of the nmon files and the import journal without expiry.
+// It can be used by several goroutines, but only by one process at a time.
+type StateStore struct {
+	db *bolt.DB
+}
+
+// OpenStateStore opens or creates the state store file
+func OpenStateStore(path string) (*StateStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, newFileError(path, err)
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: stateLockTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, &FileError{File: path, Err: errors.New("state store used by another nmon2influxdb process")}
+	}
+	if err != nil {
+		return nil, newFileError(path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(filesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(journalBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, &FileError{File: path, Err: err}
+	}
+	return &StateStore{db: db}, nil
+}
+
+// Close closes the state store file
+func (store *StateStore) Close() error {
+	return store.db.Close()
+}
+
+// ReadState returns the last imported timestamp and the checksum of the file
+func (store *StateStore) ReadState(nmonFile File) (timeStamp string, checksum string, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(filesBucket).Get([]byte(nmonFile.Source()))
+		if value == nil {
+			return nil
+		}
+		var state FileState
+		if err := json.Unmarshal(value, &state); err != nil {
+			return err
+		}
+		timeStamp, checksum = state.Timestamp, state.Checksum
+		return nil
+	})
+	return
+}
+
+// WriteState stores the last imported timestamp and the checksum of the file
+func (store *StateStore) WriteState(nmonFile File, host string, timeStamp string, checksum string) error {
+	state := FileState{File: nmonFile.LogName(), Source: nmonFile.Source(), Host: host, Timestamp: timeStamp, Checksum: checksum, Updated: time.Now()}
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).Put([]byte(state.Source), value)
+	})
+}
+
+// States returns the import state of all the files sorted by source
+func (store *StateStore) States() (states []FileState, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(key []byte, value []byte) error {
+			var state FileState
+			if err := json.Unmarshal(value, &state); err != nil {
+				return fmt.Errorf("invalid state of %s: %w", key, err)
+			}
+			states = append(states, state)
+			return nil
+		})
+	})
+	sort.Slice(states, func(i, j int) bool { return states[i].Source < states[j].Source })
+	return
+}
+
+// DeleteStates removes the import state of the files matching match. The files are imported again by the next import.
+func (store *StateStore) DeleteStates(match func(state FileState) bool) (deleted []FileState, err error) {
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(filesBucket)
+		var keys [][]byte
+		err := bucket.ForEach(func(key []byte, value []byte) error {
+			var state FileState
+			if err := json.Unmarshal(value, &state); err != nil {
+				return fmt.Errorf("invalid state of %s: %w", key, err)
+			}
+			if match(state) {
+				keys = append(keys, append([]byte(nil), key...))
+				deleted = append(deleted, state)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// AddEntry records an import in the journal
+func (store *StateStore) AddEntry(entry JournalEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(journalBucket)
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, sequence)
+		return bucket.Put(key, value)
+	})
+}
+
+// Entries returns the journal entries of host since the time, in the import order. Empty host and zero time select all the entries.
+func (store *StateStore) Entries(host string, since time.Time) (entries []JournalEntry, err error) {
+	err = store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(journalBucket).ForEach(func(key []byte, value []byte) error {
+			var entry JournalEntry
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return err
+			}
+			if len(host) > 0 && entry.Host != host {
+				return nil
+			}
+			if entry.Time.Before(since) {
+				return nil
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	return
+}
+
+// JournalSources returns the sources of the files found in the journal entries, and the sources having an entry selected by match
+func JournalSources(entries []JournalEntry, match func(entry JournalEntry) bool) (journaled map[string]bool, selected map[string]bool) {
+	journaled, selected = make(map[string]bool), make(map[string]bool)
+	for _, entry := range entries {
+		journaled[entry.Source] = true
+		if match(entry) {
+			selected[entry.Source] = true
+		}
+	}
+	return
+}
+
+// Clear removes the import state and the journal entries of the files of host having a journal entry selected by match.
+// The time frame of the files without journal entry is unknown: they are always cleared. It returns the number of files cleared.
+func (store *StateStore) Clear(host string, match func(entry JournalEntry) bool) (int, error) {
+	entries, err := store.Entries(host, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	journaled, sources := JournalSources(entries, match)
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		// the files bucket is read first to add the files without journal entry
+		for _, name := range [][]byte{filesBucket, journalBucket} {
+			bucket := tx.Bucket(name)
+			var keys [][]byte
+			err := bucket.ForEach(func(key []byte, value []byte) error {
+				var entry struct {
+					Host   string `json:"host"`
+					Source string `json:"source"`
+				}
+				if err := json.Unmarshal(value, &entry); err != nil {
+					return fmt.Errorf("invalid entry %s: %w", key, err)
+				}
+				if entry.Host != host {
+					return nil
+				}
+				if !journaled[entry.Source] {
+					sources[entry.Source] = true
+				}
+				if sources[entry.Source] {
+					keys = append(keys, append([]byte(nil), key...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				if err := bucket.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return len(sources), err
+}
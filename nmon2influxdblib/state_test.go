@@ -0,0 +1,91 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestStateStoreClear(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := OpenStateStore(filepath.Join(dir, "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+	files := []struct {
+		name  string
+		host  string
+		start time.Time
+	}{
+		{"lpar1_200101.nmon", "lpar1", day(1)},
+		{"lpar1_200102.nmon", "lpar1", day(2)},
+		{"lpar1_200103.nmon", "lpar1", time.Time{}},
+		{"lpar2_200101.nmon", "lpar2", day(1)},
+	}
+	for _, file := range files {
+		nmonFile := File{Name: "/data/" + file.name}
+		if err := store.WriteState(nmonFile, file.host, "23:59:00,01-JAN-2020", "checksum"); err != nil {
+			t.Fatal(err)
+		}
+		// the third file was imported before the journal existed
+		if file.start.IsZero() {
+			continue
+		}
+		entry := JournalEntry{File: nmonFile.LogName(), Host: file.host, Source: nmonFile.Source(), Start: file.start, End: file.start.Add(23 * time.Hour)}
+		if err := store.AddEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the files of lpar1 with points on the 2nd of January
+	cleared, err := store.Clear("lpar1", func(entry JournalEntry) bool {
+		return entry.Start.Equal(day(2))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cleared != 2 {
+		t.Errorf("%d files cleared, want 2", cleared)
+	}
+
+	states, err := store.States()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remaining []string
+	for _, state := range states {
+		remaining = append(remaining, state.File)
+	}
+	want := []string{"lpar1_200101.nmon", "lpar2_200101.nmon"}
+	if !reflect.DeepEqual(remaining, want) {
+		t.Errorf("remaining states = %q, want %q", remaining, want)
+	}
+
+	entries, err := store.Entries("", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remaining = remaining[:0]
+	for _, entry := range entries {
+		remaining = append(remaining, entry.File)
+	}
+	sort.Strings(remaining)
+	if !reflect.DeepEqual(remaining, want) {
+		t.Errorf("remaining journal entries = %q, want %q", remaining, want)
+	}
+}
@@ -0,0 +1,109 @@
+// nmon2influxdb
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	// timezones are available even if the system has no zoneinfo database
+	_ "time/tzdata"
+)
+
+var offsetRegexp = regexp.MustCompile(`^(?i:UTC|GMT)?([+-])(\d{1,2}):?(\d{2})?$`)
+
+// TimezoneRules allows to put multiple timezone rules in the configuration file
+type TimezoneRules []TimezoneRule
+
+// TimezoneRule sets the timezone of the nmon files whose host and path match the regular expressions.
+// An empty Host or Path matches everything.
+type TimezoneRule struct {
+	Host       string
+	Path       string
+	Timezone   string
+	HostRegexp *regexp.Regexp `toml:",skip"`
+	PathRegexp *regexp.Regexp `toml:",skip"`
+	Location   *time.Location `toml:",skip"`
+}
+
+// LoadTimezone returns the location of a timezone name like Asia/Singapore, or of an UTC offset like +0800, -05:00 or UTC+8.
+// An empty name returns the local timezone.
+func LoadTimezone(tz string) (*time.Location, error) {
+	if len(tz) == 0 {
+		return time.Local, nil
+	}
+	if matched := offsetRegexp.FindStringSubmatch(tz); matched != nil {
+		hours, _ := strconv.Atoi(matched[2])
+		minutes, _ := strconv.Atoi(matched[3])
+		offset := hours*3600 + minutes*60
+		if matched[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(tz, offset), nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %s: %s", tz, err)
+	}
+	return loc, nil
+}
+
+// ParseTimezoneRules compiles the regular expressions and loads the timezones of the rules
+func ParseTimezoneRules(rules TimezoneRules) (TimezoneRules, error) {
+	parsed := make(TimezoneRules, 0, len(rules))
+	for _, rule := range rules {
+		var err error
+		if rule.HostRegexp, err = regexp.Compile(rule.Host); err != nil {
+			return nil, fmt.Errorf("could not compile timezone rule host %s: %s", rule.Host, err)
+		}
+		if rule.PathRegexp, err = regexp.Compile(rule.Path); err != nil {
+			return nil, fmt.Errorf("could not compile timezone rule path %s: %s", rule.Path, err)
+		}
+		if len(rule.Timezone) == 0 {
+			return nil, fmt.Errorf("timezone rule without timezone: host %q path %q", rule.Host, rule.Path)
+		}
+		if rule.Location, err = LoadTimezone(rule.Timezone); err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+// Match returns the location of the first rule matching the host and the file path.
+// Rules with a Host expression don't match while the host is unknown.
+func (rules TimezoneRules) Match(host string, filePath string) (*time.Location, bool) {
+	for _, rule := range rules {
+		if len(rule.Host) > 0 && (len(host) == 0 || !rule.HostRegexp.MatchString(host)) {
+			continue
+		}
+		if len(rule.Path) > 0 && !rule.PathRegexp.MatchString(filePath) {
+			continue
+		}
+		return rule.Location, true
+	}
+	return nil, false
+}
+
+// FileTimezone returns the timezone set on the command line for a nmon file with --file_tz file=timezone.
+// The file is identified by its full name or its base name.
+func FileTimezone(overrides []string, nmonFile File) (*time.Location, bool, error) {
+	for _, override := range overrides {
+		i := strings.LastIndex(override, "=")
+		if i < 1 {
+			return nil, false, fmt.Errorf("invalid file timezone %s: file=timezone expected", override)
+		}
+		name := override[:i]
+		if name != nmonFile.FullName() && name != nmonFile.Name && name != nmonFile.LogName() && name != path.Base(nmonFile.Name) {
+			continue
+		}
+		loc, err := LoadTimezone(override[i+1:])
+		return loc, err == nil, err
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,74 @@
+// nmon2influxdb
+// import nmon data in InfluxDB
+// author: adejoux@djouxtech.net
+
+package nmon2influxdblib
+
+import (
+	"sync"
+	"time"
+
+	"github.com/adejoux/influxdbclient"
+	client "github.com/influxdata/influxdb1-client/v2"
+)
+
+// PointWriter is the set of methods used to store points. It's implemented by influxdbclient.InfluxDB
+type PointWriter interface {
+	AddPoint(measurement string, timestamp time.Time, fields map[string]interface{}, tags map[string]string)
+	WritePoints() error
+	PointsCount() int64
+	ClearPoints()
+}
+
+// DB is the set of methods used to store and query points. It's implemented by InfluxDBv1 and InfluxDBv2
+type DB interface {
+	PointWriter
+	ReadPoints(fields string, filters *influxdbclient.Filters, groupby string, serie string, from string, to string, function string) ([]*influxdbclient.DataSet, error)
+	ReadLastPoint(fields string, filters *influxdbclient.Filters, serie string) (string, error)
+	ListMeasurement(filters *influxdbclient.Filters) (*influxdbclient.TextSet, error)
+	Query(cmd string) ([]client.Result, error)
+	Delete(measurement string, tags map[string]string, from time.Time, to time.Time) error
+	SetPrecision(precision string)
+}
+
+// RateLimiter spreads the writes of concurrent imports to stay under a number of points per second
+type RateLimiter struct {
+	mu   sync.Mutex
+	rate int
+	next time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing rate points per second. No limit is applied if rate is 0.
+func NewRateLimiter(rate int) *RateLimiter {
+	return &RateLimiter{rate: rate}
+}
+
+// Wait blocks until points can be written
+func (limiter *RateLimiter) Wait(points int64) {
+	if limiter == nil || limiter.rate <= 0 {
+		return
+	}
+
+	limiter.mu.Lock()
+	now := time.Now()
+	if limiter.next.Before(now) {
+		limiter.next = now
+	}
+	wait := limiter.next.Sub(now)
+	limiter.next = limiter.next.Add(time.Duration(points) * time.Second / time.Duration(limiter.rate))
+	limiter.mu.Unlock()
+
+	time.Sleep(wait)
+}
+
+// LimitedWriter is a PointWriter waiting for a shared RateLimiter before each write
+type LimitedWriter struct {
+	PointWriter
+	Limiter *RateLimiter
+}
+
+// WritePoints waits for the rate limiter and writes the points
+func (writer *LimitedWriter) WritePoints() error {
+	writer.Limiter.Wait(writer.PointsCount())
+	return writer.PointWriter.WritePoints()
+}